@@ -0,0 +1,299 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// apiKeyHeader carries the API key of requests sent without a session
+const apiKeyHeader = "X-API-Key"
+
+// Scopes of API keys, a key may send the requests any of its scopes allows
+const (
+	// ScopeRead allows reading anything, and streaming events
+	ScopeRead = "read"
+	// ScopeLights allows controlling the lights
+	ScopeLights = "lights"
+	// ScopeMusic allows controlling the music and the playlists
+	ScopeMusic = "music"
+)
+
+const (
+	apiKeyBytes      = 32
+	maxAPIKeyNameLen = 100
+	// apiPrefix is the path every route starts with
+	apiPrefix = "/SmartHouse/1.0.2"
+)
+
+var (
+	ErrUnknownAPIKey = errors.New("unknown API key")
+	errAPIKeyExists  = errors.New("API key exists")
+)
+
+// apiKey is what the API keys bucket stores for the hash of a key
+type apiKey struct {
+	Username string
+	Name     string
+	Scopes   []string
+	// Created and LastUsed are Unix times, LastUsed is 0 until the key is used
+	Created  int64
+	LastUsed int64
+}
+
+// hashAPIKey returns the hash a key is stored under. Keys are random, so
+// unlike passwords they need neither salt nor rounds.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyID identifies the key stored under a hash, it is the tokenID of the
+// key
+func apiKeyID(hash string) string {
+	return hash[:16]
+}
+
+// APIKey lets scripts and devices send requests as a user, with fewer
+// permissions
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Key is sent in the X-API-Key header, it is only returned on creation
+	Key      string     `json:"key,omitempty"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+func newAPIKey(hash string, k apiKey) APIKey {
+	out := APIKey{
+		ID:      apiKeyID(hash),
+		Name:    k.Name,
+		Scopes:  k.Scopes,
+		Created: time.Unix(k.Created, 0).UTC(),
+	}
+	if k.LastUsed != 0 {
+		used := time.Unix(k.LastUsed, 0).UTC()
+		out.LastUsed = &used
+	}
+	return out
+}
+
+// scopesAllow tells whether any of scopes allows a request
+func scopesAllow(scopes []string, r *http.Request) bool {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeRead:
+			if r.Method == "GET" || r.Method == "HEAD" {
+				return true
+			}
+		case ScopeLights:
+			if underPath(path, "/lights") {
+				return true
+			}
+		case ScopeMusic:
+			if underPath(path, "/music") || underPath(path, "/playlists") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func underPath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// checkAPIKey returns a session of the user of a valid API key, limited to
+// its scopes, and records that the key was used
+func (s *Server) checkAPIKey(key string) (session, error) {
+	hash := hashAPIKey(key)
+	k, err := s.db.APIKey(hash)
+	if err != nil {
+		return session{}, errors.New("invalid API key")
+	}
+
+	creds, err := s.db.Credentials(k.Username)
+	if err != nil {
+		return session{}, errors.New("unknown user")
+	}
+
+	now := time.Now().Unix()
+	if now-k.LastUsed >= lastUsedPrecision {
+		if err := s.db.TouchAPIKey(hash, now); err != nil {
+			log.Printf("failed to record use of API key %s: %v", apiKeyID(hash), err)
+		}
+	}
+	return session{
+		Username: k.Username,
+		user:     newUser(k.Username, creds),
+		// Never nil, which would lift the limits
+		scopes: append([]string{}, k.Scopes...),
+	}, nil
+}
+
+// APIKeys lists the API keys of the user, last created first
+func (s *Server) APIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	u, _ := requestUser(r)
+	stored, err := s.db.UserAPIKeys(u.Username)
+	if err != nil {
+		msg := fmt.Sprintf("failed to read API keys: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "API keys failed: %s"}`, msg)))
+		return
+	}
+
+	keys := []APIKey{}
+	for hash, k := range stored {
+		keys = append(keys, newAPIKey(hash, k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.After(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	buf, err := json.Marshal(keys)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "API keys failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+type apiKeyInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// AddAPIKey creates an API key of the user and returns it with the key
+func (s *Server) AddAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var in apiKeyInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add API key failed: %s"}`, msg)))
+		return
+	}
+
+	u, _ := requestUser(r)
+	k, err := s.addAPIKey(u.Username, in)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add API key failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(k)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add API key failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+func (s *Server) addAPIKey(user string, in apiKeyInput) (APIKey, error) {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || len(in.Name) > maxAPIKeyNameLen {
+		return APIKey{}, invalidError(fmt.Sprintf("API keys need a name of at most %d characters", maxAPIKeyNameLen))
+	}
+
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, scope := range in.Scopes {
+		switch scope {
+		case ScopeRead, ScopeLights, ScopeMusic:
+		default:
+			return APIKey{}, invalidError(fmt.Sprintf("invalid scope '%s', expected read, lights or music", scope))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, invalidError("API keys need a scope")
+	}
+
+	stored := apiKey{Username: user, Name: in.Name, Scopes: scopes, Created: time.Now().Unix()}
+	for i := 0; i < maxRetries; i++ {
+		b, err := uuid.GenerateRandomBytes(apiKeyBytes)
+		if err != nil {
+			return APIKey{}, fmt.Errorf("failed to generate key: %v", err)
+		}
+		key := hex.EncodeToString(b)
+
+		hash := hashAPIKey(key)
+		err = s.db.PutAPIKey(hash, stored)
+		if err == errAPIKeyExists {
+			continue
+		}
+		if err != nil {
+			return APIKey{}, fmt.Errorf("failed to put API key: %v", err)
+		}
+
+		k := newAPIKey(hash, stored)
+		k.Key = key
+		return k, nil
+	}
+	return APIKey{}, errors.New("no unused key found")
+}
+
+// RevokeAPIKey deletes one of the API keys of the user
+func (s *Server) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id := mux.Vars(r)["keyID"]
+	u, _ := requestUser(r)
+
+	if err := s.db.DeleteAPIKey(u.Username, id); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownAPIKey {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Revoke API key failed: %s"}`, err)))
+		return
+	}
+	s.events.recheck()
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, revoked API key %s", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
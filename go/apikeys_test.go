@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestAPIKeys(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	if err := c.srv.PutUser("bob", server.RoleGuest, 2); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	if err := c.srv.PutSession("bob", "bob", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	guest := &testClient{t: t, srv: c.srv, url: c.url, token: "bob"}
+
+	// addKey returns a client sending requests with a new API key of owner
+	addKey := func(owner *testClient, body string) (*testClient, server.APIKey) {
+		var k server.APIKey
+		if code := owner.do("POST", "/apikeys", body, &k); code != http.StatusCreated {
+			t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+		}
+		if k.Key == "" || k.ID == "" || k.LastUsed != nil {
+			t.Fatalf("unexpected API key: %+v", k)
+		}
+		return &testClient{t: t, srv: c.srv, url: c.url, apiKey: k.Key}, k
+	}
+
+	for _, tt := range []struct {
+		desc string
+		body string
+	}{
+		{"no name", `{"name": " ", "scopes": ["read"]}`},
+		{"no scopes", `{"name": "tablet", "scopes": []}`},
+		{"unknown scope", `{"name": "tablet", "scopes": ["admin"]}`},
+	} {
+		if code := c.do("POST", "/apikeys", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, http.StatusBadRequest, code)
+		}
+	}
+
+	lights, lightsKey := addKey(c, `{"name": "switch", "scopes": ["lights", "lights"]}`)
+	if len(lightsKey.Scopes) != 1 {
+		t.Fatalf("expected scopes without duplicates, got: %v", lightsKey.Scopes)
+	}
+	reader, _ := addKey(c, `{"name": "dashboard", "scopes": ["read"]}`)
+	tablet, _ := addKey(guest, `{"name": "tablet", "scopes": ["read", "music"]}`)
+
+	for _, tt := range []struct {
+		desc   string
+		client *testClient
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"lights key switches a light", lights, "PUT", "/lights/1/on", "", http.StatusOK},
+		{"lights key adds a light", lights, "POST", "/lights", `{"description": "hall", "channel": 9}`, http.StatusCreated},
+		{"lights key reads settings", lights, "GET", "/settings/home/", "", http.StatusForbidden},
+		{"lights key plays music", lights, "PUT", "/music/play?trackId=1", "", http.StatusForbidden},
+		{"lights key adds a key", lights, "POST", "/apikeys", `{"name": "more", "scopes": ["read"]}`, http.StatusForbidden},
+		{"read key reads settings", reader, "GET", "/settings/home/", "", http.StatusOK},
+		{"read key switches a light", reader, "PUT", "/lights/1/off", "", http.StatusForbidden},
+		{"guest key plays music", tablet, "PUT", "/music/play?trackId=1", "", http.StatusOK},
+		{"guest key reads its light", tablet, "GET", "/lights/2", "", http.StatusOK},
+		{"guest key reads another light", tablet, "GET", "/lights/1", "", http.StatusForbidden},
+		{"unknown key", &testClient{t: t, url: c.url, apiKey: "guess"}, "GET", "/lights", "", http.StatusUnauthorized},
+	} {
+		if code := tt.client.do(tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, tt.code, code)
+		}
+	}
+
+	// Only read keys stream events
+	stream, code := reader.events("", http.Header{"X-Api-Key": {reader.apiKey}})
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	stream.close()
+	if _, code := lights.events("", http.Header{"X-Api-Key": {lights.apiKey}}); code != http.StatusForbidden {
+		t.Fatalf("expected status: %d, got: %d", http.StatusForbidden, code)
+	}
+
+	// Users list their own keys, with their last use
+	var keys []server.APIKey
+	if code := c.do("GET", "/apikeys", "", &keys); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got: %+v", keys)
+	}
+	for _, k := range keys {
+		if k.Key != "" || k.LastUsed == nil {
+			t.Fatalf("expected a used key without its key, got: %+v", k)
+		}
+	}
+
+	// Users only revoke their own keys
+	path := "/apikeys/" + lightsKey.ID
+	if code := guest.do("DELETE", path, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	if code := c.do("DELETE", path, "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := lights.do("PUT", "/lights/1/on", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+}
@@ -1,29 +1,22 @@
 package server
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
-
-	uuid "github.com/hashicorp/go-uuid"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	maxRetries        = 6
-	iterations        = 4096
-	keyLength         = 64
 	expirationSeconds = 60 * 60 * 24 * 7 // 7 days
-	secret            = "esperta"
 )
 
 // Login validates a username and password then returns a session token
-func Login(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	var in loginInput
@@ -35,34 +28,47 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stored := db.UserCredentials(in.Username)
-	if stored == nil {
-		msg := fmt.Sprintf("unregistered user: %s", in.Username)
-		log.Println(msg)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"message": "Login failed: %s"}`, msg)))
+	keys := []string{ipAttempts(r), userAttempts(in.Username)}
+	if wait := s.lockedOut(keys...); wait > 0 {
+		tooManyRequests(w, "Login", clientIP(r), wait)
 		return
 	}
 
-	var creds credential
-	if err := json.Unmarshal(stored, &creds); err != nil {
-		msg := fmt.Sprintf("failed to unmarshal json: %v", err)
-		log.Println(msg)
+	creds, err := s.db.Credentials(in.Username)
+	if err == ErrUnknownUser {
+		// Hash anyway so unregistered users take as long as wrong passwords
+		deriveKey(in.Password, in.Username, algorithmPBKDF2, iterations)
+		log.Printf("unregistered user: %s\n", in.Username)
+		s.failedAttempt(keys...)
+		loginFailed(w)
+		return
+	}
+	if err != nil {
+		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"message": "Login failed: %s"}`, msg)))
+		w.Write([]byte(fmt.Sprintf(`{"message": "Login failed: %s"}`, err)))
 		return
 	}
 
-	key := hash(in.Password, creds.Salt)
-	if key != creds.Key {
-		msg := fmt.Sprintf("incorrect password")
-		log.Println(msg)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"message": "Login failed: %s"}`, msg)))
+	if !creds.matches(in.Password) {
+		log.Printf("incorrect password for %s\n", in.Username)
+		s.failedAttempt(keys...)
+		loginFailed(w)
 		return
 	}
 
-	token, err := newSession()
+	// The client IP keeps its failures, which may be guesses at other users
+	if err := s.db.ClearAttempts(userAttempts(in.Username)); err != nil {
+		log.Printf("failed to clear attempts of %s: %v\n", in.Username, err)
+	}
+
+	if creds.outdated() {
+		if err := s.upgradeCredentials(in.Username, in.Password); err != nil {
+			log.Printf("failed to upgrade credentials of %s: %v\n", in.Username, err)
+		}
+	}
+
+	token, err := s.newSession(newUser(in.Username, creds), device(r))
 	if err != nil || token == "" {
 		msg := fmt.Sprintf("failed to generate session token: %v", err)
 		log.Println(msg)
@@ -79,8 +85,8 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-// Register registers a new house member
-func Register(w http.ResponseWriter, r *http.Request) {
+// Register registers a new house member with an invitation
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	var in regInput
@@ -91,39 +97,49 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if in.Secret != secret {
-		log.Printf("incorrect secret: %v\n", in.Secret)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Registration failed. Wrong secret."))
+	if wait := s.lockedOut(ipAttempts(r)); wait > 0 {
+		tooManyRequests(w, "Register", clientIP(r), wait)
 		return
 	}
 
-	salt, err := uuid.GenerateUUID()
-	if err != nil {
-		log.Printf("failed to generate uuid: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Registration failed."))
+	if in.Username == "" {
+		log.Println("missing username")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Registration failed. Missing username."))
 		return
 	}
-	key := hash(in.Password, salt)
 
-	buf, err := json.Marshal(credential{Key: key, Salt: salt})
+	fresh, err := newCredential(in.Password)
 	if err != nil {
-		log.Printf("failed to marshal (key:%s, salt: %s): %v\n", key, salt, err)
+		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Registration failed."))
 		return
 	}
 
-	err = db.PutUser(in.Username, string(buf))
-	if err != nil {
+	// The invitation sets the role, and is used up with the registration
+	creds, err := s.db.RedeemInvitation(in.Invitation, in.Username, fresh, s.clock.Now())
+	switch {
+	case err == ErrUnknownInvitation:
+		log.Printf("invalid invitation from %s\n", clientIP(r))
+		s.failedAttempt(ipAttempts(r))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Registration failed. Invalid or expired invitation."))
+		return
+	case err == ErrUserExists:
+		log.Printf("user '%s' is already registered\n", in.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Registration failed. Username taken."))
+		return
+	case err != nil:
 		log.Printf("failed to put new user '%s': %v\n", in.Username, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Registration failed."))
 		return
 	}
+	log.Printf("registered %s as %s\n", in.Username, creds.role())
 
-	buf, err = json.Marshal(StatusResponse{Message: "OK"})
+	buf, err := json.Marshal(StatusResponse{Message: "OK"})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -131,47 +147,71 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func hash(pw, salt string) string {
-	key := pbkdf2.Key([]byte(pw), []byte(salt), iterations, keyLength, sha256.New)
-	return base64.StdEncoding.EncodeToString(key)
+// Authenticate rejects requests that don't carry a valid, unexpired session
+// token or a valid API key. The session and its user are passed on with the
+// request, API keys pass on a session limited to their scopes.
+func (s *Server) Authenticate(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sess session
+		var err error
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			sess, err = s.checkAPIKey(key)
+		} else {
+			sess, err = s.checkSession(bearerToken(r))
+		}
+		if err != nil {
+			unauthorized(w, name, err.Error())
+			return
+		}
 
+		inner.ServeHTTP(w, withSession(r, sess))
+	})
 }
 
-// newSession persists and returns a new session token
-func newSession() (token string, err error) {
-	for i := 0; i < maxRetries; i++ {
-		uuid, err := uuid.GenerateUUID()
-		if err != nil {
-			return "", fmt.Errorf("failed to generate uuid: %v", err)
-		}
+// checkSession returns a valid, unexpired session and its user, and records
+// that it was used
+func (s *Server) checkSession(token string) (session, error) {
+	if token == "" {
+		return session{}, errors.New("missing session token")
+	}
+	return s.sessionStore.check(token, time.Now().Unix())
+}
 
-		created, err := db.SessionCreation(uuid)
-		if err != nil {
-			log.Printf("failed to parse creation. deleting token '%s': %v\n", uuid, err)
-			if err = db.DeleteSession(uuid); err != nil {
-				log.Printf("failed to delete token '%s': %v\n", uuid, err)
-				continue
-			}
-		}
-		// Continue to generate a new token if the current one exists
-		if created != 0 {
-			continue
-		}
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
 
-		time := strconv.FormatInt(time.Now().Unix(), 10)
-		err = db.PutSession(uuid, time)
-		if err == nil {
-			token = uuid
-			break
-		}
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
 	}
-	return token, nil
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// loginFailed tells alike of unregistered users and incorrect passwords
+func loginFailed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(`{"message": "Login failed: invalid username or password"}`))
+}
+
+func unauthorized(w http.ResponseWriter, name, msg string) {
+	log.Printf("%s: unauthorized: %s\n", name, msg)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(fmt.Sprintf(`{"message": "Unauthorized: %s"}`, msg)))
+}
+
+// newSession returns the token of a new session of u, logged in from device
+func (s *Server) newSession(u User, device string) (string, error) {
+	now := time.Now().Unix()
+	return s.sessionStore.create(session{Username: u.Username, Device: device, Created: now, LastUsed: now, user: u})
 }
 
 type regInput struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Secret   string `json:"secret"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Invitation string `json:"invitation"`
 }
 
 type loginInput struct {
@@ -182,9 +222,21 @@ type loginInput struct {
 type credential struct {
 	Key  string
 	Salt string
+	// Algorithm and Iterations derived Key, they are empty for keys derived
+	// before they were recorded
+	Algorithm  string `json:",omitempty"`
+	Iterations int    `json:",omitempty"`
+	// Role is empty for users registered before roles, until their roles are
+	// migrated on start
+	Role string
+	// Lights are the lights a guest may control
+	Lights []int
 }
 
-type session struct {
-	Token   string
-	Created int64
+// role returns the role of the user
+func (c credential) role() string {
+	if c.Role == "" {
+		return RoleMember
+	}
+	return c.Role
 }
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "SMARTHOUSE_"
+
+// Config holds the server settings. It is built from defaults, an optional
+// JSON file, SMARTHOUSE_* environment variables and flags, each overriding
+// the previous.
+type Config struct {
+	// Listen is the address the API is served on
+	Listen string `json:"listen"`
+	// Driver is the house controller backend: "serial" or "simulator"
+	Driver string `json:"driver"`
+	Device string `json:"device"`
+	Baud   int    `json:"baud"`
+	// Storage is the bolt database file
+	Storage string `json:"storage"`
+	// Music is the directory tracks are played from, empty for demo tracks
+	Music string `json:"music"`
+	// Player plays the tracks: "mpg123", "command" or "none"
+	Player string `json:"player"`
+	// MPG123 is the mpg123 binary the mpg123 player runs, in remote mode
+	MPG123 string `json:"mpg123"`
+	// PlayerCommand is the command line the command player runs per track,
+	// where {file} and {volume} stand for the track file and the volume in
+	// percent, e.g. "ffplay -nodisp -autoexit -volume {volume} {file}"
+	PlayerCommand string `json:"playerCommand"`
+	// PlayerFormats are the extensions of the files the command and none
+	// players play, mpg123 only plays mp3 files
+	PlayerFormats []string `json:"playerFormats"`
+	// MaxUpload is the size limit of uploaded tracks, in bytes
+	MaxUpload int64 `json:"maxUpload"`
+	// Rooms names the lights created on first start, in Arduino LED order
+	Rooms []string `json:"rooms"`
+	// Admin is the user made admin when the users registered before roles
+	// are migrated, the others become members
+	Admin string `json:"admin"`
+	// Latitude and Longitude locate the house in degrees, north and east
+	// positive, for rules after sunset or before sunrise. Both or neither
+	// are set.
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	// Sessions is the session backend: "bolt" keeps sessions in the database,
+	// "signed" issues tokens signed with SessionKeys, which servers sharing
+	// the keys check without a database
+	Sessions string `json:"sessions"`
+	// SessionKeys sign the tokens of signed sessions, with the first key.
+	// Tokens signed with the others stay valid while keys are rotated.
+	SessionKeys []string `json:"sessionKeys"`
+	// Secret was required to register before invitations, it is ignored
+	//
+	// Deprecated: users register with invitations
+	Secret string `json:"secret,omitempty"`
+}
+
+// DefaultConfig returns the configuration of the house Pi
+func DefaultConfig() Config {
+	return Config{
+		Listen:        "0.0.0.0:8888",
+		Driver:        "serial",
+		Device:        "/dev/ttyACM0",
+		Baud:          9600,
+		Storage:       "auth.db",
+		Music:         "/home/pi/music/",
+		Player:        "mpg123",
+		MPG123:        "mpg123",
+		PlayerFormats: []string{".mp3", ".flac", ".ogg", ".wav"},
+		MaxUpload:     50 << 20,
+		Rooms:         []string{"bedroom-1", "bedroom-2", "living room", "kitchen", "bathroom"},
+		Sessions:      "bolt",
+	}
+}
+
+type option struct {
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var options = []option{
+	{"listen", "address to serve the API on", func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"driver", "house controller backend: serial or simulator", func(c *Config, v string) error {
+		c.Driver = v
+		return nil
+	}},
+	{"device", "serial device of the Arduino", func(c *Config, v string) error {
+		c.Device = v
+		return nil
+	}},
+	{"baud", "baud rate of the Arduino", func(c *Config, v string) (err error) {
+		c.Baud, err = strconv.Atoi(v)
+		return err
+	}},
+	{"storage", "bolt database file", func(c *Config, v string) error {
+		c.Storage = v
+		return nil
+	}},
+	{"music", "music directory, empty to serve demo tracks", func(c *Config, v string) error {
+		c.Music = v
+		return nil
+	}},
+	{"player", "track player: mpg123, command or none", func(c *Config, v string) error {
+		c.Player = v
+		return nil
+	}},
+	{"mpg123", "mpg123 binary of the mpg123 player", func(c *Config, v string) error {
+		c.MPG123 = v
+		return nil
+	}},
+	{"player-command", "command line of the command player, with {file} and {volume} placeholders", func(c *Config, v string) error {
+		c.PlayerCommand = v
+		return nil
+	}},
+	{"player-formats", "comma separated extensions of the files played by the command and none players", func(c *Config, v string) error {
+		c.PlayerFormats = strings.Split(v, ",")
+		for i := range c.PlayerFormats {
+			c.PlayerFormats[i] = strings.TrimSpace(c.PlayerFormats[i])
+		}
+		return nil
+	}},
+	{"max-upload", "size limit of uploaded tracks in bytes", func(c *Config, v string) (err error) {
+		c.MaxUpload, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"rooms", "comma separated light names for the first start, in Arduino LED order", func(c *Config, v string) error {
+		c.Rooms = strings.Split(v, ",")
+		for i := range c.Rooms {
+			c.Rooms[i] = strings.TrimSpace(c.Rooms[i])
+		}
+		return nil
+	}},
+	{"admin", "user registered before roles to make admin, the others become members", func(c *Config, v string) error {
+		c.Admin = v
+		return nil
+	}},
+	{"latitude", "latitude of the house in degrees, north positive, for sunrise and sunset", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		c.Latitude = &f
+		return err
+	}},
+	{"longitude", "longitude of the house in degrees, east positive, for sunrise and sunset", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		c.Longitude = &f
+		return err
+	}},
+	{"sessions", "session backend: bolt or signed", func(c *Config, v string) error {
+		c.Sessions = v
+		return nil
+	}},
+	{"session-keys", "comma separated keys of signed sessions, the first signs new tokens", func(c *Config, v string) error {
+		c.SessionKeys = strings.Split(v, ",")
+		for i := range c.SessionKeys {
+			c.SessionKeys[i] = strings.TrimSpace(c.SessionKeys[i])
+		}
+		return nil
+	}},
+	{"secret", "deprecated and ignored, users register with invitations", func(c *Config, v string) error {
+		c.Secret = v
+		return nil
+	}},
+}
+
+// LoadConfig builds and validates the configuration for the command line args
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("smarthouse", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "JSON configuration file")
+	values := make(map[string]*string)
+	for _, o := range options {
+		values[o.name] = fs.String(o.name, "", fmt.Sprintf("%s (env %s%s)", o.usage, envPrefix, strings.ToUpper(o.name)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to open config: %v", err)
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config %s: %v", *file, err)
+		}
+	}
+
+	for _, o := range options {
+		env := envPrefix + strings.ToUpper(o.name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := o.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("invalid %s: %v", env, err)
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, o := range options {
+		if !set[o.name] {
+			continue
+		}
+		if err := o.set(&cfg, *values[o.name]); err != nil {
+			return cfg, fmt.Errorf("invalid -%s: %v", o.name, err)
+		}
+	}
+
+	if cfg.Secret != "" {
+		log.Println("warning: the secret setting is deprecated and ignored, users register with invitations, see POST /invitations")
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports the first invalid setting
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address '%s': %v", c.Listen, err)
+	}
+
+	switch c.Driver {
+	case "serial":
+		if c.Device == "" {
+			return fmt.Errorf("device is required by the serial driver")
+		}
+		if c.Baud <= 0 {
+			return fmt.Errorf("invalid baud rate: %d", c.Baud)
+		}
+	case "simulator":
+	default:
+		return fmt.Errorf("unknown driver '%s', expected serial or simulator", c.Driver)
+	}
+
+	if c.Storage == "" {
+		return fmt.Errorf("storage is required")
+	}
+
+	if c.Music != "" {
+		info, err := os.Stat(c.Music)
+		if err != nil {
+			return fmt.Errorf("invalid music directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("invalid music directory: %s is not a directory", c.Music)
+		}
+	}
+
+	switch c.Player {
+	case "mpg123":
+		if c.MPG123 == "" {
+			return fmt.Errorf("mpg123 is required by the mpg123 player")
+		}
+	case "command":
+		if !strings.Contains(c.PlayerCommand, "{file}") {
+			return fmt.Errorf("invalid player command '%s': {file} is required", c.PlayerCommand)
+		}
+		fallthrough
+	case "none":
+		if len(c.PlayerFormats) == 0 {
+			return fmt.Errorf("at least one player format is required")
+		}
+		for _, f := range c.PlayerFormats {
+			if !strings.HasPrefix(f, ".") || len(f) < 2 {
+				return fmt.Errorf("invalid player format '%s', expected an extension like .ogg", f)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown player '%s', expected mpg123, command or none", c.Player)
+	}
+
+	if c.MaxUpload <= 0 {
+		return fmt.Errorf("invalid upload size limit: %d", c.MaxUpload)
+	}
+
+	if len(c.Rooms) == 0 {
+		return fmt.Errorf("at least one room is required")
+	}
+	for i, r := range c.Rooms {
+		if r == "" {
+			return fmt.Errorf("room #%d has no name", i+1)
+		}
+	}
+
+	if (c.Latitude == nil) != (c.Longitude == nil) {
+		return fmt.Errorf("latitude and longitude are required together")
+	}
+	if c.Latitude != nil && (math.IsNaN(*c.Latitude) || *c.Latitude < -90 || *c.Latitude > 90) {
+		return fmt.Errorf("invalid latitude: %v", *c.Latitude)
+	}
+	if c.Longitude != nil && (math.IsNaN(*c.Longitude) || *c.Longitude < -180 || *c.Longitude > 180) {
+		return fmt.Errorf("invalid longitude: %v", *c.Longitude)
+	}
+
+	switch c.Sessions {
+	case "bolt":
+	case "signed":
+		if len(c.SessionKeys) == 0 {
+			return fmt.Errorf("at least one session key is required by signed sessions")
+		}
+		for i, k := range c.SessionKeys {
+			if len(k) < minSessionKeyLength {
+				return fmt.Errorf("session key #%d is shorter than %d bytes", i+1, minSessionKeyLength)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown sessions '%s', expected bolt or signed", c.Sessions)
+	}
+	return nil
+}
+
+// sun returns the sunrise and sunset of a day at the configured location, or
+// nil without one
+func (c Config) sun() func(time.Time) (int, int) {
+	if c.Latitude == nil || c.Longitude == nil {
+		return nil
+	}
+	latitude, longitude := *c.Latitude, *c.Longitude
+	return func(t time.Time) (int, int) {
+		return sunTimes(t, latitude, longitude)
+	}
+}
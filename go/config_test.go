@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"listen": "127.0.0.1:9000",
+		"driver": "simulator",
+		"music": "",
+		"rooms": ["hall", "garage"],
+		"baud": 115200,
+		"secret": "esperta"
+	}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	os.Setenv("SMARTHOUSE_LISTEN", "127.0.0.1:9001")
+	os.Setenv("SMARTHOUSE_STORAGE", "env.db")
+	defer os.Unsetenv("SMARTHOUSE_LISTEN")
+	defer os.Unsetenv("SMARTHOUSE_STORAGE")
+
+	cfg, err := server.LoadConfig([]string{"-config", file, "-storage", "flag.db", "-rooms", "hall, attic", "-secret", "ignored"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	expected := server.DefaultConfig()
+	expected.Listen = "127.0.0.1:9001"
+	expected.Driver = "simulator"
+	expected.Music = ""
+	expected.Rooms = []string{"hall", "attic"}
+	expected.Baud = 115200
+	expected.Storage = "flag.db"
+	// The secret from before invitations is still accepted, and ignored
+	expected.Secret = "ignored"
+
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("expected config: %+v, got: %+v", expected, cfg)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tt := []struct {
+		desc   string
+		modify func(c *server.Config)
+	}{
+		{"bad listen", func(c *server.Config) { c.Listen = "8888" }},
+		{"unknown driver", func(c *server.Config) { c.Driver = "bluetooth" }},
+		{"no device", func(c *server.Config) { c.Device = "" }},
+		{"bad baud", func(c *server.Config) { c.Baud = 0 }},
+		{"no storage", func(c *server.Config) { c.Storage = "" }},
+		{"missing music dir", func(c *server.Config) { c.Music = "/does/not/exist" }},
+		{"unknown player", func(c *server.Config) { c.Player = "vlc" }},
+		{"no mpg123", func(c *server.Config) { c.MPG123 = "" }},
+		{"no player file", func(c *server.Config) { c.Player, c.PlayerCommand = "command", "aplay" }},
+		{"bad player format", func(c *server.Config) { c.Player, c.PlayerFormats = "none", []string{"ogg"} }},
+		{"no upload size", func(c *server.Config) { c.MaxUpload = 0 }},
+		{"no rooms", func(c *server.Config) { c.Rooms = nil }},
+		{"empty room", func(c *server.Config) { c.Rooms = []string{"hall", ""} }},
+		{"latitude alone", func(c *server.Config) { c.Latitude = new(float64) }},
+		{"bad latitude", func(c *server.Config) {
+			lat, lon := 91.0, 0.0
+			c.Latitude, c.Longitude = &lat, &lon
+		}},
+		{"unknown sessions", func(c *server.Config) { c.Sessions = "redis" }},
+		{"no session keys", func(c *server.Config) { c.Sessions = "signed" }},
+		{"short session key", func(c *server.Config) {
+			c.Sessions, c.SessionKeys = "signed", []string{strings.Repeat("k", 32), "short"}
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := server.DefaultConfig()
+			cfg.Music = ""
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("expected valid config, got: %v", err)
+			}
+
+			tc.modify(&cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Fatalf("expected validation error")
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Monday
+	from := time.Date(2018, 5, 28, 6, 59, 30, 0, time.UTC)
+
+	for _, tt := range []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2018, 5, 28, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 1-5", time.Date(2018, 5, 28, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 0,6", time.Date(2018, 6, 2, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 7", time.Date(2018, 6, 3, 7, 0, 0, 0, time.UTC)},
+		{"*/15 23 * * *", time.Date(2018, 5, 28, 23, 0, 0, 0, time.UTC)},
+		{"30 6 * * *", time.Date(2018, 5, 29, 6, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Both days restricted, either matches
+		{"0 12 31 * 3", time.Date(2018, 5, 30, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		next, err := server.CronNext(tt.expr, from)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if !next.Equal(tt.expected) {
+			t.Errorf("%s: expected: %v, got: %v", tt.expr, tt.expected, next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := server.CronNext(expr, from); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tarm/serial"
+)
+
+// Driver is the link to the house controller (the Arduino)
+type Driver interface {
+	// Send delivers a single command, e.g. led1_ON or house_auto_OFF
+	Send(cmd string) error
+	// SendBatch delivers several commands in a single write, with no other
+	// command in between
+	SendBatch(cmds []string) error
+	// Lines returns the messages received from the controller
+	Lines() <-chan []byte
+	// State returns the current state of the link
+	State() ConnState
+	Close()
+}
+
+// ConnState is the state of the link to the Arduino
+type ConnState int
+
+const (
+	Disconnected ConnState = iota
+	Connecting
+	Connected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// NewDriver returns the Driver selected by cfg
+func NewDriver(cfg Config) (Driver, error) {
+	switch cfg.Driver {
+	case "serial":
+		return NewSerialConn(&serial.Config{Name: cfg.Device, Baud: cfg.Baud}), nil
+	case "simulator":
+		return NewSimulator(), nil
+	default:
+		return nil, fmt.Errorf("unknown driver: %s", cfg.Driver)
+	}
+}
+
+// Simulator is an in-memory Driver that records the commands it is sent and
+// emits updates on demand
+type Simulator struct {
+	mu       sync.Mutex
+	state    ConnState
+	commands []string
+	lines    chan []byte
+	closed   bool
+	// done is closed on Close to unblock Emit, sending tracks the Emit calls
+	// still using lines
+	done    chan struct{}
+	sending sync.WaitGroup
+}
+
+// NewSimulator returns a connected Simulator
+func NewSimulator() *Simulator {
+	return &Simulator{
+		state: Connected,
+		lines: make(chan []byte, queueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// Send records cmd
+func (s *Simulator) Send(cmd string) error {
+	return s.SendBatch([]string{cmd})
+}
+
+// SendBatch records cmds
+func (s *Simulator) SendBatch(cmds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.state != Connected {
+		return ErrNotConnected
+	}
+	s.commands = append(s.commands, cmds...)
+	return nil
+}
+
+// Lines returns the messages passed to Emit
+func (s *Simulator) Lines() <-chan []byte {
+	return s.lines
+}
+
+// State returns the simulated link state
+func (s *Simulator) State() ConnState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// SetState changes the simulated link state
+func (s *Simulator) SetState(state ConnState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+// Commands returns the commands sent so far
+func (s *Simulator) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Emit sends v as JSON as if the controller had reported it, e.g. a Light
+func (s *Simulator) Emit(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.sending.Add(1)
+	s.mu.Unlock()
+	defer s.sending.Done()
+
+	// The lock isn't held while waiting for the receiver, which may need it
+	select {
+	case s.lines <- buf:
+		return nil
+	case <-s.done:
+		return ErrClosed
+	}
+}
+
+// Close stops the simulator
+func (s *Simulator) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	// lines is closed once no Emit can send on it anymore
+	s.sending.Wait()
+	close(s.lines)
+}
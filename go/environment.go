@@ -5,22 +5,81 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 )
 
+const (
+	// Readings older than this are reported as stale
+	staleAfter = 5 * time.Minute
+
+	defaultHistory   = 24 * time.Hour
+	maxHistoryPoints = 2000
+	// Readings are kept this long
+	historyRetention = 90 * 24 * time.Hour
+)
+
+// SensorData is a reading, or for downsampled history the average of the
+// readings in a time bucket starting at Updated
 type SensorData struct {
-	Value float32 `json:"value"`
-	Unit  string  `json:"unit,omitempty"`
+	Value   float32    `json:"value"`
+	Unit    string     `json:"unit,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Stale   bool       `json:"stale"`
+	Min     *float32   `json:"min,omitempty"`
+	Max     *float32   `json:"max,omitempty"`
+	Count   int        `json:"count,omitempty"`
 }
 
-func Luminosity(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+// SensorReading is a measurement reported by the Arduino, e.g.
+// {"sensor": "temperature", "value": 21.5}
+type SensorReading struct {
+	Sensor string  `json:"sensor"`
+	Value  float32 `json:"value"`
+}
+
+// sensor holds the latest reading of a sensor
+type sensor struct {
+	mu      sync.RWMutex
+	unit    string
+	value   float32
+	updated time.Time
+}
+
+func newSensor(unit string) *sensor {
+	return &sensor{unit: unit}
+}
+
+func (s *sensor) set(value float32, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.value = value
+	s.updated = t
+}
+
+// data returns the latest reading, stale if none arrived recently before now
+func (s *sensor) data(now time.Time) SensorData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	sd := SensorData{
-		Value: 688,
-		Unit:  "Lux",
+		Value: s.value,
+		Unit:  s.unit,
+		Stale: now.Sub(s.updated) > staleAfter,
+	}
+	if !s.updated.IsZero() {
+		updated := s.updated
+		sd.Updated = &updated
 	}
+	return sd
+}
+
+func (s *Server) Luminosity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	buf, err := json.Marshal(sd)
+	buf, err := json.Marshal(s.house.luminosity.data(s.clock.Now()))
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal: %v", err)
 		log.Println(msg)
@@ -32,14 +91,10 @@ func Luminosity(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func Temperature(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Temperature(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	sd := SensorData{
-		Value: 27,
-		Unit:  "Celsius",
-	}
 
-	buf, err := json.Marshal(sd)
+	buf, err := json.Marshal(s.house.temperature.data(s.clock.Now()))
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal: %v", err)
 		log.Println(msg)
@@ -50,3 +105,150 @@ func Temperature(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(buf)
 }
+
+func (s *Server) LuminosityHistory(w http.ResponseWriter, r *http.Request) {
+	s.sensorHistory(w, r, luminosityBucket, s.house.luminosity.unit, "Luminosity history")
+}
+
+func (s *Server) TemperatureHistory(w http.ResponseWriter, r *http.Request) {
+	s.sensorHistory(w, r, temperatureBucket, s.house.temperature.unit, "Temperature history")
+}
+
+// sensorHistory writes the stored readings of a sensor in the requested range,
+// downsampled if a resolution was given or if there are more readings than
+// maxHistoryPoints
+func (s *Server) sensorHistory(w http.ResponseWriter, r *http.Request, name, unit, op string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	from, to, res, err := historyQuery(r.URL.Query(), s.clock.Now())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, op, err)))
+		return
+	}
+
+	readings, err := s.db.Readings(name, from, to)
+	if err != nil {
+		msg := fmt.Sprintf("failed to read history: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, op, msg)))
+		return
+	}
+
+	// Without a resolution, too many readings are downsampled to the finest
+	// resolution allowed
+	if res == 0 && len(readings) > maxHistoryPoints {
+		res = (to.Sub(from) + maxHistoryPoints - 1) / maxHistoryPoints
+	}
+
+	var data []SensorData
+	if res > 0 {
+		data = downsample(readings, from, res, unit)
+	} else {
+		data = make([]SensorData, 0, len(readings))
+		for _, rd := range readings {
+			t := rd.Time
+			data = append(data, SensorData{Value: rd.Value, Unit: unit, Updated: &t})
+		}
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, op, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// sweepReadings deletes the readings older than historyRetention
+func (s *Server) sweepReadings() {
+	before := s.clock.Now().Add(-historyRetention)
+	for _, name := range []string{luminosityBucket, temperatureBucket} {
+		n, err := s.db.DeleteReadingsBefore(name, before)
+		if err != nil {
+			log.Printf("error: failed to delete old %s readings: %v", name, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("deleted %d old %s readings", n, name)
+		}
+	}
+}
+
+// historyQuery parses the from and to (RFC 3339) and resolution (e.g. 15m)
+// query parameters. The range defaults to the 24 hours before now and a zero
+// resolution means no downsampling.
+func historyQuery(q url.Values, now time.Time) (from, to time.Time, res time.Duration, err error) {
+	to = now
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, res, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+
+	from = to.Add(-defaultHistory)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, res, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, res, fmt.Errorf("from must be before to")
+	}
+
+	if v := q.Get("resolution"); v != "" {
+		if res, err = time.ParseDuration(v); err != nil {
+			return from, to, res, fmt.Errorf("invalid resolution: %v", err)
+		}
+		if res <= 0 {
+			return from, to, res, fmt.Errorf("resolution must be positive")
+		}
+		if to.Sub(from)/res > maxHistoryPoints {
+			return from, to, res, fmt.Errorf("resolution too fine, at most %d points allowed", maxHistoryPoints)
+		}
+	}
+	return from, to, res, nil
+}
+
+// downsample aggregates readings into buckets of width res starting at from.
+// Empty buckets are skipped.
+func downsample(readings []reading, from time.Time, res time.Duration, unit string) []SensorData {
+	data := []SensorData{}
+
+	var sum float64
+	for _, rd := range readings {
+		start := from.Add(rd.Time.Sub(from) / res * res)
+
+		if n := len(data); n == 0 || !data[n-1].Updated.Equal(start) {
+			if n > 0 {
+				data[n-1].Value = float32(sum / float64(data[n-1].Count))
+			}
+
+			min, max := rd.Value, rd.Value
+			data = append(data, SensorData{Unit: unit, Updated: &start, Min: &min, Max: &max})
+			sum = 0
+		}
+
+		sd := &data[len(data)-1]
+		sd.Count++
+		sum += float64(rd.Value)
+		if rd.Value < *sd.Min {
+			*sd.Min = rd.Value
+		}
+		if rd.Value > *sd.Max {
+			*sd.Max = rd.Value
+		}
+	}
+
+	if n := len(data); n > 0 {
+		data[n-1].Value = float32(sum / float64(data[n-1].Count))
+	}
+	return data
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of past events kept for clients resuming a stream
+	eventBacklog = 256
+	// Events buffered per client before it is considered too slow and dropped
+	eventBuffer = 64
+
+	keepAliveInterval = 30 * time.Second
+)
+
+// Event types pushed to clients
+const (
+	LightEvent        = "light"
+	LightDeletedEvent = "light_deleted"
+	MusicEvent        = "music"
+	SettingsEvent     = "settings"
+	SensorEvent       = "sensor"
+	// NotifyEvent carries the message of a notify action
+	NotifyEvent = "notify"
+	// ResyncEvent tells a resuming client that events were missed and it
+	// should fetch the current state again
+	ResyncEvent = "resync"
+)
+
+// Event is a change in the house
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// sensorEvent is the data of a SensorEvent
+type sensorEvent struct {
+	Sensor string `json:"sensor"`
+	SensorData
+}
+
+// sees tells whether u may receive ev, guests only receive the events of
+// the routes they may read
+func (u User) sees(ev Event) bool {
+	if u.Role != RoleGuest {
+		return true
+	}
+	switch ev.Type {
+	case SensorEvent, SettingsEvent:
+		return false
+	case LightEvent, LightDeletedEvent:
+		l, ok := ev.Data.(Light)
+		return ok && u.controls(l.ID)
+	}
+	return true
+}
+
+// eventHub fans events out to subscribers and keeps a backlog so clients can
+// resume after a disconnect
+type eventHub struct {
+	mu      sync.Mutex
+	lastID  uint64
+	backlog []Event
+	// subs are the event channels of subscribers, with the channels asking
+	// them to check their credentials again
+	subs map[chan Event]chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]chan struct{})}
+}
+
+// recheck asks all subscribers to check their credentials again, once
+// sessions or API keys were revoked
+func (h *eventHub) recheck() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, check := range h.subs {
+		select {
+		case check <- struct{}{}:
+		default:
+			// A check is already pending
+		}
+	}
+}
+
+// publish records an event and sends it to all subscribers. Subscribers that
+// can't keep up are dropped.
+func (h *eventHub) publish(typ string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	ev := Event{ID: h.lastID, Type: typ, Time: time.Now(), Data: data}
+
+	h.backlog = append(h.backlog, ev)
+	if len(h.backlog) > eventBacklog {
+		h.backlog = h.backlog[1:]
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of new events, and one receiving when the
+// subscriber should check its credentials again. If resuming, the events
+// after lastID are returned too, and missed is true if some are no longer
+// known.
+func (h *eventHub) subscribe(lastID uint64, resume bool) (backlog []Event, missed bool, ch chan Event, check <-chan struct{}, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if resume {
+		if lastID > h.lastID {
+			// The id is from before a restart
+			missed = true
+			backlog = append(backlog, h.backlog...)
+		} else {
+			for _, ev := range h.backlog {
+				if ev.ID > lastID {
+					backlog = append(backlog, ev)
+				}
+			}
+			oldest := h.lastID + 1
+			if len(h.backlog) > 0 {
+				oldest = h.backlog[0].ID
+			}
+			missed = lastID+1 < oldest
+		}
+	}
+
+	ch = make(chan Event, eventBuffer)
+	recheck := make(chan struct{}, 1)
+	h.subs[ch] = recheck
+
+	cancel = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, missed, ch, recheck, cancel
+}
+
+// Events streams house changes as server-sent events. The session token is
+// taken from the Authorization header or, as browsers can't set headers on
+// an EventSource, the access_token query parameter. API keys with the read
+// scope may stream too. Guests only receive the events of the routes they may
+// read. Clients resume with the Last-Event-ID header or lastEventId query
+// parameter. The stream ends when the session expires or is revoked.
+func (s *Server) Events(w http.ResponseWriter, r *http.Request) {
+	authenticate := func() (session, error) {
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			return s.checkAPIKey(key)
+		}
+		token := bearerToken(r)
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+		return s.checkSession(token)
+	}
+
+	sess, err := authenticate()
+	if err != nil {
+		unauthorized(w, "Events", err.Error())
+		return
+	}
+	if sess.scopes != nil && !scopesAllow(sess.scopes, r) {
+		forbidden(w, "Events", fmt.Sprintf("not allowed for API key scopes %s", strings.Join(sess.scopes, ", ")))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "Events failed: streaming unsupported"}`))
+		return
+	}
+	// API keys don't expire
+	var expired <-chan time.Time
+	if sess.scopes == nil {
+		expiry := time.NewTimer(time.Until(time.Unix(sess.Created+expirationSeconds, 0)))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+	var lastID uint64
+	if last != "" {
+		if lastID, err = strconv.ParseUint(last, 10, 64); err != nil {
+			msg := fmt.Sprintf("invalid last event id: %v", err)
+			log.Println(msg)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"message": "Events failed: %s"}`, msg)))
+			return
+		}
+	}
+
+	backlog, missed, events, check, cancel := s.events.subscribe(lastID, last != "")
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if missed {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", ResyncEvent)
+	}
+	for _, ev := range backlog {
+		if sess.user.sees(ev) {
+			writeEvent(w, ev)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	// revoked checks the credentials of the stream again, the user may have
+	// changed too
+	revoked := func() bool {
+		if sess, err = authenticate(); err != nil {
+			fmt.Fprint(w, "event: revoked\ndata: {}\n\n")
+			flusher.Flush()
+			return true
+		}
+		return false
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// Too slow, the client resumes from the last event it got
+				return
+			}
+			if !sess.user.sees(ev) {
+				continue
+			}
+			writeEvent(w, ev)
+		case <-keepAlive.C:
+			if revoked() {
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-check:
+			if revoked() {
+				return
+			}
+		case <-expired:
+			fmt.Fprint(w, "event: expired\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.quit:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev Event) {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("error: failed to marshal event #%d: %v", ev.ID, err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, buf)
+}
@@ -0,0 +1,273 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+// eventStream reads server-sent events
+type eventStream struct {
+	t      *testing.T
+	resp   *http.Response
+	events chan sseEvent
+}
+
+type sseEvent struct {
+	id, typ string
+	data    server.Event
+}
+
+func (c *testClient) events(query string, header http.Header) (*eventStream, int) {
+	req, err := http.NewRequest("GET", c.url+"/events"+query, nil)
+	if err != nil {
+		c.t.Fatalf("failed to create request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("failed to get events: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, resp.StatusCode
+	}
+
+	es := &eventStream{t: c.t, resp: resp, events: make(chan sseEvent, 16)}
+	go func() {
+		defer close(es.events)
+
+		var ev sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				es.events <- ev
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				ev.typ = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(line[len("data: "):]), &ev.data)
+			}
+		}
+	}()
+	return es, resp.StatusCode
+}
+
+func (es *eventStream) next() sseEvent {
+	select {
+	case ev, ok := <-es.events:
+		if !ok {
+			es.t.Fatal("event stream closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		es.t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+func (es *eventStream) close() {
+	es.resp.Body.Close()
+}
+
+func TestEvents(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	bearer := http.Header{"Authorization": {"Bearer " + c.token}}
+
+	if _, code := c.events("", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if _, code := c.events("?access_token=invalid", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+
+	es, code := c.events("", bearer)
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer es.close()
+
+	if code := c.do("PUT", "/lights/2/on", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	light := es.next()
+	if light.typ != server.LightEvent || light.id != "1" {
+		t.Fatalf("expected light event #1, got: %+v", light)
+	}
+	if l := light.data.Data.(map[string]interface{}); l["id"] != 2.0 || l["turnon"] != true {
+		t.Fatalf("expected light #2 on, got: %v", l)
+	}
+
+	if err := sim.Emit(server.SensorReading{Sensor: "temperature", Value: 21.5}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	if sensor := es.next(); sensor.typ != server.SensorEvent {
+		t.Fatalf("expected sensor event, got: %+v", sensor)
+	}
+
+	if code := c.do("PUT", "/music/play?trackId=3", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if music := es.next(); music.typ != server.MusicEvent || music.id != "3" {
+		t.Fatalf("expected music event #3, got: %+v", music)
+	}
+
+	// Resuming replays the events after the last one seen
+	resumed, code := c.events("?access_token="+c.token, http.Header{"Last-Event-ID": {"1"}})
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer resumed.close()
+
+	for _, typ := range []string{server.SensorEvent, server.MusicEvent} {
+		if ev := resumed.next(); ev.typ != typ {
+			t.Fatalf("expected %s event, got: %+v", typ, ev)
+		}
+	}
+
+	// An id from before a restart asks the client to resync
+	stale, code := c.events("?lastEventId=100", bearer)
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer stale.close()
+
+	if ev := stale.next(); ev.typ != server.ResyncEvent {
+		t.Fatalf("expected resync event, got: %+v", ev)
+	}
+}
+
+func TestRevokedEvents(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	if err := c.srv.PutSession("tablet", "admin", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	var k server.APIKey
+	if code := c.do("POST", "/apikeys", `{"name": "dashboard", "scopes": ["read"]}`, &k); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+
+	session, code := c.events("?access_token=tablet", nil)
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer session.close()
+	key, code := c.events("", http.Header{"X-Api-Key": {k.Key}})
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer key.close()
+
+	// Open streams end once their session or API key is revoked
+	tablet := &testClient{t: t, srv: c.srv, url: c.url, token: "tablet"}
+	if code := tablet.do("POST", "/logout", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if ev := session.next(); ev.typ != "revoked" {
+		t.Fatalf("expected revoked event, got: %+v", ev)
+	}
+
+	if code := c.do("DELETE", "/apikeys/"+k.ID, "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if ev := key.next(); ev.typ != "revoked" {
+		t.Fatalf("expected revoked event, got: %+v", ev)
+	}
+}
+
+func TestGuestEvents(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	if err := c.srv.PutUser("bob", server.RoleGuest, 2); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	if err := c.srv.PutSession("bob", "bob", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+
+	es, code := c.events("?access_token=bob", nil)
+	if code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	defer es.close()
+
+	// Guests don't see sensors, settings or the lights they don't control
+	if code := c.do("PUT", "/lights/3/on", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if err := sim.Emit(server.SensorReading{Sensor: "temperature", Value: 21.5}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	if code := c.do("PUT", "/settings/home/", `{"automatic": true, "threshold": 2.5}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/lights/2/on", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	light := es.next()
+	if light.typ != server.LightEvent {
+		t.Fatalf("expected light event, got: %+v", light)
+	}
+	if l := light.data.Data.(map[string]interface{}); l["id"] != 2.0 {
+		t.Fatalf("expected light #2, got: %v", l)
+	}
+}
+
+func TestEventsTokenNotLogged(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	if _, code := c.events("?access_token=leaked-token&lastEventId=3", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	eventually(t, func() bool {
+		return strings.Contains(buf.String(), "GET /SmartHouse/1.0.2/events?lastEventId=3 Events")
+	})
+	if strings.Contains(buf.String(), "leaked-token") {
+		t.Fatalf("expected the token not to be logged, got: %s", buf.String())
+	}
+}
+
+// lockedBuffer is a buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
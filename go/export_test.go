@@ -1,7 +1,126 @@
 package server
 
-// Export regInput and secret for testing
+import (
+	"io"
+	"time"
+)
+
+// Export regInput for testing
 type RegInput regInput
 type LoginInput loginInput
 
-var Secret = secret
+// Invite creates an invitation for role and returns its code
+func (s *Server) Invite(role, username string) (string, error) {
+	inv, err := s.invite("", invitationInput{Role: role, Username: username, ValidHours: defaultInvitationHours})
+	return inv.Code, err
+}
+
+// AdminInvitations returns the codes of the invitations for admins
+func (s *Server) AdminInvitations() ([]string, error) {
+	invitations, err := s.db.Invitations()
+	var codes []string
+	for _, inv := range invitations {
+		if inv.Role == RoleAdmin {
+			codes = append(codes, inv.Code)
+		}
+	}
+	return codes, err
+}
+
+// Export session handling for testing
+const ExpirationSeconds = expirationSeconds
+
+func (s *Server) PutSession(token, user string, created int64) error {
+	return s.db.PutSession(token, session{Username: user, Created: created})
+}
+
+// HasSession tells whether a session token is stored
+func (s *Server) HasSession(token string) bool {
+	_, err := s.db.Session(token)
+	return err == nil
+}
+
+// SweepSessions deletes the expired sessions
+func (s *Server) SweepSessions() {
+	s.sweepSessions()
+}
+
+// PutUser registers a user with the given role and password "password"
+func (s *Server) PutUser(name, role string, lights ...int) error {
+	c, err := newCredential("password")
+	if err != nil {
+		return err
+	}
+	c.Role, c.Lights = role, lights
+	return s.db.PutUser(name, c)
+}
+
+// PutLegacyUser registers a user with password "password" as users were
+// before their hashing and roles were recorded
+func (s *Server) PutLegacyUser(name string) error {
+	key, err := deriveKey("password", name, algorithmPBKDF2, legacyIterations)
+	if err != nil {
+		return err
+	}
+	return s.db.PutUser(name, credential{Key: key, Salt: name})
+}
+
+// Hashing returns the hashing parameters of the password of a user
+func (s *Server) Hashing(name string) (string, int, error) {
+	c, err := s.db.Credentials(name)
+	algorithm, rounds := c.hashing()
+	return algorithm, rounds, err
+}
+
+// NewTestSerialConn returns a SerialConn using open and short backoffs
+func NewTestSerialConn(open func() (io.ReadWriteCloser, error)) *SerialConn {
+	return newSerialConn(open, time.Millisecond, 10*time.Millisecond)
+}
+
+func (s *Server) PutReading(sensor string, t time.Time, value float32) error {
+	return s.db.PutReading(sensor, t, value)
+}
+
+// SweepReadings deletes the readings older than their retention
+func (s *Server) SweepReadings() {
+	s.sweepReadings()
+}
+
+// NewServerWithClock returns a server whose schedules run on clock
+func NewServerWithClock(cfg Config, driver Driver, clock Clock) (*Server, error) {
+	return newServer(cfg, driver, clock)
+}
+
+// RunDueSchedules runs the schedules due by the server's clock
+func (s *Server) RunDueSchedules() {
+	s.runDueSchedules()
+}
+
+// UpdateSensor handles a reading as if the Arduino had sent it
+func (s *Server) UpdateSensor(r SensorReading) {
+	s.updateSensor(r)
+}
+
+// EndTrack acts as if the playing track had ended by itself
+func (s *Server) EndTrack() {
+	s.house.mu.RLock()
+	p := s.house.player
+	s.house.mu.RUnlock()
+	s.house.trackEnded(p, nil, s.startTrack)
+}
+
+// RecordingPlayer returns the player of a server configured with the none
+// player
+func (s *Server) RecordingPlayer() *RecordingPlayer {
+	p, _ := s.player.(*RecordingPlayer)
+	return p
+}
+
+// CronNext returns the first time after t matching a cron expression
+func CronNext(expr string, t time.Time) (time.Time, error) {
+	spec, err := parseCron(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return spec.next(t), nil
+}
@@ -0,0 +1,635 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownLight = errors.New("unknown light")
+	ErrUnknownTrack = errors.New("unknown track")
+	ErrTrackPlaying = errors.New("the track is playing")
+)
+
+// invalidError is returned when a change to the house is rejected
+type invalidError string
+
+func (e invalidError) Error() string { return string(e) }
+
+func isInvalid(err error) bool {
+	_, ok := err.(invalidError)
+	return ok
+}
+
+// unavailableError is returned when the house controller can't be reached
+type unavailableError string
+
+func (e unavailableError) Error() string { return string(e) }
+
+func isUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok
+}
+
+// House is the state of a house: its lights, settings, sensors and music
+// player. It is safe for concurrent use and reads return copies. Every change
+// is published as an event, in the order the changes are made.
+type House struct {
+	mu     sync.RWMutex
+	events *eventHub
+	clock  Clock
+
+	lights   []Light
+	settings Settings
+
+	tracks       []Track
+	queue        *playQueue
+	activeTrack  Track
+	trackPlaying bool
+	trackStarted time.Time
+	trackElapsed time.Duration
+	paused       bool
+	volume       int
+	player       Playback
+
+	temperature *sensor
+	luminosity  *sensor
+}
+
+// NewHouse returns a house with the given lights and tracks, publishing its
+// changes to events. Playing time is measured with clock.
+func NewHouse(lights []Light, tracks []Track, events *eventHub, clock Clock) *House {
+	return &House{
+		events: events,
+		clock:  clock,
+		lights: append([]Light(nil), lights...),
+		settings: Settings{
+			Automatic: false,
+			Threshold: 1,
+		},
+		tracks:      append([]Track(nil), tracks...),
+		queue:       newPlayQueue(),
+		volume:      maxVolume,
+		temperature: newSensor("Celsius"),
+		luminosity:  newSensor("Lux"),
+	}
+}
+
+// Lights returns all lights
+func (h *House) Lights() []Light {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]Light{}, h.lights...)
+}
+
+// Light returns the light with the given id
+func (h *House) Light(id int) (Light, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if i := h.findLight(id); i >= 0 {
+		return h.lights[i], true
+	}
+	return Light{}, false
+}
+
+// LightOnChannel returns the light wired to an Arduino channel
+func (h *House) LightOnChannel(channel int) (Light, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, l := range h.lights {
+		if l.Channel == channel {
+			return l, true
+		}
+	}
+	return Light{}, false
+}
+
+// AddLight adds l. commit runs before the light is added, under the lock,
+// returns it with its id and aborts the change if it fails.
+func (h *House) AddLight(l Light, commit func(Light) (Light, error)) (Light, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l.ID = 0
+	if err := h.validateLight(l); err != nil {
+		return Light{}, err
+	}
+	l, err := commit(l)
+	if err != nil {
+		return Light{}, err
+	}
+
+	h.lights = append(h.lights, l)
+	h.events.publish(LightEvent, l)
+	return l, nil
+}
+
+// UpdateLight applies change to the light with the given id. commit runs
+// before the result is stored, under the lock, and aborts the change if it
+// fails.
+func (h *House) UpdateLight(id int, change func(*Light), commit func(Light) error) (Light, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := h.findLight(id)
+	if i < 0 {
+		return Light{}, ErrUnknownLight
+	}
+
+	l := h.lights[i]
+	change(&l)
+	l.ID = id
+
+	if err := h.validateLight(l); err != nil {
+		return Light{}, err
+	}
+	if err := commit(l); err != nil {
+		return Light{}, err
+	}
+
+	h.lights[i] = l
+	h.events.publish(LightEvent, l)
+	return l, nil
+}
+
+// lightChange sets the brightness of a light, fading over Transition
+type lightChange struct {
+	ID         int
+	Brightness int
+	Transition time.Duration
+}
+
+// UpdateLights applies several changes at once. A change to an unknown light
+// fails on its own, the resulting lights of the others are passed together to
+// commit, which runs under the lock and aborts them all if it fails. The
+// returned errors are in the order of changes, nil for applied changes.
+func (h *House) UpdateLights(changes []lightChange, commit func([]Light) error) []error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	errs := make([]error, len(changes))
+	var lights []Light
+	var index []int
+	for i, c := range changes {
+		j := h.findLight(c.ID)
+		if j < 0 {
+			errs[i] = ErrUnknownLight
+			continue
+		}
+		l := h.lights[j]
+		l.setBrightness(c.Brightness)
+		lights = append(lights, l)
+		index = append(index, j)
+	}
+	if len(lights) == 0 {
+		return errs
+	}
+
+	if err := commit(lights); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+
+	for k, l := range lights {
+		h.lights[index[k]] = l
+		h.events.publish(LightEvent, l)
+	}
+	return errs
+}
+
+// RemoveLight removes the light with the given id. commit runs before the
+// light is removed, under the lock, and aborts the change if it fails.
+func (h *House) RemoveLight(id int, commit func() error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := h.findLight(id)
+	if i < 0 {
+		return ErrUnknownLight
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	h.events.publish(LightDeletedEvent, h.lights[i])
+	h.lights = append(h.lights[:i], h.lights[i+1:]...)
+	return nil
+}
+
+func (h *House) findLight(id int) int {
+	for i, l := range h.lights {
+		if l.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateLight checks l against the other lights
+func (h *House) validateLight(l Light) error {
+	if strings.TrimSpace(l.Description) == "" {
+		return invalidError("description is required")
+	}
+	if l.Channel < 1 {
+		return invalidError(fmt.Sprintf("invalid channel: %d", l.Channel))
+	}
+	if l.Brightness < 0 || l.Brightness > maxBrightness {
+		return invalidError(fmt.Sprintf("invalid brightness: %d", l.Brightness))
+	}
+	for _, other := range h.lights {
+		if other.ID != l.ID && other.Channel == l.Channel {
+			return invalidError(fmt.Sprintf("channel %d is used by light #%d", l.Channel, other.ID))
+		}
+	}
+	return nil
+}
+
+// Settings returns the house settings
+func (h *House) Settings() Settings {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.settings
+}
+
+// UpdateSettings applies change to the settings. commit runs before the
+// result is stored, under the lock, and aborts the change if it fails.
+func (h *House) UpdateSettings(change func(*Settings) error, commit func(Settings) error) (Settings, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.settings
+	if err := change(&s); err != nil {
+		return Settings{}, err
+	}
+	if err := commit(s); err != nil {
+		return Settings{}, err
+	}
+
+	h.settings = s
+	h.events.publish(SettingsEvent, s)
+	return s, nil
+}
+
+// Sensor returns the sensor with the given name, or nil
+func (h *House) Sensor(name string) *sensor {
+	switch name {
+	case temperatureBucket:
+		return h.temperature
+	case luminosityBucket:
+		return h.luminosity
+	default:
+		return nil
+	}
+}
+
+// Tracks returns the available tracks
+func (h *House) Tracks() []Track {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]Track{}, h.tracks...)
+}
+
+// SetTracks replaces the available tracks, the queue is left alone
+func (h *House) SetTracks(tracks []Track) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tracks = append([]Track(nil), tracks...)
+}
+
+// RemoveTrack removes the track with the given id from the available tracks
+// and the queue, unless it is playing. commit runs before the track is
+// removed, under the lock, and aborts the change if it fails.
+func (h *House) RemoveTrack(id int, commit func(Track) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := -1
+	for k, t := range h.tracks {
+		if t.ID == id {
+			i = k
+			break
+		}
+	}
+	if i < 0 {
+		return ErrUnknownTrack
+	}
+	if h.trackPlaying && h.activeTrack.ID == id {
+		return ErrTrackPlaying
+	}
+	if err := commit(h.tracks[i]); err != nil {
+		return err
+	}
+
+	h.tracks = append(h.tracks[:i], h.tracks[i+1:]...)
+	if h.queue.remove(id) {
+		h.events.publish(MusicEvent, h.musicStatus())
+	}
+	return nil
+}
+
+// Track returns the track with the given id
+func (h *House) Track(id int) (Track, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, t := range h.tracks {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Track{}, false
+}
+
+// MusicStatus returns the state of the music player
+func (h *House) MusicStatus() MusicPlayerStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.musicStatus()
+}
+
+func (h *House) musicStatus() MusicPlayerStatus {
+	status := MusicPlayerStatus{
+		State:         h.trackPlaying,
+		Track:         h.activeTrack,
+		Paused:        h.paused,
+		Volume:        h.volume,
+		QueuePosition: h.queue.pos,
+		QueueLength:   len(h.queue.order),
+	}
+	if !h.trackPlaying {
+		return status
+	}
+	if h.player != nil {
+		if pos, duration, ok := h.player.Progress(); ok {
+			status.Elapsed, status.Duration = pos, duration
+			return status
+		}
+	}
+	status.Elapsed = h.elapsed().Seconds()
+	status.Duration = h.activeTrack.Duration
+	return status
+}
+
+// elapsed returns how long the active track has been playing by the clock,
+// for players that don't report their position
+func (h *House) elapsed() time.Duration {
+	if h.paused {
+		return h.trackElapsed
+	}
+	return h.trackElapsed + h.clock.Now().Sub(h.trackStarted)
+}
+
+// Queue returns the play queue
+func (h *House) Queue() Queue {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.queue.snapshot()
+}
+
+// startFunc starts playing t at volume percent. It returns the playback, or
+// nil if nothing is actually played.
+type startFunc func(t Track, volume int) (Playback, error)
+
+// PlayTrack plays t with start. A track not queued yet is queued after the
+// current one.
+func (h *House) PlayTrack(t Track, start startFunc) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.queue.jump(t)
+	err := h.play(start)
+	return h.musicStatus(), err
+}
+
+// PlayQueue queues tracks instead of the queued ones and plays the first
+func (h *House) PlayQueue(tracks []Track, start startFunc) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.queue.replace(tracks)
+	err := h.play(start)
+	return h.musicStatus(), err
+}
+
+// Enqueue queues tracks after the queued ones
+func (h *House) Enqueue(tracks []Track) Queue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.queue.add(tracks)
+	h.events.publish(MusicEvent, h.musicStatus())
+	return h.queue.snapshot()
+}
+
+// ClearQueue stops the music and empties the queue
+func (h *House) ClearQueue() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopMusic()
+	h.queue.replace(nil)
+	h.events.publish(MusicEvent, h.musicStatus())
+}
+
+// SetQueueMode turns shuffling on or off, if shuffle is set, and changes
+// the repeat mode, if repeat is set
+func (h *House) SetQueueMode(shuffle *bool, repeat string) Queue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if shuffle != nil {
+		h.queue.setShuffle(*shuffle)
+	}
+	if repeat != "" {
+		h.queue.repeat = repeat
+	}
+	h.events.publish(MusicEvent, h.musicStatus())
+	return h.queue.snapshot()
+}
+
+// Next plays the next track of the queue, past its end the music stops
+func (h *House) Next(start startFunc) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.queue.order) == 0 {
+		return MusicPlayerStatus{}, invalidError("the queue is empty")
+	}
+	if !h.queue.next(false) {
+		h.stopMusic()
+		h.events.publish(MusicEvent, h.musicStatus())
+		return h.musicStatus(), nil
+	}
+	err := h.play(start)
+	return h.musicStatus(), err
+}
+
+// Previous plays the previous track of the queue
+func (h *House) Previous(start startFunc) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.queue.previous() {
+		return MusicPlayerStatus{}, invalidError("the queue is empty")
+	}
+	err := h.play(start)
+	return h.musicStatus(), err
+}
+
+// PauseMusic pauses or resumes the active track
+func (h *House) PauseMusic(pause bool) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.trackPlaying {
+		return MusicPlayerStatus{}, invalidError("no track is playing")
+	}
+	if pause == h.paused {
+		return h.musicStatus(), nil
+	}
+
+	if h.player != nil {
+		if err := h.player.Pause(); err != nil {
+			return MusicPlayerStatus{}, err
+		}
+	}
+	h.trackElapsed = h.elapsed()
+	h.trackStarted = h.clock.Now()
+	h.paused = pause
+
+	status := h.musicStatus()
+	h.events.publish(MusicEvent, status)
+	return status, nil
+}
+
+// SeekMusic jumps to position seconds in the active track
+func (h *House) SeekMusic(position float64) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.trackPlaying {
+		return MusicPlayerStatus{}, invalidError("no track is playing")
+	}
+	if duration := h.musicStatus().Duration; duration > 0 && position > duration {
+		return MusicPlayerStatus{}, invalidError(fmt.Sprintf("position %.1fs is past the end of the track at %.1fs", position, duration))
+	}
+	if h.player != nil {
+		if err := h.player.Seek(position); err != nil {
+			return MusicPlayerStatus{}, err
+		}
+	}
+	h.trackElapsed = time.Duration(position * float64(time.Second))
+	h.trackStarted = h.clock.Now()
+
+	status := h.musicStatus()
+	h.events.publish(MusicEvent, status)
+	return status, nil
+}
+
+// SetVolume changes the volume in percent, of the active track and of the
+// tracks played next
+func (h *House) SetVolume(volume int) (MusicPlayerStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.player != nil {
+		if err := h.player.SetVolume(volume); err != nil {
+			return MusicPlayerStatus{}, err
+		}
+	}
+	h.volume = volume
+
+	status := h.musicStatus()
+	h.events.publish(MusicEvent, status)
+	return status, nil
+}
+
+// StopMusic stops the playing track, the queue is kept
+func (h *House) StopMusic() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopMusic()
+	h.events.publish(MusicEvent, h.musicStatus())
+}
+
+// play stops the playing track and plays the current track of the queue
+// with start. Once the player exits by itself the queue moves on.
+func (h *House) play(start startFunc) error {
+	h.stopMusic()
+
+	t, ok := h.queue.current()
+	if !ok {
+		h.events.publish(MusicEvent, h.musicStatus())
+		return nil
+	}
+
+	p, err := start(t, h.volume)
+	if err != nil {
+		h.events.publish(MusicEvent, h.musicStatus())
+		return err
+	}
+
+	h.player = p
+	h.trackPlaying = true
+	h.activeTrack = t
+	h.trackStarted = h.clock.Now()
+	h.trackElapsed = 0
+	if p != nil {
+		go func() {
+			h.trackEnded(p, p.Wait(), start)
+		}()
+	}
+
+	h.events.publish(MusicEvent, h.musicStatus())
+	return nil
+}
+
+// trackEnded plays the next track of the queue once the player p exited
+// with err. Nothing happens if p was stopped or replaced in the meantime.
+func (h *House) trackEnded(p Playback, err error, start startFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.trackPlaying || h.player != p {
+		return
+	}
+	h.player = nil
+
+	// Rather stop than run through a queue of tracks that fail to play
+	if err != nil {
+		log.Printf("failed to play %s: %v", h.activeTrack.Name, err)
+		h.stopMusic()
+		h.events.publish(MusicEvent, h.musicStatus())
+		return
+	}
+
+	if !h.queue.next(true) {
+		h.stopMusic()
+		h.events.publish(MusicEvent, h.musicStatus())
+		return
+	}
+	if err := h.play(start); err != nil {
+		log.Printf("failed to play next track: %v", err)
+	}
+}
+
+func (h *House) stopMusic() {
+	if h.player != nil {
+		h.player.Stop()
+		h.player = nil
+	}
+	h.trackPlaying = false
+	h.paused = false
+	h.activeTrack = Track{}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// tags is the metadata of an mp3 file
+type tags struct {
+	Title  string
+	Artist string
+	Album  string
+	// Duration is in seconds, 0 if unknown
+	Duration float64
+}
+
+// maxSyncSearch bounds how far after the ID3 tag the first MPEG frame is
+// looked for
+const maxSyncSearch = 64 * 1024
+
+// readTags reads the ID3v2 tag of an mp3 file, falling back to the ID3v1 tag
+// for missing fields. The duration comes from the TLEN frame, else from the
+// first MPEG frame. Files without tags yield empty tags.
+func readTags(file string) (tags, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return tags{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return tags{}, err
+	}
+
+	var t tags
+	audio, err := readID3v2(f, info.Size(), &t)
+	if err != nil {
+		return tags{}, err
+	}
+
+	end := info.Size()
+	if end >= 128 {
+		v1 := make([]byte, 128)
+		if _, err := f.ReadAt(v1, end-128); err != nil {
+			return tags{}, err
+		}
+		if string(v1[:3]) == "TAG" {
+			end -= 128
+			if t.Title == "" {
+				t.Title = latin1(v1[3:33])
+			}
+			if t.Artist == "" {
+				t.Artist = latin1(v1[33:63])
+			}
+			if t.Album == "" {
+				t.Album = latin1(v1[63:93])
+			}
+		}
+	}
+
+	if t.Duration == 0 {
+		t.Duration = mpegDuration(f, audio, end)
+	}
+	return t, nil
+}
+
+// readID3v2 fills t from the ID3v2 tag at the start of r, of fileSize bytes,
+// if any, and returns where the audio starts. Tags larger than the file are
+// skipped.
+func readID3v2(r io.ReaderAt, fileSize int64, t *tags) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if string(header[:3]) != "ID3" {
+		return 0, nil
+	}
+
+	version := header[3]
+	size := syncsafe(header[6:10])
+	if int64(10+size) > fileSize {
+		return 0, nil
+	}
+	body := make([]byte, size)
+	if _, err := r.ReadAt(body, 10); err != nil && err != io.EOF {
+		return 0, err
+	}
+	audio := int64(10 + size)
+	if version < 2 || version > 4 {
+		return audio, nil
+	}
+
+	// Skip the extended header
+	if header[5]&0x40 != 0 && version > 2 && len(body) >= 4 {
+		ext := int(binary.BigEndian.Uint32(body[:4])) + 4
+		if version == 4 {
+			ext = syncsafe(body[:4])
+		}
+		if ext > len(body) {
+			return audio, nil
+		}
+		body = body[ext:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var n int
+		switch version {
+		case 2:
+			n = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(body[4:8]))
+		case 4:
+			n = syncsafe(body[4:8])
+		}
+		if n < 0 || headerLen+n > len(body) {
+			break
+		}
+		data := body[headerLen : headerLen+n]
+		body = body[headerLen+n:]
+
+		switch id {
+		case "TIT2", "TT2":
+			t.Title = text(data)
+		case "TPE1", "TP1":
+			t.Artist = text(data)
+		case "TALB", "TAL":
+			t.Album = text(data)
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(text(data)); err == nil && ms > 0 {
+				t.Duration = float64(ms) / 1000
+			}
+		}
+	}
+	return audio, nil
+}
+
+// syncsafe decodes a 28 bit integer stored in 4 bytes of 7 bits
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// text decodes the value of an ID3v2 text frame
+func text(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+
+	enc, data := data[0], data[1:]
+	switch enc {
+	case 1, 2:
+		// UTF-16 with a byte order mark, or big endian without
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			data = data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			u := order.Uint16(data[i:])
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	case 3:
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		return strings.TrimSpace(string(data))
+	default:
+		return latin1(data)
+	}
+}
+
+// latin1 decodes a NUL padded ISO-8859-1 string
+func latin1(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+var (
+	// bitrates of MPEG layer III in kbit/s, for MPEG 1 and MPEG 2 and 2.5
+	mpeg1Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	// sample rates of MPEG 1 in Hz, halved for MPEG 2 and quartered for 2.5
+	mpeg1SampleRates = [4]int{44100, 48000, 32000, 0}
+)
+
+// mpegDuration estimates the duration in seconds of the MPEG layer III audio
+// between start and end of r. VBR files are measured with their Xing or Info
+// header, others by their bitrate. It returns 0 if no frame is found.
+func mpegDuration(r io.ReaderAt, start, end int64) float64 {
+	buf := make([]byte, maxSyncSearch)
+	n, err := r.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0
+	}
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		h := buf[i:]
+		// Frame sync, layer III and a valid bitrate and sample rate
+		if h[0] != 0xff || h[1]&0xe0 != 0xe0 || (h[1]>>1)&0x3 != 1 {
+			continue
+		}
+		version := (h[1] >> 3) & 0x3
+		bitrateIndex := h[2] >> 4
+		rateIndex := (h[2] >> 2) & 0x3
+		if version == 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+
+		mono := h[3]>>6 == 3
+		bitrate := mpeg1Bitrates[bitrateIndex]
+		sampleRate := mpeg1SampleRates[rateIndex]
+		samples := 1152
+		side := 32
+		if mono {
+			side = 17
+		}
+		if version != 3 {
+			bitrate = mpeg2Bitrates[bitrateIndex]
+			sampleRate /= 2
+			if version == 0 {
+				sampleRate /= 2
+			}
+			samples = 576
+			side = 17
+			if mono {
+				side = 9
+			}
+		}
+
+		// A Xing or Info header in the first frame counts the frames
+		if x := i + 4 + side; x+12 <= len(buf) {
+			tag := string(buf[x : x+4])
+			flags := binary.BigEndian.Uint32(buf[x+4 : x+8])
+			if (tag == "Xing" || tag == "Info") && flags&0x1 != 0 {
+				frames := binary.BigEndian.Uint32(buf[x+8 : x+12])
+				return float64(frames) * float64(samples) / float64(sampleRate)
+			}
+		}
+
+		audio := end - start - int64(i)
+		return float64(audio*8) / float64(bitrate*1000)
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+const (
+	// defaultInvitationHours is how long invitations are valid by default
+	defaultInvitationHours = 7 * 24
+	// maxInvitationHours bounds how long invitations are valid
+	maxInvitationHours = 30 * 24
+)
+
+var (
+	ErrUnknownInvitation = errors.New("unknown or expired invitation")
+	ErrUserExists        = errors.New("username taken")
+)
+
+// Invitation lets one user register, with a preset role, until it expires
+type Invitation struct {
+	ID string `json:"id"`
+	// Code is presented to register, it is only returned on creation
+	Code string `json:"code,omitempty"`
+	Role string `json:"role"`
+	// Lights are the lights a guest may control
+	Lights []int `json:"lights,omitempty"`
+	// Username is the only name the invitation registers, any if empty
+	Username  string    `json:"username,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+type invitationInput struct {
+	// Role defaults to member
+	Role     string `json:"role"`
+	Lights   []int  `json:"lights"`
+	Username string `json:"username"`
+	// ValidHours defaults to a week
+	ValidHours int `json:"validHours"`
+}
+
+// Invitations lists the outstanding invitations, first to expire first
+func (s *Server) Invitations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	stored, err := s.db.Invitations()
+	if err != nil {
+		msg := fmt.Sprintf("failed to read invitations: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Invitations failed: %s"}`, msg)))
+		return
+	}
+
+	now := s.clock.Now()
+	invitations := []Invitation{}
+	for _, inv := range stored {
+		if !inv.Expires.After(now) {
+			continue
+		}
+		inv.ID = tokenID(inv.Code)
+		inv.Code = ""
+		invitations = append(invitations, inv)
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		if !invitations[i].Expires.Equal(invitations[j].Expires) {
+			return invitations[i].Expires.Before(invitations[j].Expires)
+		}
+		return invitations[i].ID < invitations[j].ID
+	})
+
+	buf, err := json.Marshal(invitations)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Invitations failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddInvitation creates an invitation and returns it with its code
+func (s *Server) AddInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	in := invitationInput{Role: RoleMember, ValidHours: defaultInvitationHours}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add invitation failed: %s"}`, msg)))
+		return
+	}
+
+	u, _ := requestUser(r)
+	inv, err := s.invite(u.Username, in)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add invitation failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(inv)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add invitation failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// invite persists a new invitation created by a user
+func (s *Server) invite(by string, in invitationInput) (Invitation, error) {
+	lights, err := s.checkRole(roleInput{Role: in.Role, Lights: in.Lights})
+	if err != nil {
+		return Invitation{}, err
+	}
+	if in.ValidHours <= 0 || in.ValidHours > maxInvitationHours {
+		return Invitation{}, invalidError(fmt.Sprintf("invalid validity %dh, expected 1 to %dh", in.ValidHours, maxInvitationHours))
+	}
+	if in.Username != "" && s.db.UserCredentials(in.Username) != nil {
+		return Invitation{}, invalidError(fmt.Sprintf("user %s is already registered", in.Username))
+	}
+
+	now := s.clock.Now()
+	inv := Invitation{
+		Role:      in.Role,
+		Lights:    lights,
+		Username:  in.Username,
+		CreatedBy: by,
+		Created:   now,
+		Expires:   now.Add(time.Duration(in.ValidHours) * time.Hour),
+	}
+	for i := 0; i < maxRetries; i++ {
+		inv.Code, err = uuid.GenerateUUID()
+		if err != nil {
+			return Invitation{}, fmt.Errorf("failed to generate uuid: %v", err)
+		}
+
+		err = s.db.PutInvitation(inv)
+		if err == errInvitationExists {
+			continue
+		}
+		if err != nil {
+			return Invitation{}, fmt.Errorf("failed to put invitation: %v", err)
+		}
+
+		inv.ID = tokenID(inv.Code)
+		return inv, nil
+	}
+	return Invitation{}, errors.New("no unused code found")
+}
+
+// RevokeInvitation deletes an outstanding invitation
+func (s *Server) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id := mux.Vars(r)["invitationID"]
+	if err := s.db.DeleteInvitation(id); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownInvitation {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Revoke invitation failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, revoked invitation %s", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// inviteFirstAdmin logs an invitation for the first admin of a house without
+// admins. Restarts log the unexpired invitation again, revoking any other.
+func (s *Server) inviteFirstAdmin() error {
+	invitations, err := s.db.Invitations()
+	if err != nil {
+		return fmt.Errorf("failed to read invitations: %v", err)
+	}
+
+	var inv Invitation
+	now := s.clock.Now()
+	for _, other := range invitations {
+		if other.Role != RoleAdmin || other.CreatedBy != "" || !other.Expires.After(now) {
+			continue
+		}
+		if other.Expires.After(inv.Expires) {
+			inv, other = other, inv
+		}
+		if other.Code == "" {
+			continue
+		}
+		if err := s.db.DeleteInvitation(tokenID(other.Code)); err != nil {
+			return fmt.Errorf("failed to revoke invitation: %v", err)
+		}
+	}
+
+	if inv.Code == "" {
+		inv, err = s.invite("", invitationInput{Role: RoleAdmin, ValidHours: defaultInvitationHours})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("no admin yet, register the admin with invitation code %s before %s\n", inv.Code, inv.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// sweepInvitations deletes expired invitations
+func (s *Server) sweepInvitations() {
+	n, err := s.db.DeleteExpiredInvitations(s.clock.Now())
+	if err != nil {
+		log.Printf("error: failed to delete expired invitations: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("deleted %d expired invitations", n)
+	}
+}
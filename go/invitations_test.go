@@ -0,0 +1,179 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestInvitations(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	invite := func(body string) server.Invitation {
+		var inv server.Invitation
+		if code := c.do("POST", "/invitations", body, &inv); code != http.StatusCreated {
+			t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+		}
+		if inv.Code == "" || inv.ID == "" {
+			t.Fatalf("expected a code and an id, got: %+v", inv)
+		}
+		return inv
+	}
+	register := func(name, code string) int {
+		body := fmt.Sprintf(`{"username": %q, "password": "pw", "invitation": %q}`, name, code)
+		resp, err := http.Post(c.url+"/register", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to register: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		desc string
+		body string
+	}{
+		{"unknown role", `{"role": "owner"}`},
+		{"unknown light", `{"role": "guest", "lights": [42]}`},
+		{"no validity", `{"validHours": 0}`},
+		{"too long", `{"validHours": 10000}`},
+		{"registered user", `{"username": "admin"}`},
+	} {
+		if code := c.do("POST", "/invitations", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, http.StatusBadRequest, code)
+		}
+	}
+
+	guest := invite(`{"role": "guest", "lights": [2, 2], "username": "dave", "validHours": 2}`)
+	if guest.Role != server.RoleGuest || !reflect.DeepEqual(guest.Lights, []int{2}) || guest.CreatedBy != "admin" {
+		t.Fatalf("unexpected invitation: %+v", guest)
+	}
+	if !guest.Expires.Equal(clock.Now().Add(2 * time.Hour)) {
+		t.Fatalf("expected expiry: %v, got: %v", clock.Now().Add(2*time.Hour), guest.Expires)
+	}
+
+	// Codes are only shown on creation
+	var invitations []server.Invitation
+	if code := c.do("GET", "/invitations", "", &invitations); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	listed := false
+	for _, inv := range invitations {
+		if inv.Code != "" {
+			t.Fatalf("expected no code, got: %+v", inv)
+		}
+		listed = listed || inv.ID == guest.ID
+	}
+	if !listed {
+		t.Fatalf("expected invitation %s listed, got: %+v", guest.ID, invitations)
+	}
+
+	// Preset usernames are enforced, and invitations are single use
+	if code := register("erin", guest.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code := register("dave", guest.Code); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := register("dave", guest.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	var users []server.User
+	if code := c.do("GET", "/users", "", &users); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expected := []server.User{
+		{Username: "admin", Role: server.RoleAdmin},
+		{Username: "dave", Role: server.RoleGuest, Lights: []int{2}},
+	}
+	if !reflect.DeepEqual(users, expected) {
+		t.Fatalf("expected users: %+v, got: %+v", expected, users)
+	}
+
+	// Taken usernames don't use up the invitation
+	member := invite(`{}`)
+	if code := register("dave", member.Code); code != http.StatusConflict {
+		t.Fatalf("expected status: %d, got: %d", http.StatusConflict, code)
+	}
+
+	// Revoked invitations can't register
+	path := "/invitations/" + member.ID
+	if code := c.do("DELETE", path, "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", path, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	if code := register("frank", member.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// Nor can expired ones, which aren't listed
+	expiring := invite(`{"validHours": 1}`)
+	clock.Advance(time.Hour)
+	if code := register("frank", expiring.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	invitations = nil
+	if code := c.do("GET", "/invitations", "", &invitations); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	for _, inv := range invitations {
+		if inv.ID == expiring.ID || inv.ID == member.ID || inv.ID == guest.ID {
+			t.Fatalf("expected invitation %s not listed", inv.ID)
+		}
+	}
+
+	if code := register("frank", invite(`{}`).Code); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+}
+
+func TestFirstAdminInvitation(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Restarts without users keep the first invitation
+	var codes []string
+	for i := 0; i < 3; i++ {
+		sim := server.NewSimulator()
+		s, err := server.NewServer(testConfig(filepath.Join(dir, "test.db")), sim)
+		if err != nil {
+			t.Fatalf("failed to create server: %v", err)
+		}
+		got, err := s.AdminInvitations()
+		s.Close()
+		sim.Close()
+		if err != nil {
+			t.Fatalf("failed to read invitations: %v", err)
+		}
+		if len(got) != 1 || (codes != nil && got[0] != codes[0]) {
+			t.Fatalf("start %d: expected invitation %v, got: %v", i+1, codes, got)
+		}
+		codes = got
+	}
+}
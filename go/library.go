@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// libraryEntry is an indexed track and the state of its file when it was
+// indexed
+type libraryEntry struct {
+	Track   Track     `json:"track"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// LibraryScan reports the changes found by indexing the music directory
+type LibraryScan struct {
+	Tracks  int `json:"tracks"`
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+// scanLibrary indexes the files under dir with the given extensions and
+// returns the tracks ordered by id. Known files keep their id and are only
+// read again if they changed, the ids of removed files are not reused. Only
+// mp3 files have their tags read.
+func scanLibrary(db *AuthStore, dir string, formats []string) ([]Track, LibraryScan, error) {
+	entries, err := db.LibraryEntries()
+	if err != nil {
+		return nil, LibraryScan{}, fmt.Errorf("failed to read library: %v", err)
+	}
+	known := make(map[string]libraryEntry, len(entries))
+	for _, e := range entries {
+		known[e.Track.Name] = e
+	}
+
+	var scan LibraryScan
+	var changed []libraryEntry
+	found := make(map[string]bool)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Printf("skipping %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() || !hasFormat(path, formats) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		found[name] = true
+
+		e, ok := known[name]
+		if ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		var tags tags
+		if strings.EqualFold(filepath.Ext(path), ".mp3") {
+			if tags, err = readTags(path); err != nil {
+				log.Printf("failed to read tags of %s: %v", name, err)
+			}
+		}
+		e.Track = Track{
+			ID:       e.Track.ID,
+			Name:     name,
+			Title:    tags.Title,
+			Artist:   tags.Artist,
+			Album:    tags.Album,
+			Duration: tags.Duration,
+		}
+		e.Size = info.Size()
+		e.ModTime = info.ModTime()
+		changed = append(changed, e)
+
+		if ok {
+			scan.Updated++
+		} else {
+			scan.Added++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, LibraryScan{}, fmt.Errorf("failed to read music dir: %v", err)
+	}
+
+	var removed []int
+	for name, e := range known {
+		if !found[name] {
+			removed = append(removed, e.Track.ID)
+		}
+	}
+	scan.Removed = len(removed)
+
+	if err := db.UpdateLibrary(changed, removed); err != nil {
+		return nil, LibraryScan{}, fmt.Errorf("failed to update library: %v", err)
+	}
+
+	entries, err = db.LibraryEntries()
+	if err != nil {
+		return nil, LibraryScan{}, fmt.Errorf("failed to read library: %v", err)
+	}
+	tracks := make([]Track, len(entries))
+	for i, e := range entries {
+		tracks[i] = e.Track
+	}
+	scan.Tracks = len(tracks)
+	return tracks, scan, nil
+}
+
+// hasFormat tells whether file has one of the extensions, ignoring case
+func hasFormat(file string, formats []string) bool {
+	ext := filepath.Ext(file)
+	for _, f := range formats {
+		if strings.EqualFold(ext, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// rescan indexes the music directory again and serves the tracks found
+func (s *Server) rescan() (LibraryScan, error) {
+	if s.cfg.Music == "" {
+		return LibraryScan{}, invalidError("no music directory is configured")
+	}
+
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+
+	tracks, scan, err := scanLibrary(s.db, s.cfg.Music, s.player.Formats())
+	if err != nil {
+		return LibraryScan{}, err
+	}
+	s.house.SetTracks(tracks)
+	return scan, nil
+}
+
+// RescanMusic indexes the music directory again
+func (s *Server) RescanMusic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	scan, err := s.rescan()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Rescan failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(scan)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Rescan failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// trackTypes are the content types accepted for uploaded tracks, besides none
+var trackTypes = map[string]bool{
+	"audio/mpeg":               true,
+	"audio/mp3":                true,
+	"audio/mpeg3":              true,
+	"audio/flac":               true,
+	"audio/x-flac":             true,
+	"audio/ogg":                true,
+	"application/ogg":          true,
+	"audio/wav":                true,
+	"audio/x-wav":              true,
+	"audio/wave":               true,
+	"application/octet-stream": true,
+}
+
+// isTrack tells whether head, the start of a file with extension ext, looks
+// like audio of that format. Formats it doesn't know are accepted.
+func isTrack(ext string, head []byte) bool {
+	has := func(magic string) bool { return strings.HasPrefix(string(head), magic) }
+	switch strings.ToLower(ext) {
+	case ".mp3":
+		// An ID3 tag or an MPEG frame
+		return has("ID3") || len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0
+	case ".flac":
+		return has("fLaC")
+	case ".ogg":
+		return has("OggS")
+	case ".wav":
+		return has("RIFF")
+	default:
+		return true
+	}
+}
+
+// uploadError is returned when an uploaded track is rejected
+type uploadError struct {
+	code int
+	msg  string
+}
+
+func (e uploadError) Error() string { return e.msg }
+
+// UploadTrack adds a track to the music directory from the "file" part of a
+// multipart form. The file is written under a temporary name and only linked
+// into place once complete, so rescans never index a partial upload.
+func (s *Server) UploadTrack(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	t, err := s.uploadTrack(r)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch e := err.(type) {
+		case uploadError:
+			code = e.code
+		case invalidError:
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Upload failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(t)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Upload failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+func (s *Server) uploadTrack(r *http.Request) (Track, error) {
+	if s.cfg.Music == "" {
+		return Track{}, invalidError("no music directory is configured")
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return Track{}, invalidError(fmt.Sprintf("failed to read form: %v", err))
+	}
+	var part io.Reader
+	var filename, contentType string
+	for part == nil {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return Track{}, invalidError("file is required")
+		}
+		if err != nil {
+			return Track{}, invalidError(fmt.Sprintf("failed to read form: %v", err))
+		}
+		if p.FormName() == "file" {
+			part, filename, contentType = p, p.FileName(), p.Header.Get("Content-Type")
+		}
+	}
+
+	name := filepath.Base(filepath.FromSlash(filename))
+	if filename == "" || strings.HasPrefix(name, ".") || hasControl(name) {
+		return Track{}, invalidError(fmt.Sprintf("invalid file name: %q", filename))
+	}
+	if !hasFormat(name, s.player.Formats()) {
+		return Track{}, uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("the player can't play %s", name)}
+	}
+	if contentType != "" {
+		if t, _, err := mime.ParseMediaType(contentType); err != nil || !trackTypes[t] {
+			return Track{}, uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type: %s", contentType)}
+		}
+	}
+
+	br := bufio.NewReader(part)
+	head, _ := br.Peek(4)
+	if !isTrack(filepath.Ext(name), head) {
+		return Track{}, uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not a %s file", name, filepath.Ext(name))}
+	}
+
+	tmp, err := ioutil.TempFile(s.cfg.Music, ".upload-*.tmp")
+	if err != nil {
+		return Track{}, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(br, s.cfg.MaxUpload+1))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Track{}, fmt.Errorf("failed to write file: %v", err)
+	}
+	if n > s.cfg.MaxUpload {
+		return Track{}, uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("the file is larger than %d bytes", s.cfg.MaxUpload)}
+	}
+
+	// Linking fails rather than replace an existing track
+	if err := os.Link(tmp.Name(), filepath.Join(s.cfg.Music, name)); err != nil {
+		if os.IsExist(err) {
+			return Track{}, uploadError{http.StatusConflict, fmt.Sprintf("the track exists: %s", name)}
+		}
+		return Track{}, fmt.Errorf("failed to add file: %v", err)
+	}
+
+	if _, err := s.rescan(); err != nil {
+		return Track{}, err
+	}
+	for _, t := range s.house.Tracks() {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return Track{}, fmt.Errorf("the track was not indexed: %s", name)
+}
+
+// DeleteTrack removes a track from the music directory. The playing track
+// can't be deleted.
+func (s *Server) DeleteTrack(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["trackID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete track failed: %s"}`, msg)))
+		return
+	}
+
+	err = s.deleteTrack(id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case err == ErrUnknownTrack:
+			code = http.StatusNotFound
+		case err == ErrTrackPlaying:
+			code = http.StatusConflict
+		case isInvalid(err):
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete track failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted track #%d", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func (s *Server) deleteTrack(id int) error {
+	if s.cfg.Music == "" {
+		return invalidError("no music directory is configured")
+	}
+
+	// Keep rescans from indexing the track again while it is deleted
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+
+	return s.house.RemoveTrack(id, func(t Track) error {
+		file := filepath.Join(s.cfg.Music, filepath.FromSlash(t.Name))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove file: %v", err)
+		}
+		return s.db.UpdateLibrary(nil, []int{id})
+	})
+}
+
+// trackFilter selects tracks: artist and album match whole values and
+// search matches part of the name, title, artist or album, all ignoring case
+type trackFilter struct {
+	Artist string
+	Album  string
+	Search string
+}
+
+func (f trackFilter) match(t Track) bool {
+	if f.Artist != "" && !strings.EqualFold(t.Artist, f.Artist) {
+		return false
+	}
+	if f.Album != "" && !strings.EqualFold(t.Album, f.Album) {
+		return false
+	}
+	if f.Search == "" {
+		return true
+	}
+
+	search := strings.ToLower(f.Search)
+	for _, v := range []string{t.Name, t.Title, t.Artist, t.Album} {
+		if strings.Contains(strings.ToLower(v), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasControl tells whether name contains control characters, e.g. a newline
+// that would end an mpg123 command
+func hasControl(name string) bool {
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+// id3v2 returns an ID3v2 tag of the given version with frames, a list of
+// frame ids and their encoded values
+func id3v2(version byte, frames ...string) []byte {
+	var body bytes.Buffer
+	for i := 0; i+1 < len(frames); i += 2 {
+		body.WriteString(frames[i])
+		size := uint32(len(frames[i+1]))
+		if version == 4 {
+			size = size&0x7f | (size>>7&0x7f)<<8 | (size>>14&0x7f)<<16
+		}
+		binary.Write(&body, binary.BigEndian, size)
+		body.Write([]byte{0, 0})
+		body.WriteString(frames[i+1])
+	}
+
+	n := body.Len()
+	header := []byte{'I', 'D', '3', version, 0, 0, byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	return append(header, body.Bytes()...)
+}
+
+// utf16Text encodes an ID3v2 text frame value in little endian UTF-16
+func utf16Text(s string) string {
+	buf := []byte{1, 0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(s)) {
+		buf = append(buf, byte(u), byte(u>>8))
+	}
+	return string(buf)
+}
+
+// id3v1 returns an ID3v1 tag
+func id3v1(title, artist, album string) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	return tag
+}
+
+// mpegFrames returns n bytes of MPEG 1 layer III audio at 128 kbit/s and
+// 44.1 kHz. With xing set the first frame has a Xing header counting frames.
+func mpegFrames(n int, xing uint32) []byte {
+	audio := make([]byte, n)
+	copy(audio, []byte{0xff, 0xfb, 0x90, 0x00})
+	if xing > 0 {
+		copy(audio[36:], "Xing")
+		binary.BigEndian.PutUint32(audio[40:], 1)
+		binary.BigEndian.PutUint32(audio[44:], xing)
+	}
+	return audio
+}
+
+func TestLibrary(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	music := filepath.Join(dir, "music")
+	write := func(name string, parts ...[]byte) {
+		file := filepath.Join(music, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(file, bytes.Join(parts, nil), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	write("Queen/A Night at the Opera/01 Bohemian.mp3",
+		id3v2(3, "TIT2", "\x00Bohemian Rhapsody", "TPE1", utf16Text("Queen"), "TALB", "\x00A Night at the Opera", "TLEN", "\x00354000"),
+		mpegFrames(1000, 0))
+	write("Queen/News of the World/01 We Will.mp3",
+		id3v2(4, "TIT2", "\x03We Will Rock You\x00", "TPE1", "\x03Queen", "TALB", "\x03News of the World"),
+		mpegFrames(16000, 0))
+	write("abba.MP3", mpegFrames(2000, 100), id3v1("Waterloo", "ABBA", "Waterloo"))
+	write("notes.txt", []byte("not a track"))
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	available := func(query string) []server.Track {
+		var tracks []server.Track
+		if code := c.do("GET", "/music/available"+query, "", &tracks); code != http.StatusOK {
+			t.Fatalf("%s: expected status: %d, got: %d", query, http.StatusOK, code)
+		}
+		return tracks
+	}
+
+	tracks := available("")
+	expected := []server.Track{
+		{ID: 1, Name: "Queen/A Night at the Opera/01 Bohemian.mp3", Title: "Bohemian Rhapsody", Artist: "Queen", Album: "A Night at the Opera", Duration: 354},
+		{ID: 2, Name: "Queen/News of the World/01 We Will.mp3", Title: "We Will Rock You", Artist: "Queen", Album: "News of the World", Duration: 1},
+		{ID: 3, Name: "abba.MP3", Title: "Waterloo", Artist: "ABBA", Album: "Waterloo", Duration: 100 * 1152 / 44100.0},
+	}
+	if len(tracks) != len(expected) {
+		t.Fatalf("expected tracks: %+v, got: %+v", expected, tracks)
+	}
+	for i := range expected {
+		if math.Abs(tracks[i].Duration-expected[i].Duration) > 0.01 {
+			t.Fatalf("expected duration of %s: %v, got: %v", expected[i].Name, expected[i].Duration, tracks[i].Duration)
+		}
+		tracks[i].Duration = expected[i].Duration
+	}
+	if !reflect.DeepEqual(tracks, expected) {
+		t.Fatalf("expected tracks: %+v, got: %+v", expected, tracks)
+	}
+
+	for _, tt := range []struct {
+		query string
+		ids   []int
+	}{
+		{"?artist=queen", []int{1, 2}},
+		{"?album=Waterloo", []int{3}},
+		{"?artist=queen&album=waterloo", []int{}},
+		{"?q=rock", []int{2}},
+		{"?q=opera", []int{1}},
+		{"?q=abba", []int{3}},
+		{"?offset=1&limit=1", []int{2}},
+		{"?artist=queen&offset=1", []int{2}},
+		{"?offset=10", []int{}},
+	} {
+		ids := []int{}
+		for _, t := range available(tt.query) {
+			ids = append(ids, t.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Fatalf("%s: expected tracks: %v, got: %v", tt.query, tt.ids, ids)
+		}
+	}
+	for _, query := range []string{"?offset=abc", "?limit=-1"} {
+		if code := c.do("GET", "/music/available"+query, "", nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status: %d, got: %d", query, http.StatusBadRequest, code)
+		}
+	}
+
+	req, err := http.NewRequest("GET", c.url+"/music/available?artist=queen&limit=1", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to list tracks: %v", err)
+	}
+	resp.Body.Close()
+	if total := resp.Header.Get("X-Total-Count"); total != "2" {
+		t.Fatalf("expected total count: 2, got: %q", total)
+	}
+
+	// Tracks keep their id across rescans, new ones get new ids
+	if err := os.Remove(filepath.Join(music, "Queen/News of the World/01 We Will.mp3")); err != nil {
+		t.Fatalf("failed to remove track: %v", err)
+	}
+	write("Queen/Jazz/01 Mustapha.mp3", mpegFrames(16000, 0))
+	write("abba.MP3", mpegFrames(3000, 100), id3v1("Waterloo", "ABBA", "Gold"))
+
+	var scan server.LibraryScan
+	if code := c.do("POST", "/music/rescan", "", &scan); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if scan != (server.LibraryScan{Tracks: 3, Added: 1, Updated: 1, Removed: 1}) {
+		t.Fatalf("unexpected scan: %+v", scan)
+	}
+
+	ids := map[string]int{}
+	for _, t := range available("") {
+		ids[t.Name] = t.ID
+	}
+	if tracks := available("?album=gold"); len(tracks) != 1 || tracks[0].ID != 3 {
+		t.Fatalf("expected the changed track read again, got: %+v", tracks)
+	}
+	if !reflect.DeepEqual(ids, map[string]int{
+		"Queen/A Night at the Opera/01 Bohemian.mp3": 1,
+		"Queen/Jazz/01 Mustapha.mp3":                 4,
+		"abba.MP3":                                   3,
+	}) {
+		t.Fatalf("unexpected ids after rescan: %v", ids)
+	}
+	if code := c.do("PUT", "/music/play?trackId=2", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+}
+
+func TestLibraryOversizedTag(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The ID3v2 tag claims 256 MiB, it is skipped instead of read
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0700); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	data := append([]byte("ID3\x03\x00\x00\x7f\x7f\x7f\x7f"), id3v1("Bogus", "Nobody", "Nothing")...)
+	if err := ioutil.WriteFile(filepath.Join(music, "bogus.mp3"), data, 0600); err != nil {
+		t.Fatalf("failed to write track: %v", err)
+	}
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	var tracks []server.Track
+	if code := c.do("GET", "/music/available", "", &tracks); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expected := []server.Track{{ID: 1, Name: "bogus.mp3", Title: "Bogus", Artist: "Nobody", Album: "Nothing"}}
+	if !reflect.DeepEqual(tracks, expected) {
+		t.Fatalf("expected tracks: %+v, got: %+v", expected, tracks)
+	}
+}
+
+func TestTrackUpload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake player reads the length of a track from its file, in tenths
+	// of a second
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0700); err != nil {
+		t.Fatalf("failed to create music dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(music, "long.mp3"), []byte("600"), 0600); err != nil {
+		t.Fatalf("failed to write track: %v", err)
+	}
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	cfg.MaxUpload = 2048
+	if cfg.MPG123, err = filepath.Abs("testdata/fake-mpg123"); err != nil {
+		t.Fatalf("failed to find fake player: %v", err)
+	}
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	upload := func(field, filename, contentType string, data []byte, token string) (int, server.Track) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		h := textproto.MIMEHeader{}
+		disposition := fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, filename)
+		if strings.HasPrefix(filename, "UTF-8''") {
+			// Encoded as in RFC 2231
+			disposition = fmt.Sprintf(`form-data; name="%s"; filename*=%s`, field, filename)
+		}
+		h.Set("Content-Disposition", disposition)
+		if contentType != "" {
+			h.Set("Content-Type", contentType)
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatalf("failed to create part: %v", err)
+		}
+		part.Write(data)
+		mw.Close()
+
+		req, err := http.NewRequest("POST", c.url+"/music/tracks", &body)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to upload %s: %v", filename, err)
+		}
+		defer resp.Body.Close()
+
+		var track server.Track
+		if resp.StatusCode == http.StatusCreated {
+			if err := json.NewDecoder(resp.Body).Decode(&track); err != nil {
+				t.Fatalf("failed to decode track: %v", err)
+			}
+		}
+		return resp.StatusCode, track
+	}
+
+	song := append(id3v2(3, "TIT2", "\x00Waterloo", "TPE1", "\x00ABBA"), mpegFrames(1000, 0)...)
+	code, track := upload("file", "../abba.mp3", "audio/mpeg", song, c.token)
+	if code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	if track.ID != 2 || track.Name != "abba.mp3" || track.Title != "Waterloo" || track.Artist != "ABBA" {
+		t.Fatalf("unexpected track: %+v", track)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(music, "abba.mp3")); err != nil || !bytes.Equal(data, song) {
+		t.Fatalf("expected the upload written, got: %v", err)
+	}
+
+	for _, tt := range []struct {
+		desc        string
+		field       string
+		filename    string
+		contentType string
+		data        []byte
+		token       string
+		code        int
+	}{
+		{"unauthenticated", "file", "new.mp3", "", song, "nope", http.StatusUnauthorized},
+		{"existing track", "file", "abba.mp3", "", song, c.token, http.StatusConflict},
+		{"no file", "track", "new.mp3", "", song, c.token, http.StatusBadRequest},
+		{"hidden file", "file", ".new.mp3", "", song, c.token, http.StatusBadRequest},
+		{"newline", "file", "UTF-8''a%0ALOAD%20x.mp3", "", song, c.token, http.StatusBadRequest},
+		{"control character", "file", "UTF-8''a%7Fx.mp3", "", song, c.token, http.StatusBadRequest},
+		{"wrong extension", "file", "new.wav", "", song, c.token, http.StatusUnsupportedMediaType},
+		{"wrong content type", "file", "new.mp3", "text/plain", song, c.token, http.StatusUnsupportedMediaType},
+		{"not an mp3", "file", "new.mp3", "", []byte("RIFF....WAVE"), c.token, http.StatusUnsupportedMediaType},
+		{"too large", "file", "new.mp3", "", mpegFrames(4096, 0), c.token, http.StatusRequestEntityTooLarge},
+	} {
+		if code, _ := upload(tt.field, tt.filename, tt.contentType, tt.data, tt.token); code != tt.code {
+			t.Fatalf("%s: expected status: %d, got: %d", tt.desc, tt.code, code)
+		}
+	}
+
+	// Only the tracks are left, no partial uploads
+	files, err := ioutil.ReadDir(music)
+	if err != nil {
+		t.Fatalf("failed to read music dir: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"abba.mp3", "long.mp3"}) {
+		t.Fatalf("unexpected files: %v", names)
+	}
+
+	// The playing track can't be deleted, queued ones leave the queue
+	if code := c.do("PUT", "/music/queue", `{"tracks": [1, 2]}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", "/music/tracks/1", "", nil); code != http.StatusConflict {
+		t.Fatalf("expected status: %d, got: %d", http.StatusConflict, code)
+	}
+	if code := c.do("DELETE", "/music/tracks/2", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	var q server.Queue
+	if code := c.do("GET", "/music/queue", "", &q); code != http.StatusOK || len(q.Tracks) != 1 || q.Tracks[0].ID != 1 {
+		t.Fatalf("expected track #2 removed from the queue, got: %d %+v", code, q)
+	}
+	if _, err := os.Stat(filepath.Join(music, "abba.mp3")); !os.IsNotExist(err) {
+		t.Fatalf("expected the file removed, got: %v", err)
+	}
+
+	if code := c.do("PUT", "/music/off", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", "/music/tracks/1", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", "/music/tracks/1", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	if code := c.do("DELETE", "/music/tracks/abc", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// Deleted tracks stay deleted after a rescan
+	var scan server.LibraryScan
+	if code := c.do("POST", "/music/rescan", "", &scan); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if scan != (server.LibraryScan{}) {
+		t.Fatalf("unexpected scan: %+v", scan)
+	}
+}
@@ -5,20 +5,107 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/tarm/serial"
 )
 
+const (
+	maxBrightness = 100
+	// Longest fade between two brightness levels
+	maxTransition = time.Minute
+)
+
+// Light is a light in the house. Channel is the Arduino LED it is wired to,
+// commands for it take the form led<Channel>_ON.
 type Light struct {
 	ID          int    `json:"id"`
 	Description string `json:"description,omitempty"`
+	Channel     int    `json:"channel"`
 	TurnOn      bool   `json:"turnon"`
+	// Brightness goes from 0, off, to 100, fully on
+	Brightness int `json:"brightness"`
+}
+
+// lightLevel is the body of requests dimming a light
+type lightLevel struct {
+	Brightness *int `json:"brightness"`
+	// Transition is how long the light fades to the new brightness
+	Transition Duration `json:"transition"`
+}
+
+// lightInput is the body of requests adding or changing a light
+type lightInput struct {
+	Description *string `json:"description"`
+	Channel     *int    `json:"channel"`
 }
 
-func LightState(w http.ResponseWriter, r *http.Request) {
+// apply sets the fields present in the input on l
+func (in lightInput) apply(l *Light) {
+	if in.Description != nil {
+		l.Description = *in.Description
+	}
+	if in.Channel != nil {
+		l.Channel = *in.Channel
+	}
+}
+
+// loadLights restores the persisted lights, seeding one light per room on
+// first start
+func loadLights(db *AuthStore, rooms []string) ([]Light, error) {
+	stored, err := db.Lights()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lights stored before dimming was supported are fully on or off
+	for i, l := range stored {
+		if l.TurnOn && l.Brightness == 0 {
+			stored[i].Brightness = maxBrightness
+		}
+	}
+
+	if len(stored) == 0 {
+		for i, room := range rooms {
+			l := Light{
+				ID:          i + 1,
+				Description: room,
+				Channel:     i + 1,
+				TurnOn:      false,
+			}
+			if err := db.PutLight(l); err != nil {
+				return nil, err
+			}
+			stored = append(stored, l)
+		}
+	}
+	return stored, nil
+}
+
+// lightCommand returns the Arduino command setting l, e.g. led1_ON. Dimmed
+// or fading lights take the form led<Channel>_DIM_<brightness>_<transition
+// in ms>, e.g. led1_DIM_40_500.
+func lightCommand(l Light, transition time.Duration) string {
+	if transition == 0 && (l.Brightness == 0 || l.Brightness == maxBrightness) {
+		state := "OFF"
+		if l.TurnOn {
+			state = "ON"
+		}
+		return fmt.Sprintf("led%d_%s", l.Channel, state)
+	}
+	return fmt.Sprintf("led%d_DIM_%d_%d", l.Channel, l.Brightness, transition/time.Millisecond)
+}
+
+// setBrightness sets the brightness of l, switching it on or off to match
+func (l *Light) setBrightness(brightness int) {
+	l.Brightness = brightness
+	l.TurnOn = brightness > 0
+}
+
+func (s *Server) LightState(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	params := mux.Vars(r)
@@ -31,7 +118,16 @@ func LightState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, err := json.Marshal(lights[id-1])
+	l, ok := s.house.Light(id)
+	if !ok {
+		msg := fmt.Sprintf("unknown light #%d", id)
+		log.Println(msg)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light state failed: %s"}\n`, msg)))
+		return
+	}
+
+	buf, err := json.Marshal(l)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -39,9 +135,21 @@ func LightState(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func Lights(w http.ResponseWriter, r *http.Request) {
+// Lights lists the lights, guests only see the lights they may control
+func (s *Server) Lights(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
+	lights := s.house.Lights()
+	if u, ok := requestUser(r); ok {
+		visible := lights[:0]
+		for _, l := range lights {
+			if u.controls(l.ID) {
+				visible = append(visible, l)
+			}
+		}
+		lights = visible
+	}
+
 	buf, err := json.Marshal(lights)
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal json: %v", err)
@@ -54,7 +162,7 @@ func Lights(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func SetLightState(w http.ResponseWriter, r *http.Request) {
+func (s *Server) SetLightState(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	params := mux.Vars(r)
@@ -62,8 +170,7 @@ func SetLightState(w http.ResponseWriter, r *http.Request) {
 	state := strings.ToUpper(params["state"])
 
 	id, err := strconv.Atoi(params["lightID"])
-	if err != nil || id > len(lights) {
-		log.Printf("setting light #%d, len is: %d\n", id, len(lights))
+	if err != nil {
 		msg := fmt.Sprintf("failed to parse id: %v", err)
 		log.Println(msg)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -71,11 +178,12 @@ func SetLightState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var turnOn bool
 	switch state {
 	case "ON":
-		lights[id-1].TurnOn = true
+		turnOn = true
 	case "OFF":
-		lights[id-1].TurnOn = false
+		turnOn = false
 	default:
 		msg := fmt.Sprintf("invalid command: %v", state)
 		log.Println(msg)
@@ -84,33 +192,326 @@ func SetLightState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if LIVE == true {
-		s, err := serial.OpenPort(serialConf)
-		if err != nil {
-			msg := fmt.Sprintf("failed to open port: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, msg)))
-			return
+	if err := s.setLightState(id, turnOn); err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case err == ErrUnknownLight:
+			code = http.StatusNotFound
+		case isUnavailable(err):
+			code = http.StatusServiceUnavailable
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, err)))
+		return
+	}
+
+	msg := fmt.Sprintf("OK, toggled light #%d to %s", id, state)
+	buf, err := json.Marshal(&StatusResponse{Message: msg})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// setLightState switches a light fully on or off on the Arduino and records
+// it. Requests, schedules and rules all go through it.
+func (s *Server) setLightState(id int, turnOn bool) error {
+	brightness := 0
+	if turnOn {
+		brightness = maxBrightness
+	}
+	return s.setLightStates([]lightChange{{ID: id, Brightness: brightness}})[0]
+}
+
+// setLightStates sets several lights with a single batch of Arduino commands
+// and records them. It returns an error per change, nil if applied.
+func (s *Server) setLightStates(changes []lightChange) []error {
+	if conn := s.arduino.State(); conn != Connected {
+		errs := make([]error, len(changes))
+		for i := range errs {
+			errs[i] = unavailableError(fmt.Sprintf("arduino is %s", conn))
 		}
-		defer s.Close()
+		return errs
+	}
+
+	transitions := make(map[int]time.Duration)
+	for _, c := range changes {
+		transitions[c.ID] = c.Transition
+	}
 
-		// Example Arduino commands: led1_ON, led2_OFF
-		cmd := fmt.Sprintf("led%d_%s\n", id, state)
-		fmt.Println("sending command:", cmd)
+	return s.house.UpdateLights(changes, func(lights []Light) error {
+		// Example Arduino commands: led1_ON, led2_OFF, led3_DIM_40_500
+		cmds := make([]string, len(lights))
+		for i, l := range lights {
+			cmds[i] = lightCommand(l, transitions[l.ID])
+		}
+		if err := s.arduino.SendBatch(cmds); err != nil {
+			return fmt.Errorf("failed to write: %v", err)
+		}
 
-		_, err = s.Write([]byte(cmd))
+		for _, l := range lights {
+			if err := s.db.PutLight(l); err != nil {
+				log.Printf("failed to persist light #%d: %v\n", l.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// SetLightLevel dims a light, optionally fading over a transition
+func (s *Server) SetLightLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["lightID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light level failed: %s"}`, msg)))
+		return
+	}
+
+	var in lightLevel
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light level failed: %s"}`, msg)))
+		return
+	}
+
+	var msg string
+	switch transition := time.Duration(in.Transition); {
+	case in.Brightness == nil:
+		msg = "brightness is required"
+	case *in.Brightness < 0 || *in.Brightness > maxBrightness:
+		msg = fmt.Sprintf("invalid brightness %d, expected 0 to %d", *in.Brightness, maxBrightness)
+	case transition < 0 || transition > maxTransition:
+		msg = fmt.Sprintf("invalid transition %v, expected up to %v", transition, maxTransition)
+	}
+	if msg != "" {
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light level failed: %s"}`, msg)))
+		return
+	}
+
+	change := lightChange{ID: id, Brightness: *in.Brightness, Transition: time.Duration(in.Transition)}
+	if err := s.setLightStates([]lightChange{change})[0]; err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case err == ErrUnknownLight:
+			code = http.StatusNotFound
+		case isUnavailable(err):
+			code = http.StatusServiceUnavailable
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Light level failed: %s"}`, err)))
+		return
+	}
+
+	l, _ := s.house.Light(id)
+	buf, err := json.Marshal(l)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddLight adds a light wired to an Arduino channel
+func (s *Server) AddLight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var in lightInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add light failed: %s"}`, msg)))
+		return
+	}
+
+	var l Light
+	in.apply(&l)
+
+	l, err := s.house.AddLight(l, s.db.AddLight)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add light failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(l)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// UpdateLight renames a light or moves it to another Arduino channel
+func (s *Server) UpdateLight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["lightID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Update light failed: %s"}`, msg)))
+		return
+	}
+
+	var in lightInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Update light failed: %s"}`, msg)))
+		return
+	}
+
+	l, err := s.house.UpdateLight(id, in.apply, s.db.PutLight)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case err == ErrUnknownLight:
+			code = http.StatusNotFound
+		case isInvalid(err):
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Update light failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(l)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// lightInUseError lists what refers to a light that can't be deleted
+type lightInUseError []string
+
+func (e lightInUseError) Error() string {
+	return "the light is used by " + strings.Join(e, ", ")
+}
+
+// lightUsers returns what refers to the light with the given id: schedules,
+// rules, scenes, guests and invitations
+func (s *Server) lightUsers(id int) ([]string, error) {
+	var users []string
+	for _, sc := range s.schedules.list() {
+		if sc.Action.Type == "light" && sc.Action.Light == id {
+			users = append(users, fmt.Sprintf("schedule #%d", sc.ID))
+		}
+	}
+	for _, r := range s.rules.list() {
+		if r.Action.Type == "light" && r.Action.Light == id {
+			users = append(users, fmt.Sprintf("rule #%d", r.ID))
+		}
+	}
+
+	scenes, err := s.db.Scenes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenes: %v", err)
+	}
+	for _, sc := range scenes {
+		for _, a := range sc.Actions {
+			if a.Type == "light" && a.Light == id {
+				users = append(users, fmt.Sprintf("scene #%d", sc.ID))
+				break
+			}
+		}
+	}
+
+	creds, err := s.db.Users()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users: %v", err)
+	}
+	var names []string
+	for name, c := range creds {
+		if containsInt(c.Lights, id) {
+			names = append(names, "user "+name)
+		}
+	}
+	sort.Strings(names)
+	users = append(users, names...)
+
+	invitations, err := s.db.Invitations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invitations: %v", err)
+	}
+	for _, inv := range invitations {
+		if containsInt(inv.Lights, id) {
+			users = append(users, "invitation "+inv.ID)
+		}
+	}
+	return users, nil
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteLight removes a light, unless schedules, rules, scenes, guests or
+// invitations refer to it
+func (s *Server) DeleteLight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["lightID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete light failed: %s"}`, msg)))
+		return
+	}
+
+	err = s.house.RemoveLight(id, func() error {
+		users, err := s.lightUsers(id)
 		if err != nil {
-			msg := fmt.Sprintf("failed to write: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, msg)))
-			return
+			return err
+		}
+		if len(users) > 0 {
+			return lightInUseError(users)
 		}
+		return s.db.DeleteLight(id)
+	})
+	if err != nil {
+		code := http.StatusInternalServerError
+		_, inUse := err.(lightInUseError)
+		switch {
+		case err == ErrUnknownLight:
+			code = http.StatusNotFound
+		case inUse:
+			code = http.StatusConflict
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete light failed: %s"}`, err)))
+		return
 	}
 
-	msg := fmt.Sprintf("OK, toggled light #%d to %s", id, state)
-	buf, err := json.Marshal(&StatusResponse{Message: msg})
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted light #%d", id)})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// freeAttempts failures in a row are allowed before locking out
+	freeAttempts = 5
+	// Lockouts double with every failure from minLockout up to maxLockout
+	minLockout = 30 * time.Second
+	maxLockout = time.Hour
+	// attemptMemory is how long failures are remembered after the last one
+	attemptMemory = 24 * time.Hour
+
+	// Clients may send authRequestsPerMinute login and registration requests
+	// on average, and authBurst at once
+	authRequestsPerMinute = 10
+	authBurst             = 10
+)
+
+// attempts are the failed attempts of a client IP or a username to log in or
+// register, stored in the attempts bucket
+type attempts struct {
+	Failures    int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+// fail records a failure at now, locking out once the free attempts are used
+func (a *attempts) fail(now time.Time) {
+	if now.Sub(a.Last) > attemptMemory {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.Last = now
+
+	if a.Failures >= freeAttempts {
+		lockout := minLockout << uint(a.Failures-freeAttempts)
+		if lockout <= 0 || lockout > maxLockout {
+			lockout = maxLockout
+		}
+		a.LockedUntil = now.Add(lockout)
+	}
+}
+
+// ipAttempts keys the attempts of the client IP a request comes from
+func ipAttempts(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// userAttempts keys the attempts to log in as a user
+func userAttempts(name string) string {
+	return "user:" + strings.ToLower(name)
+}
+
+// lockedOut returns how long the longest lockout of keys lasts, 0 if none
+func (s *Server) lockedOut(keys ...string) time.Duration {
+	now := s.clock.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		a, err := s.db.Attempts(k)
+		if err != nil {
+			log.Printf("failed to read attempts of %s: %v", k, err)
+			continue
+		}
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// failedAttempt records a failed attempt of keys
+func (s *Server) failedAttempt(keys ...string) {
+	now := s.clock.Now()
+	for _, k := range keys {
+		a, err := s.db.UpdateAttempts(k, func(a *attempts) { a.fail(now) })
+		if err != nil {
+			log.Printf("failed to record attempt of %s: %v", k, err)
+			continue
+		}
+		if !a.LockedUntil.Before(now) {
+			log.Printf("%s locked out until %s after %d failures", k, a.LockedUntil.Format(time.RFC3339), a.Failures)
+		}
+	}
+}
+
+// sweepAttempts deletes the attempts old enough to be forgotten
+func (s *Server) sweepAttempts() {
+	if err := s.db.DeleteAttemptsBefore(s.clock.Now().Add(-attemptMemory - maxLockout)); err != nil {
+		log.Printf("error: failed to delete old attempts: %v", err)
+	}
+}
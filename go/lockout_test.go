@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestLoginLockout(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	if err := c.srv.PutUser("bob", server.RoleMember); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+
+	// post returns the status and the Retry-After header of a request
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(c.url+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+	login := func(pw string) (int, string) {
+		return post("/login", fmt.Sprintf(`{"username": "bob", "password": %q}`, pw))
+	}
+
+	for i := 0; i < 5; i++ {
+		if code, _ := login("guess"); code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: expected status: %d, got: %d", i+1, http.StatusBadRequest, code)
+		}
+	}
+
+	// Locked out even with the right password
+	if code, retry := login("password"); code != http.StatusTooManyRequests || retry != "30" {
+		t.Fatalf("expected status: %d retrying in 30s, got: %d retrying in %ss", http.StatusTooManyRequests, code, retry)
+	}
+
+	clock.Advance(31 * time.Second)
+	if code, _ := login("password"); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	// The client IP keeps its failures, and its lockouts double
+	if code, _ := login("guess"); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code, retry := login("password"); code != http.StatusTooManyRequests || retry != "60" {
+		t.Fatalf("expected status: %d retrying in 60s, got: %d retrying in %ss", http.StatusTooManyRequests, code, retry)
+	}
+
+	// Failures are forgotten after a day, invalid invitations count too
+	clock.Advance(25 * time.Hour)
+	for i := 0; i < 5; i++ {
+		if code, _ := post("/register", `{"username": "carol", "password": "pw", "invitation": "guess"}`); code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: expected status: %d, got: %d", i+1, http.StatusBadRequest, code)
+		}
+	}
+	invitation, err := c.srv.Invite(server.RoleMember, "")
+	if err != nil {
+		t.Fatalf("failed to invite: %v", err)
+	}
+	reg := fmt.Sprintf(`{"username": "carol", "password": "pw", "invitation": %q}`, invitation)
+	if code, _ := post("/register", reg); code != http.StatusTooManyRequests {
+		t.Fatalf("expected status: %d, got: %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	limiter := server.NewRateLimiter(60, 2, clock)
+	handler := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	request := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := request("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status: %d, got: %d", i+1, http.StatusOK, rec.Code)
+		}
+	}
+
+	rec := request("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected status: %d retrying in 1s, got: %d retrying in %ss", http.StatusTooManyRequests, rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Other clients have their own limit
+	if rec := request("10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, rec.Code)
+	}
+
+	clock.Advance(time.Second)
+	if rec := request("10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, rec.Code)
+	}
+	if rec := request("10.0.0.1:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status: %d, got: %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
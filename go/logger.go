@@ -15,9 +15,23 @@ func Logger(inner http.Handler, name string) http.Handler {
 		log.Printf(
 			"%s %s %s %s",
 			r.Method,
-			r.RequestURI,
+			loggedURI(r),
 			name,
 			time.Since(start),
 		)
 	})
 }
+
+// loggedURI returns the path and query of r without the access_token, so
+// session tokens don't end up in the log
+func loggedURI(r *http.Request) string {
+	q := r.URL.Query()
+	if _, ok := q["access_token"]; !ok {
+		return r.RequestURI
+	}
+	q.Del("access_token")
+
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mpg123Player plays mp3 files with mpg123
+type mpg123Player struct {
+	bin string
+}
+
+func (m mpg123Player) Formats() []string {
+	return []string{".mp3"}
+}
+
+func (m mpg123Player) Start(file string, volume int) (Playback, error) {
+	p, err := startMPG123(m.bin, file, volume)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// mpg123 plays a track with mpg123 in remote mode (mpg123 -R): commands are
+// written to its stdin and its progress is read from its stdout. The process
+// exits once the track ended or failed to load.
+type mpg123 struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// done is closed once stdout is drained
+	done chan struct{}
+
+	mu       sync.Mutex
+	loaded   bool
+	position float64
+	duration float64
+	err      error
+}
+
+// startMPG123 starts bin in remote mode playing file at volume percent
+func startMPG123(bin, file string, volume int) (*mpg123, error) {
+	// Commands are lines, a newline in the file would start another one
+	if strings.ContainsAny(file, "\r\n") {
+		return nil, fmt.Errorf("invalid file name: %q", file)
+	}
+
+	cmd := exec.Command(bin, "-R")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &mpg123{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+	go p.read(stdout)
+
+	err = p.send("VOLUME %d", volume)
+	if err == nil {
+		err = p.send("LOAD %s", file)
+	}
+	if err != nil {
+		p.Stop()
+		p.Wait()
+		return nil, err
+	}
+	return p, nil
+}
+
+// send writes a command, e.g. PAUSE or JUMP 30s
+func (p *mpg123) send(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(p.stdin, format+"\n", args...); err != nil {
+		return fmt.Errorf("failed to control mpg123: %v", err)
+	}
+	return nil
+}
+
+// read parses the messages of mpg123 until it exits:
+//
+//	@F <frame> <frames left> <seconds> <seconds left>  progress
+//	@P 0|1|2                                           stopped, paused, playing
+//	@E <message>                                       error
+func (p *mpg123) read(stdout io.Reader) {
+	defer close(p.done)
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "@F":
+			if len(fields) < 5 {
+				continue
+			}
+			pos, err1 := strconv.ParseFloat(fields[3], 64)
+			left, err2 := strconv.ParseFloat(fields[4], 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.mu.Lock()
+			p.loaded = true
+			p.position = pos
+			p.duration = pos + left
+			p.mu.Unlock()
+		case "@P":
+			// The track ended, mpg123 quits once its stdin is closed
+			if len(fields) > 1 && fields[1] == "0" {
+				p.stdin.Close()
+			}
+		case "@E":
+			msg := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "@E"))
+			p.mu.Lock()
+			loaded := p.loaded
+			if !loaded {
+				p.err = errors.New(msg)
+			}
+			p.mu.Unlock()
+
+			// Nothing to play if the track failed to load
+			if !loaded {
+				p.stdin.Close()
+			} else {
+				log.Printf("mpg123: %s", msg)
+			}
+		}
+	}
+}
+
+// Wait waits for mpg123 to exit, returning why the track failed to play
+func (p *mpg123) Wait() error {
+	<-p.done
+	err := p.cmd.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return err
+}
+
+// Progress returns the position in the track and its duration in seconds,
+// once mpg123 reported them
+func (p *mpg123) Progress() (float64, float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position, p.duration, p.loaded
+}
+
+// Pause toggles pausing
+func (p *mpg123) Pause() error {
+	return p.send("PAUSE")
+}
+
+// Seek jumps to position seconds in the track
+func (p *mpg123) Seek(position float64) error {
+	if err := p.send("JUMP %.2fs", position); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.position = position
+	p.mu.Unlock()
+	return nil
+}
+
+// SetVolume sets the volume in percent
+func (p *mpg123) SetVolume(volume int) error {
+	return p.send("VOLUME %d", volume)
+}
+
+// Stop kills mpg123
+func (p *mpg123) Stop() {
+	p.cmd.Process.Kill()
+}
@@ -4,26 +4,92 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
+// maxVolume is the full volume of the music player, in percent
+const maxVolume = 100
+
 type MusicPlayerStatus struct {
-	State bool
-	Track Track
+	State  bool
+	Track  Track
+	Paused bool
+	// Volume is in percent
+	Volume int
+	// QueuePosition is the index of Track in the queue, -1 if none
+	QueuePosition int
+	QueueLength   int
+	// Elapsed is the position in Track and Duration its length, in seconds.
+	// Duration is 0 if unknown.
+	Elapsed  float64
+	Duration float64
 }
 
+// Track is an mp3 file of the music directory. Its id stays the same across
+// rescans.
 type Track struct {
-	ID   int    `json:"id,omitempty"`
-	Name string `json:"name,omitempty"`
+	ID int `json:"id,omitempty"`
+	// Name is the path of the file in the music directory
+	Name   string `json:"name,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	// Duration is in seconds
+	Duration float64 `json:"duration,omitempty"`
 }
 
-func MusicAvailable(w http.ResponseWriter, r *http.Request) {
+// MusicAvailable lists the tracks, optionally filtered by artist, album or a
+// search and paginated with offset and limit. The number of matching tracks
+// is returned in the X-Total-Count header.
+func (s *Server) MusicAvailable(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
+	query := r.URL.Query()
+	filter := trackFilter{
+		Artist: query.Get("artist"),
+		Album:  query.Get("album"),
+		Search: query.Get("q"),
+	}
+
+	var page [2]int
+	for i, name := range []string{"offset", "limit"} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			msg := fmt.Sprintf("invalid %s: %q", name, v)
+			log.Println(msg)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"message": "Available failed: %s"}`, msg)))
+			return
+		}
+		page[i] = n
+	}
+	offset, limit := page[0], page[1]
+
+	tracks := []Track{}
+	for _, t := range s.house.Tracks() {
+		if filter.match(t) {
+			tracks = append(tracks, t)
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(tracks)))
+
+	if offset > len(tracks) {
+		offset = len(tracks)
+	}
+	tracks = tracks[offset:]
+	if limit > 0 && limit < len(tracks) {
+		tracks = tracks[:limit]
+	}
+
 	buf, err := json.Marshal(tracks)
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal json: %v", err)
@@ -37,14 +103,10 @@ func MusicAvailable(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func MusicSummary(w http.ResponseWriter, r *http.Request) {
+func (s *Server) MusicSummary(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	status := MusicPlayerStatus{
-		State: trackPlaying,
-		Track: activeTrack,
-	}
-	buf, err := json.Marshal(status)
+	buf, err := json.Marshal(s.house.MusicStatus())
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal json: %v", err)
 		log.Println(msg)
@@ -56,7 +118,7 @@ func MusicSummary(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func PlayTrack(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PlayTrack(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	id, err := strconv.Atoi(r.URL.Query().Get("trackId"))
@@ -68,30 +130,19 @@ func PlayTrack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if LIVE {
-		if trackPlaying {
-			mpg123.Process.Kill()
-			mpg123 = nil
-		}
-
-		mpg123 = exec.Command("mpg123", "-q", music+tracks[id-1].Name)
-		err = mpg123.Start()
-		if err != nil {
-			msg := fmt.Sprintf("failed to play: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Play failed: %s"}`, msg)))
-			return
+	status, err := s.playTrack(id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownTrack {
+			code = http.StatusNotFound
+			err = fmt.Errorf("unknown track #%d", id)
 		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play failed: %s"}`, err)))
+		return
 	}
 
-	trackPlaying = true
-	activeTrack = tracks[id-1]
-
-	status := MusicPlayerStatus{
-		State: trackPlaying,
-		Track: activeTrack,
-	}
 	buf, err := json.Marshal(status)
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal json: %v", err)
@@ -104,29 +155,297 @@ func PlayTrack(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func SetMusicState(w http.ResponseWriter, r *http.Request) {
+// playTrack plays the track with the given id, queuing it after the current
+// track if it is not queued yet. Requests and schedules both go through it.
+func (s *Server) playTrack(id int) (MusicPlayerStatus, error) {
+	t, ok := s.house.Track(id)
+	if !ok {
+		return MusicPlayerStatus{}, ErrUnknownTrack
+	}
+
+	status, err := s.house.PlayTrack(t, s.startTrack)
+	if err != nil {
+		return MusicPlayerStatus{}, fmt.Errorf("failed to play: %v", err)
+	}
+	return status, nil
+}
+
+// startTrack starts the player playing t at volume percent, unless serving
+// demo tracks. The queue moves on once the track ends.
+func (s *Server) startTrack(t Track, volume int) (Playback, error) {
+	if s.cfg.Music == "" {
+		return nil, nil
+	}
+	return s.player.Start(filepath.Join(s.cfg.Music, filepath.FromSlash(t.Name)), volume)
+}
+
+func (s *Server) SetMusicState(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	params := mux.Vars(r)
 	state := params["state"]
 
-	if state == "off" {
-		trackPlaying = false
-		activeTrack = Track{}
+	status, err := s.setMusicState(state)
+	writeMusicStatus(w, "Music state", status, err)
+}
+
+// setMusicState changes the state of the music player: "off" stops it,
+// "pause" and "resume" pause the active track, "next" and "previous" move
+// through the queue. Requests and schedules both go through it.
+func (s *Server) setMusicState(state string) (MusicPlayerStatus, error) {
+	var status MusicPlayerStatus
+	var err error
+	switch state {
+	case "off":
+		s.house.StopMusic()
+		return s.house.MusicStatus(), nil
+	case "pause", "resume":
+		return s.house.PauseMusic(state == "pause")
+	case "next":
+		status, err = s.house.Next(s.startTrack)
+	case "previous":
+		status, err = s.house.Previous(s.startTrack)
+	default:
+		return MusicPlayerStatus{}, invalidError(fmt.Sprintf("unknown music state: %v", state))
+	}
+
+	if err != nil && !isInvalid(err) {
+		return MusicPlayerStatus{}, fmt.Errorf("failed to play: %v", err)
+	}
+	return status, err
+}
+
+// SeekMusic jumps to a position in the active track, in seconds
+func (s *Server) SeekMusic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	position, err := strconv.ParseFloat(r.URL.Query().Get("position"), 64)
+	if err != nil || position < 0 || math.IsNaN(position) || math.IsInf(position, 0) {
+		msg := fmt.Sprintf("invalid position: %q", r.URL.Query().Get("position"))
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Seek failed: %s"}`, msg)))
+		return
+	}
+
+	status, err := s.house.SeekMusic(position)
+	writeMusicStatus(w, "Seek", status, err)
+}
+
+// SetMusicVolume changes the volume, in percent
+func (s *Server) SetMusicVolume(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	volume, err := strconv.Atoi(r.URL.Query().Get("level"))
+	if err != nil || volume < 0 || volume > maxVolume {
+		msg := fmt.Sprintf("invalid level: %q, expected 0 to %d", r.URL.Query().Get("level"), maxVolume)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Volume failed: %s"}`, msg)))
+		return
+	}
+
+	status, err := s.house.SetVolume(volume)
+	writeMusicStatus(w, "Volume", status, err)
+}
+
+// writeMusicStatus responds with the status of the music player, or with
+// err if the change named name failed
+func writeMusicStatus(w http.ResponseWriter, name string, status MusicPlayerStatus, err error) {
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, name, err)))
+		return
+	}
+
+	buf, err := json.Marshal(status)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, name, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// queueRequest lists the tracks to queue
+type queueRequest struct {
+	Tracks []int `json:"tracks"`
+}
+
+// queueMode changes how the queue is played, unset fields are kept
+type queueMode struct {
+	Shuffle *bool  `json:"shuffle"`
+	Repeat  string `json:"repeat"`
+}
+
+// queueTracks returns the tracks with the given ids
+func (s *Server) queueTracks(ids []int) ([]Track, error) {
+	if len(ids) == 0 {
+		return nil, invalidError("at least one track is required")
+	}
+
+	tracks := make([]Track, len(ids))
+	for i, id := range ids {
+		t, ok := s.house.Track(id)
+		if !ok {
+			return nil, invalidError(fmt.Sprintf("unknown track #%d", id))
+		}
+		tracks[i] = t
+	}
+	return tracks, nil
+}
+
+// MusicQueue lists the queued tracks in play order
+func (s *Server) MusicQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-		if LIVE && mpg123 != nil {
-			mpg123.Process.Kill()
-			mpg123 = nil
+	buf, err := json.Marshal(s.house.Queue())
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Queue failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// PlayMusicQueue queues the given tracks instead of the queued ones and
+// plays the first
+func (s *Server) PlayMusicQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var req queueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play queue failed: %s"}`, msg)))
+		return
+	}
+
+	status, err := s.playQueue(req.Tracks)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
 		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play queue failed: %s"}`, err)))
+		return
+	}
 
-	} else {
-		msg := fmt.Sprintf("unknown music state: %v", state)
+	buf, err := json.Marshal(status)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
 		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play queue failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// playQueue queues the tracks with the given ids and plays the first.
+// Requests and playlists both go through it.
+func (s *Server) playQueue(ids []int) (MusicPlayerStatus, error) {
+	tracks, err := s.queueTracks(ids)
+	if err != nil {
+		return MusicPlayerStatus{}, err
+	}
+
+	status, err := s.house.PlayQueue(tracks, s.startTrack)
+	if err != nil {
+		return MusicPlayerStatus{}, fmt.Errorf("failed to play: %v", err)
+	}
+	return status, nil
+}
+
+// AddToMusicQueue queues the given tracks after the queued ones
+func (s *Server) AddToMusicQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var req queueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add to queue failed: %s"}`, msg)))
+		return
+	}
+
+	tracks, err := s.queueTracks(req.Tracks)
+	if err != nil {
+		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"message": "Music state failed: %s"}`, msg)))
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add to queue failed: %s"}`, err)))
 		return
 	}
 
+	buf, err := json.Marshal(s.house.Enqueue(tracks))
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add to queue failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// SetMusicQueueMode turns shuffling on or off and changes the repeat mode
+func (s *Server) SetMusicQueueMode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var mode queueMode
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Queue mode failed: %s"}`, msg)))
+		return
+	}
+
+	switch mode.Repeat {
+	case "", RepeatOff, RepeatAll, RepeatOne:
+	default:
+		msg := fmt.Sprintf("invalid repeat mode: %s", mode.Repeat)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Queue mode failed: %s"}`, msg)))
+		return
+	}
+
+	buf, err := json.Marshal(s.house.SetQueueMode(mode.Shuffle, mode.Repeat))
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Queue mode failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// ClearMusicQueue stops the music and empties the queue
+func (s *Server) ClearMusicQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	s.house.ClearQueue()
+
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "OK, music state updated to off"}`))
+	w.Write([]byte(`{"message": "OK, queue cleared"}`))
 }
@@ -0,0 +1,485 @@
+package server_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+// queueIDs returns the ids of the queued tracks in play order
+func queueIDs(q server.Queue) []int {
+	ids := make([]int, len(q.Tracks))
+	for i, t := range q.Tracks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+func TestMusicQueue(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	status := func() server.MusicPlayerStatus {
+		var status server.MusicPlayerStatus
+		if code := c.do("GET", "/music", "", &status); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return status
+	}
+	queue := func() server.Queue {
+		var q server.Queue
+		if code := c.do("GET", "/music/queue", "", &q); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return q
+	}
+	expectPlaying := func(desc string, id, pos int) {
+		if s := status(); !s.State || s.Track.ID != id || s.QueuePosition != pos {
+			t.Fatalf("%s: expected track #%d playing at %d, got: %+v", desc, id, pos, s)
+		}
+	}
+
+	for _, body := range []string{`{"tracks": []}`, `{"tracks": [42]}`, `{"tracks": "1"}`} {
+		if code := c.do("PUT", "/music/queue", body, nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status: %d, got: %d", body, http.StatusBadRequest, code)
+		}
+	}
+	if code := c.do("PUT", "/music/next", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	var s server.MusicPlayerStatus
+	if code := c.do("PUT", "/music/queue", `{"tracks": [2, 4, 6]}`, &s); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if !s.State || s.Track.ID != 2 || s.QueuePosition != 0 || s.QueueLength != 3 {
+		t.Fatalf("expected track #2 playing first of 3, got: %+v", s)
+	}
+
+	clock.Advance(90 * time.Second)
+	if s := status(); s.Elapsed != 90 {
+		t.Fatalf("expected 90s elapsed, got: %+v", s)
+	}
+
+	for _, tt := range []struct {
+		state string
+		id    int
+		pos   int
+	}{
+		{"next", 4, 1},
+		{"previous", 2, 0},
+		// The first track stays current without repeat
+		{"previous", 2, 0},
+	} {
+		if code := c.do("PUT", "/music/"+tt.state, "", nil); code != http.StatusOK {
+			t.Fatalf("%s: expected status: %d, got: %d", tt.state, http.StatusOK, code)
+		}
+		expectPlaying(tt.state, tt.id, tt.pos)
+	}
+	if s := status(); s.Elapsed != 0 {
+		t.Fatalf("expected elapsed time reset, got: %+v", s)
+	}
+
+	// Ended tracks advance the queue until its end
+	c.srv.EndTrack()
+	expectPlaying("ended", 4, 1)
+	c.srv.EndTrack()
+	expectPlaying("ended", 6, 2)
+	c.srv.EndTrack()
+	if s := status(); s.State || s.QueueLength != 3 {
+		t.Fatalf("expected music stopped at the end of the queue, got: %+v", s)
+	}
+
+	// Repeat modes
+	if code := c.do("PATCH", "/music/queue", `{"repeat": "sometimes"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code := c.do("PATCH", "/music/queue", `{"repeat": "one"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	c.do("PUT", "/music/previous", "", nil)
+	expectPlaying("previous", 4, 1)
+	c.srv.EndTrack()
+	expectPlaying("repeat one", 4, 1)
+
+	c.do("PATCH", "/music/queue", `{"repeat": "all"}`, nil)
+	c.srv.EndTrack()
+	expectPlaying("repeat all", 6, 2)
+	c.srv.EndTrack()
+	expectPlaying("repeat all", 2, 0)
+	c.do("PUT", "/music/previous", "", nil)
+	expectPlaying("repeat all", 6, 2)
+
+	// Shuffling keeps the current track and all the queued ones
+	var q server.Queue
+	if code := c.do("PATCH", "/music/queue", `{"shuffle": true}`, &q); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	ids := queueIDs(q)
+	if !q.Shuffle || q.Repeat != server.RepeatAll || q.Position != 0 || ids[0] != 6 {
+		t.Fatalf("expected track #6 first in the shuffled queue, got: %+v", q)
+	}
+	sort.Ints(ids)
+	if !reflect.DeepEqual(ids, []int{2, 4, 6}) {
+		t.Fatalf("expected shuffled tracks: [2 4 6], got: %v", ids)
+	}
+	expectPlaying("shuffled", 6, 0)
+
+	c.do("PATCH", "/music/queue", `{"shuffle": false}`, nil)
+	if q := queue(); !reflect.DeepEqual(queueIDs(q), []int{2, 4, 6}) || q.Position != 2 {
+		t.Fatalf("expected queue order restored, got: %+v", q)
+	}
+
+	// Queued tracks go last, played tracks right after the current one
+	if code := c.do("POST", "/music/queue", `{"tracks": [8]}`, &q); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if got := queueIDs(q); !reflect.DeepEqual(got, []int{2, 4, 6, 8}) {
+		t.Fatalf("expected queue: [2 4 6 8], got: %v", got)
+	}
+	c.do("PUT", "/music/play?trackId=9", "", nil)
+	expectPlaying("play", 9, 3)
+	c.do("PUT", "/music/play?trackId=4", "", nil)
+	expectPlaying("play queued", 4, 1)
+	if got := queueIDs(queue()); !reflect.DeepEqual(got, []int{2, 4, 6, 9, 8}) {
+		t.Fatalf("expected queue: [2 4 6 9 8], got: %v", got)
+	}
+
+	// Stopping keeps the queue, clearing empties it
+	c.do("PUT", "/music/off", "", nil)
+	if s := status(); s.State || s.QueueLength != 5 {
+		t.Fatalf("expected music stopped with the queue kept, got: %+v", s)
+	}
+	if code := c.do("DELETE", "/music/queue", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if q := queue(); len(q.Tracks) != 0 || q.Position != -1 {
+		t.Fatalf("expected empty queue, got: %+v", q)
+	}
+}
+
+func TestPlaylists(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"no name", `{"tracks": [1]}`},
+		{"no tracks", `{"name": "empty"}`},
+		{"unknown track", `{"name": "x", "tracks": [1, 42]}`},
+	} {
+		if code := c.do("POST", "/playlists", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.name, http.StatusBadRequest, code)
+		}
+	}
+
+	var p server.Playlist
+	if code := c.do("POST", "/playlists", `{"name": "morning", "tracks": [3, 1]}`, &p); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+
+	var playlists []server.Playlist
+	if code := c.do("GET", "/playlists", "", &playlists); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(playlists) != 1 || !reflect.DeepEqual(playlists[0], p) {
+		t.Fatalf("expected playlists: %+v, got: %+v", []server.Playlist{p}, playlists)
+	}
+
+	var status server.MusicPlayerStatus
+	if code := c.do("PUT", "/playlists/1/play", "", &status); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if !status.State || status.Track.ID != 3 || status.QueueLength != 2 {
+		t.Fatalf("expected track #3 playing first of 2, got: %+v", status)
+	}
+
+	if code := c.do("DELETE", "/playlists/1", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/playlists/1/play", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+}
+
+func TestMusicPlayer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake player reads the length of a track from its file, in tenths
+	// of a second
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0700); err != nil {
+		t.Fatalf("failed to create music dir: %v", err)
+	}
+	for name, length := range map[string]string{"1 short.mp3": "3", "2 long.mp3": "600", "3 broken.mp3": "x"} {
+		if err := ioutil.WriteFile(filepath.Join(music, name), []byte(length), 0600); err != nil {
+			t.Fatalf("failed to write track: %v", err)
+		}
+	}
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	if cfg.MPG123, err = filepath.Abs("testdata/fake-mpg123"); err != nil {
+		t.Fatalf("failed to find fake player: %v", err)
+	}
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	status := func() server.MusicPlayerStatus {
+		var status server.MusicPlayerStatus
+		if code := c.do("GET", "/music", "", &status); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return status
+	}
+
+	if code := c.do("PUT", "/music/pause", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// The short track ends by itself and the queue moves on
+	if code := c.do("PUT", "/music/queue", `{"tracks": [1, 2]}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	eventually(t, func() bool {
+		s := status()
+		return s.Track.ID == 2 && s.Duration == 60 && s.Elapsed > 0
+	})
+
+	var s server.MusicPlayerStatus
+	if code := c.do("PUT", "/music/pause", "", &s); code != http.StatusOK || !s.Paused {
+		t.Fatalf("expected music paused, got: %d %+v", code, s)
+	}
+	time.Sleep(200 * time.Millisecond)
+	paused := status().Elapsed
+	time.Sleep(300 * time.Millisecond)
+	if s := status(); s.Elapsed != paused || !s.Paused {
+		t.Fatalf("expected position %v kept while paused, got: %+v", paused, s)
+	}
+
+	if code := c.do("PUT", "/music/resume", "", &s); code != http.StatusOK || s.Paused {
+		t.Fatalf("expected music resumed, got: %d %+v", code, s)
+	}
+	eventually(t, func() bool { return status().Elapsed > paused })
+
+	for _, query := range []string{"", "?position=abc", "?position=-1", "?position=120", "?position=NaN", "?position=Inf"} {
+		if code := c.do("PUT", "/music/seek"+query, "", nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status: %d, got: %d", query, http.StatusBadRequest, code)
+		}
+	}
+	if code := c.do("PUT", "/music/seek?position=30", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	eventually(t, func() bool {
+		s := status()
+		return s.Elapsed > 30 && s.Elapsed < 40
+	})
+
+	for _, query := range []string{"", "?level=101", "?level=-5"} {
+		if code := c.do("PUT", "/music/volume"+query, "", nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status: %d, got: %d", query, http.StatusBadRequest, code)
+		}
+	}
+	if code := c.do("PUT", "/music/volume?level=40", "", &s); code != http.StatusOK || s.Volume != 40 {
+		t.Fatalf("expected volume 40, got: %d %+v", code, s)
+	}
+
+	// A track that fails to load stops the music
+	if code := c.do("PUT", "/music/play?trackId=3", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	eventually(t, func() bool { return !status().State })
+	if s := status(); s.Volume != 40 {
+		t.Fatalf("expected volume kept, got: %+v", s)
+	}
+}
+
+func TestRecordingPlayer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0700); err != nil {
+		t.Fatalf("failed to create music dir: %v", err)
+	}
+	for _, name := range []string{"a.mp3", "b.flac", "c.OGG", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(music, name), nil, 0600); err != nil {
+			t.Fatalf("failed to write track: %v", err)
+		}
+	}
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	cfg.Player = "none"
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+	player := c.srv.RecordingPlayer()
+
+	var tracks []server.Track
+	if code := c.do("GET", "/music/available", "", &tracks); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	var names []string
+	for _, t := range tracks {
+		names = append(names, t.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a.mp3", "b.flac", "c.OGG"}) {
+		t.Fatalf("unexpected tracks: %v", names)
+	}
+
+	status := func() server.MusicPlayerStatus {
+		var status server.MusicPlayerStatus
+		if code := c.do("GET", "/music", "", &status); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return status
+	}
+
+	for _, req := range []string{"/music/queue", "/music/pause", "/music/resume", "/music/seek?position=1.5", "/music/volume?level=40"} {
+		body := ""
+		if req == "/music/queue" {
+			body = `{"tracks": [1, 2]}`
+		}
+		if code := c.do("PUT", req, body, nil); code != http.StatusOK {
+			t.Fatalf("%s: expected status: %d, got: %d", req, http.StatusOK, code)
+		}
+	}
+
+	// The queue moves on once a track ends and stops on a failure
+	if !player.Finish(nil) {
+		t.Fatalf("expected a track playing")
+	}
+	eventually(t, func() bool { return status().Track.ID == 2 })
+	player.Finish(errors.New("broken"))
+	eventually(t, func() bool { return !status().State })
+
+	if code := c.do("PUT", "/music/play?trackId=3", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/music/off", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if player.Finish(nil) {
+		t.Fatalf("expected no track playing")
+	}
+
+	expected := []string{
+		"play " + filepath.Join(music, "a.mp3") + " 100",
+		"pause",
+		"pause",
+		"seek 1.5",
+		"volume 40",
+		"play " + filepath.Join(music, "b.flac") + " 40",
+		"play " + filepath.Join(music, "c.OGG") + " 40",
+		"stop",
+	}
+	if commands := player.Commands(); !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands: %q, got: %q", expected, commands)
+	}
+}
+
+func TestCommandPlayer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0700); err != nil {
+		t.Fatalf("failed to create music dir: %v", err)
+	}
+	for _, name := range []string{"1.wav", "2.wav"} {
+		if err := ioutil.WriteFile(filepath.Join(music, name), nil, 0600); err != nil {
+			t.Fatalf("failed to write track: %v", err)
+		}
+	}
+
+	// The player logs what it plays and plays for a fifth of a second
+	log := filepath.Join(dir, "played")
+	script := filepath.Join(dir, "play.sh")
+	if err := ioutil.WriteFile(script, []byte(fmt.Sprintf("echo \"$1 $2\" >> %s\nsleep 0.2\n", log)), 0600); err != nil {
+		t.Fatalf("failed to write player: %v", err)
+	}
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	cfg.Music = music
+	cfg.Player = "command"
+	cfg.PlayerCommand = "sh " + script + " {file} {volume}"
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	status := func() server.MusicPlayerStatus {
+		var status server.MusicPlayerStatus
+		if code := c.do("GET", "/music", "", &status); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return status
+	}
+
+	if code := c.do("PUT", "/music/queue", `{"tracks": [1, 2]}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/music/seek?position=1", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// A paused track doesn't end, the volume applies to the next track
+	if code := c.do("PUT", "/music/pause", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/music/volume?level=30", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if s := status(); s.Track.ID != 1 || !s.Paused {
+		t.Fatalf("expected track #1 paused, got: %+v", s)
+	}
+	if code := c.do("PUT", "/music/resume", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	eventually(t, func() bool { return !status().State })
+
+	played, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	expected := []string{filepath.Join(music, "1.wav") + " 100", filepath.Join(music, "2.wav") + " 30"}
+	if lines := strings.Split(strings.TrimSpace(string(played)), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected played: %q, got: %q", expected, lines)
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/hashicorp/go-uuid"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// algorithmPBKDF2 derives keys with PBKDF2 and SHA-256
+	algorithmPBKDF2 = "pbkdf2-sha256"
+	// Passwords are hashed with iterations rounds, and rehashed on login if
+	// they were hashed with fewer
+	iterations = 32768
+	// legacyIterations hashed the credentials stored without parameters
+	legacyIterations = 4096
+	keyLength        = 64
+	// resetValidity is how long password resets are valid
+	resetValidity = 24 * time.Hour
+)
+
+var (
+	ErrUnknownReset   = errors.New("unknown or expired password reset")
+	errResetExists    = errors.New("password reset exists")
+	errUnknownHashing = errors.New("unknown hashing algorithm")
+)
+
+// newCredential returns the credentials of a password, hashed with a new salt
+// and the current parameters
+func newCredential(pw string) (credential, error) {
+	salt, err := uuid.GenerateUUID()
+	if err != nil {
+		return credential{}, fmt.Errorf("failed to generate uuid: %v", err)
+	}
+	key, err := deriveKey(pw, salt, algorithmPBKDF2, iterations)
+	if err != nil {
+		return credential{}, err
+	}
+	return credential{Key: key, Salt: salt, Algorithm: algorithmPBKDF2, Iterations: iterations}, nil
+}
+
+// deriveKey hashes a password with the given parameters
+func deriveKey(pw, salt, algorithm string, rounds int) (string, error) {
+	if algorithm != algorithmPBKDF2 || rounds <= 0 {
+		return "", errUnknownHashing
+	}
+	key := pbkdf2.Key([]byte(pw), []byte(salt), rounds, keyLength, sha256.New)
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// hashing returns the parameters the key was derived with
+func (c credential) hashing() (string, int) {
+	if c.Algorithm == "" {
+		return algorithmPBKDF2, legacyIterations
+	}
+	return c.Algorithm, c.Iterations
+}
+
+// matches tells whether pw is the password of the credentials
+func (c credential) matches(pw string) bool {
+	algorithm, rounds := c.hashing()
+	key, err := deriveKey(pw, c.Salt, algorithm, rounds)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(c.Key)) == 1
+}
+
+// outdated tells whether the key should be derived again with the current
+// parameters
+func (c credential) outdated() bool {
+	algorithm, rounds := c.hashing()
+	return algorithm != algorithmPBKDF2 || rounds < iterations
+}
+
+// setPassword replaces the password of the credentials with the one of p,
+// keeping the role
+func (c *credential) setPassword(p credential) {
+	c.Key, c.Salt, c.Algorithm, c.Iterations = p.Key, p.Salt, p.Algorithm, p.Iterations
+}
+
+// upgradeCredentials hashes the password of a user again with the current
+// parameters
+func (s *Server) upgradeCredentials(user, pw string) error {
+	fresh, err := newCredential(pw)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.UpdateCredentials(user, func(c *credential) { c.setPassword(fresh) })
+	return err
+}
+
+type passwordInput struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// ChangePassword changes the password of the user, ends its other sessions
+// and deletes its API keys
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var in passwordInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, msg)))
+		return
+	}
+
+	sess, _ := requestSession(r)
+	keys := []string{ipAttempts(r), userAttempts(sess.Username)}
+	if wait := s.lockedOut(keys...); wait > 0 {
+		tooManyRequests(w, "ChangePassword", clientIP(r), wait)
+		return
+	}
+
+	if in.NewPassword == "" {
+		msg := "missing new password"
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, msg)))
+		return
+	}
+
+	fresh, err := newCredential(in.NewPassword)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, err)))
+		return
+	}
+
+	creds, err := s.db.Credentials(sess.Username)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, err)))
+		return
+	}
+	if !creds.matches(in.CurrentPassword) {
+		msg := "incorrect password"
+		log.Printf("%s for %s\n", msg, sess.Username)
+		s.failedAttempt(keys...)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, msg)))
+		return
+	}
+
+	if _, err := s.db.UpdateCredentials(sess.Username, func(c *credential) { c.setPassword(fresh) }); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Change password failed: %s"}`, err)))
+		return
+	}
+
+	if err := s.sessionStore.revokeUser(sess.Username, sess.token); err != nil {
+		log.Printf("failed to end the other sessions of %s: %v", sess.Username, err)
+	}
+	if err := s.db.DeleteUserAPIKeys(sess.Username); err != nil {
+		log.Printf("failed to delete the API keys of %s: %v", sess.Username, err)
+	}
+	s.events.recheck()
+
+	buf, err := json.Marshal(StatusResponse{Message: "OK"})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// PasswordReset lets a user set a new password without the current one,
+// until it expires
+type PasswordReset struct {
+	// Code is presented with the new password
+	Code      string    `json:"code"`
+	Username  string    `json:"username"`
+	CreatedBy string    `json:"createdBy"`
+	Expires   time.Time `json:"expires"`
+}
+
+// AddPasswordReset creates a password reset for a user, replacing its previous
+// ones
+func (s *Server) AddPasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	name := mux.Vars(r)["username"]
+	u, _ := requestUser(r)
+
+	reset, err := s.addPasswordReset(u.Username, name)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownUser {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add password reset failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(reset)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add password reset failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+func (s *Server) addPasswordReset(by, user string) (PasswordReset, error) {
+	reset := PasswordReset{
+		Username:  user,
+		CreatedBy: by,
+		Expires:   s.clock.Now().Add(resetValidity),
+	}
+	for i := 0; i < maxRetries; i++ {
+		var err error
+		reset.Code, err = uuid.GenerateUUID()
+		if err != nil {
+			return PasswordReset{}, fmt.Errorf("failed to generate uuid: %v", err)
+		}
+
+		err = s.db.PutPasswordReset(reset)
+		if err == errResetExists {
+			continue
+		}
+		if err != nil {
+			return PasswordReset{}, err
+		}
+		return reset, nil
+	}
+	return PasswordReset{}, errors.New("no unused code found")
+}
+
+type resetInput struct {
+	Username    string `json:"username"`
+	Code        string `json:"code"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ResetPassword sets a new password with a password reset, which is used up,
+// ends the sessions of the user and deletes its API keys
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var in resetInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Reset password failed: %s"}`, msg)))
+		return
+	}
+
+	if wait := s.lockedOut(ipAttempts(r)); wait > 0 {
+		tooManyRequests(w, "ResetPassword", clientIP(r), wait)
+		return
+	}
+
+	if in.NewPassword == "" {
+		msg := "missing new password"
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Reset password failed: %s"}`, msg)))
+		return
+	}
+
+	fresh, err := newCredential(in.NewPassword)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Reset password failed: %s"}`, err)))
+		return
+	}
+
+	if err := s.db.RedeemPasswordReset(in.Code, in.Username, fresh, s.clock.Now()); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownReset {
+			code = http.StatusBadRequest
+			s.failedAttempt(ipAttempts(r))
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Reset password failed: %s"}`, err)))
+		return
+	}
+
+	if err := s.sessionStore.revokeUser(in.Username, ""); err != nil {
+		log.Printf("failed to end the sessions of %s: %v", in.Username, err)
+	}
+	s.events.recheck()
+
+	// The user may have been locked out guessing its password
+	if err := s.db.ClearAttempts(userAttempts(in.Username)); err != nil {
+		log.Printf("failed to clear attempts of %s: %v\n", in.Username, err)
+	}
+
+	buf, err := json.Marshal(StatusResponse{Message: "OK"})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// sweepPasswordResets deletes expired password resets
+func (s *Server) sweepPasswordResets() {
+	if err := s.db.DeleteExpiredPasswordResets(s.clock.Now()); err != nil {
+		log.Printf("error: failed to delete expired password resets: %v", err)
+	}
+}
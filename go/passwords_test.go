@@ -0,0 +1,146 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestPasswords(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	if err := c.srv.PutUser("alice", server.RoleMember); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	public := &testClient{t: t, srv: c.srv, url: c.url}
+
+	// login returns the status of a login and a client of its session
+	login := func(name, pw string) (int, *testClient) {
+		var token server.StatusResponse
+		code := public.do("POST", "/login", fmt.Sprintf(`{"username": %q, "password": %q}`, name, pw), &token)
+		return code, &testClient{t: t, srv: c.srv, url: c.url, token: token.Message}
+	}
+	_, first := login("alice", "password")
+	_, second := login("alice", "password")
+
+	for _, tt := range []struct {
+		desc string
+		body string
+		code int
+	}{
+		{"wrong password", `{"currentPassword": "guess", "newPassword": "secret"}`, http.StatusBadRequest},
+		{"no new password", `{"currentPassword": "password", "newPassword": ""}`, http.StatusBadRequest},
+		{"changed", `{"currentPassword": "password", "newPassword": "secret"}`, http.StatusOK},
+	} {
+		if code := first.do("PUT", "/password", tt.body, nil); code != tt.code {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, tt.code, code)
+		}
+	}
+
+	// Other sessions end with a password change
+	if code := first.do("GET", "/sessions", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := second.do("GET", "/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code, _ := login("alice", "password"); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code, _ := login("alice", "secret"); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	// Admins reset passwords
+	if code := first.do("POST", "/users/alice/password-reset", "", nil); code != http.StatusForbidden {
+		t.Fatalf("expected status: %d, got: %d", http.StatusForbidden, code)
+	}
+	if code := c.do("POST", "/users/carol/password-reset", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	var reset server.PasswordReset
+	if code := c.do("POST", "/users/alice/password-reset", "", &reset); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	var k server.APIKey
+	if code := first.do("POST", "/apikeys", `{"name": "tablet", "scopes": ["read"]}`, &k); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	key := &testClient{t: t, srv: c.srv, url: c.url, apiKey: k.Key}
+	if code := key.do("GET", "/lights", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if reset.Code == "" || reset.Username != "alice" || !reset.Expires.Equal(clock.Now().Add(24*time.Hour)) {
+		t.Fatalf("unexpected password reset: %+v", reset)
+	}
+
+	resetPassword := func(name, code string) int {
+		return public.do("POST", "/password-reset", fmt.Sprintf(`{"username": %q, "code": %q, "newPassword": "reset"}`, name, code), nil)
+	}
+	if code := resetPassword("admin", reset.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	if code := resetPassword("alice", reset.Code); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := resetPassword("alice", reset.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// Every session and API key ends with a reset
+	if code := first.do("GET", "/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code := key.do("GET", "/lights", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code, _ := login("alice", "reset"); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	// Resets expire, and replace the previous ones
+	if code := c.do("POST", "/users/alice/password-reset", "", &reset); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	replaced := reset.Code
+	if code := c.do("POST", "/users/alice/password-reset", "", &reset); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	if code := resetPassword("alice", replaced); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+	clock.Advance(25 * time.Hour)
+	if code := resetPassword("alice", reset.Code); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+
+	// Passwords hashed with outdated parameters are upgraded on login
+	if err := c.srv.PutLegacyUser("root"); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if code, _ := login("root", "password"); code != http.StatusOK {
+			t.Fatalf("login %d: expected status: %d, got: %d", i+1, http.StatusOK, code)
+		}
+		algorithm, rounds, err := c.srv.Hashing("root")
+		if err != nil || algorithm != "pbkdf2-sha256" || rounds <= 4096 {
+			t.Fatalf("expected an upgraded hash, got: %s %d %v", algorithm, rounds, err)
+		}
+	}
+}
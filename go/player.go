@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Player plays tracks
+type Player interface {
+	// Formats returns the extensions of the files it plays, e.g. ".mp3"
+	Formats() []string
+	// Start starts playing file at volume percent
+	Start(file string, volume int) (Playback, error)
+}
+
+// Playback is a track being played
+type Playback interface {
+	// Wait waits for the track to end, returning why it failed to play
+	Wait() error
+	// Progress returns the position in the track and its duration in
+	// seconds, ok is false if the player doesn't report them
+	Progress() (position, duration float64, ok bool)
+	// Pause toggles pausing
+	Pause() error
+	// Seek jumps to position seconds in the track
+	Seek(position float64) error
+	// SetVolume sets the volume in percent
+	SetVolume(volume int) error
+	// Stop stops playing, Wait returns once it stopped
+	Stop()
+}
+
+// NewPlayer returns the Player selected by cfg
+func NewPlayer(cfg Config) (Player, error) {
+	switch cfg.Player {
+	case "mpg123":
+		return mpg123Player{bin: cfg.MPG123}, nil
+	case "command":
+		args := strings.Fields(cfg.PlayerCommand)
+		if len(args) == 0 {
+			return nil, errors.New("the player command is empty")
+		}
+		return commandPlayer{args: args, formats: cfg.PlayerFormats}, nil
+	case "none":
+		return NewRecordingPlayer(cfg.PlayerFormats), nil
+	default:
+		return nil, fmt.Errorf("unknown player: %s", cfg.Player)
+	}
+}
+
+// commandPlayer plays each track with a command line, in which {file} and
+// {volume} are replaced by the file and the volume in percent. The command
+// runs in its own process group, so wrapper scripts are paused and stopped
+// with their children. Seeking is not supported and volume changes apply
+// from the next track.
+type commandPlayer struct {
+	args    []string
+	formats []string
+}
+
+func (c commandPlayer) Formats() []string {
+	return c.formats
+}
+
+func (c commandPlayer) Start(file string, volume int) (Playback, error) {
+	r := strings.NewReplacer("{file}", file, "{volume}", strconv.Itoa(volume))
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		args[i] = r.Replace(a)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", args[0], err)
+	}
+
+	p := &commandPlayback{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+type commandPlayback struct {
+	cmd *exec.Cmd
+	// done is closed once the process exited with err
+	done chan struct{}
+	err  error
+
+	mu     sync.Mutex
+	paused bool
+}
+
+func (p *commandPlayback) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *commandPlayback) Progress() (float64, float64, bool) {
+	return 0, 0, false
+}
+
+func (p *commandPlayback) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sig := syscall.SIGSTOP
+	if p.paused {
+		sig = syscall.SIGCONT
+	}
+	if err := p.signal(sig); err != nil {
+		return fmt.Errorf("failed to pause player: %v", err)
+	}
+	p.paused = !p.paused
+	return nil
+}
+
+func (p *commandPlayback) Seek(position float64) error {
+	return invalidError("the player command can't seek")
+}
+
+func (p *commandPlayback) SetVolume(volume int) error {
+	return nil
+}
+
+func (p *commandPlayback) Stop() {
+	p.signal(syscall.SIGKILL)
+}
+
+// signal sends sig to the process group of the command
+func (p *commandPlayback) signal(sig syscall.Signal) error {
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+// RecordingPlayer is a Player that plays nothing and records what it is
+// asked to do. Its tracks play until stopped or ended with Finish.
+type RecordingPlayer struct {
+	formats []string
+
+	mu       sync.Mutex
+	commands []string
+	current  *recordedPlayback
+}
+
+// NewRecordingPlayer returns a RecordingPlayer of files with the given
+// extensions
+func NewRecordingPlayer(formats []string) *RecordingPlayer {
+	return &RecordingPlayer{formats: formats}
+}
+
+// Formats returns the extensions passed to NewRecordingPlayer
+func (r *RecordingPlayer) Formats() []string {
+	return r.formats
+}
+
+// Start records "play <file> <volume>"
+func (r *RecordingPlayer) Start(file string, volume int) (Playback, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, fmt.Sprintf("play %s %d", file, volume))
+	r.current = &recordedPlayback{player: r, done: make(chan struct{})}
+	return r.current, nil
+}
+
+// Commands returns what was recorded so far, e.g. "pause" or "seek 30.0"
+func (r *RecordingPlayer) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// Finish ends the track being played as if it ended by itself, or failed to
+// play with err. It returns false if no track is being played.
+func (r *RecordingPlayer) Finish(err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current == nil {
+		return false
+	}
+	r.current.end(err)
+	return true
+}
+
+func (r *RecordingPlayer) record(p *recordedPlayback, cmd string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, cmd)
+	if cmd == "stop" && r.current == p {
+		p.end(nil)
+	}
+}
+
+// recordedPlayback is a track of a RecordingPlayer, guarded by its lock
+type recordedPlayback struct {
+	player *RecordingPlayer
+	done   chan struct{}
+	err    error
+}
+
+// end closes done with err, the player lock is held
+func (p *recordedPlayback) end(err error) {
+	p.err = err
+	close(p.done)
+	p.player.current = nil
+}
+
+func (p *recordedPlayback) Wait() error {
+	<-p.done
+
+	p.player.mu.Lock()
+	defer p.player.mu.Unlock()
+	return p.err
+}
+
+func (p *recordedPlayback) Progress() (float64, float64, bool) {
+	return 0, 0, false
+}
+
+func (p *recordedPlayback) Pause() error {
+	p.player.record(p, "pause")
+	return nil
+}
+
+func (p *recordedPlayback) Seek(position float64) error {
+	p.player.record(p, fmt.Sprintf("seek %.1f", position))
+	return nil
+}
+
+func (p *recordedPlayback) SetVolume(volume int) error {
+	p.player.record(p, fmt.Sprintf("volume %d", volume))
+	return nil
+}
+
+func (p *recordedPlayback) Stop() {
+	p.player.record(p, "stop")
+}
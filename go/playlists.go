@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrUnknownPlaylist = errors.New("unknown playlist")
+
+// Playlist is a named list of tracks, played by loading it into the queue
+type Playlist struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Tracks []int  `json:"tracks"`
+}
+
+// validatePlaylist checks a new playlist
+func (s *Server) validatePlaylist(p Playlist) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return invalidError("name is required")
+	}
+	_, err := s.queueTracks(p.Tracks)
+	return err
+}
+
+// Playlists lists the playlists
+func (s *Server) Playlists(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	playlists, err := s.db.Playlists()
+	if err != nil {
+		msg := fmt.Sprintf("failed to read playlists: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Playlists failed: %s"}`, msg)))
+		return
+	}
+
+	buf, err := json.Marshal(playlists)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Playlists failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddPlaylist creates a playlist
+func (s *Server) AddPlaylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var p Playlist
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add playlist failed: %s"}`, msg)))
+		return
+	}
+	p.ID = 0
+
+	if err := s.validatePlaylist(p); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add playlist failed: %s"}`, err)))
+		return
+	}
+
+	p, err := s.db.PutPlaylist(p)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add playlist failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(p)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// DeletePlaylist removes a playlist, the queue is left alone
+func (s *Server) DeletePlaylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["playlistID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete playlist failed: %s"}`, msg)))
+		return
+	}
+
+	if err := s.db.DeletePlaylist(id); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownPlaylist {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete playlist failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted playlist #%d", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// PlayPlaylist queues the tracks of a playlist instead of the queued ones and
+// plays the first. Tracks no longer available are skipped.
+func (s *Server) PlayPlaylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["playlistID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play playlist failed: %s"}`, msg)))
+		return
+	}
+
+	p, err := s.db.Playlist(id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownPlaylist {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play playlist failed: %s"}`, err)))
+		return
+	}
+
+	var ids []int
+	for _, t := range p.Tracks {
+		if _, ok := s.house.Track(t); !ok {
+			log.Printf("skipping unknown track #%d of playlist #%d", t, p.ID)
+			continue
+		}
+		ids = append(ids, t)
+	}
+
+	status, err := s.playQueue(ids)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isInvalid(err) {
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play playlist failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(status)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Play playlist failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Repeat modes of the play queue
+const (
+	RepeatOff = "off"
+	RepeatAll = "all"
+	RepeatOne = "one"
+)
+
+// Queue is the play queue of the music player
+type Queue struct {
+	// Tracks are listed in play order
+	Tracks []Track `json:"tracks"`
+	// Position is the index in Tracks of the current track, -1 if none
+	Position int    `json:"position"`
+	Shuffle  bool   `json:"shuffle"`
+	Repeat   string `json:"repeat"`
+}
+
+// playQueue is the order tracks are played in. Shuffling only changes the
+// play order, so turning it off goes back to the order tracks were queued in.
+type playQueue struct {
+	tracks []Track
+	// order holds the indexes in tracks in play order
+	order []int
+	// pos is the index in order of the current track, -1 if none
+	pos     int
+	shuffle bool
+	repeat  string
+	rand    *rand.Rand
+}
+
+func newPlayQueue() *playQueue {
+	return &playQueue{
+		pos:    -1,
+		repeat: RepeatOff,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// snapshot returns the queue in play order
+func (q *playQueue) snapshot() Queue {
+	tracks := make([]Track, len(q.order))
+	for i, k := range q.order {
+		tracks[i] = q.tracks[k]
+	}
+	return Queue{Tracks: tracks, Position: q.pos, Shuffle: q.shuffle, Repeat: q.repeat}
+}
+
+// current returns the current track
+func (q *playQueue) current() (Track, bool) {
+	if q.pos < 0 || q.pos >= len(q.order) {
+		return Track{}, false
+	}
+	return q.tracks[q.order[q.pos]], true
+}
+
+// replace queues tracks instead of the queued ones and moves to the first
+func (q *playQueue) replace(tracks []Track) {
+	q.tracks = append([]Track(nil), tracks...)
+	q.order = make([]int, len(tracks))
+	for i := range q.order {
+		q.order[i] = i
+	}
+	if q.shuffle {
+		q.shuffleFrom(0)
+	}
+
+	q.pos = -1
+	if len(tracks) > 0 {
+		q.pos = 0
+	}
+}
+
+// add queues tracks after the queued ones, shuffled among the tracks still to
+// be played if shuffle is on
+func (q *playQueue) add(tracks []Track) {
+	for _, t := range tracks {
+		q.tracks = append(q.tracks, t)
+		q.order = append(q.order, len(q.tracks)-1)
+	}
+	if q.shuffle {
+		q.shuffleFrom(q.pos + 1)
+	}
+}
+
+// jump makes t the current track. A track not queued yet is queued right
+// after the current one.
+func (q *playQueue) jump(t Track) {
+	for i, k := range q.order {
+		if q.tracks[k].ID == t.ID {
+			q.pos = i
+			return
+		}
+	}
+
+	q.tracks = append(q.tracks, t)
+	at := q.pos + 1
+	q.order = append(q.order, 0)
+	copy(q.order[at+1:], q.order[at:])
+	q.order[at] = len(q.tracks) - 1
+	q.pos = at
+}
+
+// remove takes the track with the given id out of the queue and returns
+// false if it wasn't queued. If it was current the track after it becomes
+// current.
+func (q *playQueue) remove(id int) bool {
+	removed := false
+	for k := len(q.tracks) - 1; k >= 0; k-- {
+		if q.tracks[k].ID == id {
+			q.removeAt(k)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// removeAt takes q.tracks[k] out of the queue
+func (q *playQueue) removeAt(k int) {
+	q.tracks = append(q.tracks[:k], q.tracks[k+1:]...)
+
+	order := q.order[:0]
+	for i, j := range q.order {
+		switch {
+		case j == k:
+			if i < q.pos {
+				q.pos--
+			}
+			continue
+		case j > k:
+			j--
+		}
+		order = append(order, j)
+	}
+	q.order = order
+	if q.pos >= len(q.order) {
+		q.pos = len(q.order) - 1
+	}
+}
+
+// next moves to the next track and returns false past the end of the queue.
+// ended tells the current track ended by itself, which repeat one replays.
+func (q *playQueue) next(ended bool) bool {
+	switch {
+	case len(q.order) == 0:
+		return false
+	case ended && q.repeat == RepeatOne && q.pos >= 0:
+		return true
+	case q.pos+1 < len(q.order):
+		q.pos++
+		return true
+	case q.repeat == RepeatOff:
+		return false
+	}
+
+	// Wrap around, in a new order if shuffling
+	if q.shuffle {
+		q.shuffleFrom(0)
+	}
+	q.pos = 0
+	return true
+}
+
+// previous moves to the previous track. The first track stays current unless
+// the queue repeats.
+func (q *playQueue) previous() bool {
+	switch {
+	case len(q.order) == 0:
+		return false
+	case q.pos > 0:
+		q.pos--
+	case q.repeat != RepeatOff:
+		q.pos = len(q.order) - 1
+	default:
+		q.pos = 0
+	}
+	return true
+}
+
+// setShuffle turns shuffling on or off, the current track stays current
+func (q *playQueue) setShuffle(on bool) {
+	if on == q.shuffle {
+		return
+	}
+	q.shuffle = on
+
+	cur := -1
+	if q.pos >= 0 {
+		cur = q.order[q.pos]
+	}
+	for i := range q.order {
+		q.order[i] = i
+	}
+
+	switch {
+	case cur < 0:
+		if on {
+			q.shuffleFrom(0)
+		}
+	case on:
+		// Play the rest in random order after the current track
+		q.order[0], q.order[cur] = q.order[cur], q.order[0]
+		q.pos = 0
+		q.shuffleFrom(1)
+	default:
+		q.pos = cur
+	}
+}
+
+// shuffleFrom shuffles the play order from index i
+func (q *playQueue) shuffleFrom(i int) {
+	rest := q.order[i:]
+	q.rand.Shuffle(len(rest), func(a, b int) {
+		rest[a], rest[b] = rest[b], rest[a]
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleClients bounds how many clients a RateLimiter tracks before it
+// forgets the ones back to a full burst
+const maxIdleClients = 1024
+
+// RateLimiter limits the requests of each client IP to a burst, refilled at
+// a steady rate
+type RateLimiter struct {
+	// interval is how long one request takes to refill
+	interval time.Duration
+	burst    float64
+	clock    Clock
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing perMinute requests per client
+// on average, and burst at once
+func NewRateLimiter(perMinute, burst int, clock Clock) *RateLimiter {
+	return &RateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    float64(burst),
+		clock:    clock,
+		clients:  make(map[string]*tokenBucket),
+	}
+}
+
+// Limit wraps a route handler, answering 429 to clients over the limit
+func (l *RateLimiter) Limit(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if wait := l.take(ip); wait > 0 {
+			tooManyRequests(w, fmt.Sprintf("%s %s", r.Method, r.URL.Path), ip, wait)
+			return
+		}
+
+		inner(w, r)
+	}
+}
+
+// take uses a request of client, or returns how long it must wait for one
+func (l *RateLimiter) take(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxIdleClients {
+			l.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.last))/float64(l.interval))
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(l.interval))
+	}
+	b.tokens--
+	return 0
+}
+
+// forgetIdle drops the clients that are back to a full burst
+func (l *RateLimiter) forgetIdle(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+float64(now.Sub(b.last))/float64(l.interval) >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// clientIP returns the IP address a request comes from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests rejects a request of client, which may retry after wait
+func tooManyRequests(w http.ResponseWriter, name, client string, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	log.Printf("%s: too many requests from %s, retry in %ds\n", name, client, secs)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(fmt.Sprintf(`{"message": "Too many requests: retry in %ds"}`, secs)))
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles of users
+const (
+	// RoleAdmin may do anything, including changing roles
+	RoleAdmin = "admin"
+	// RoleMember may do anything but administer users and the house setup
+	RoleMember = "member"
+	// RoleGuest may only control the music and the lights it was given
+	RoleGuest = "guest"
+)
+
+var ErrUnknownUser = errors.New("unknown user")
+
+// Permission is what a route requires of the user sending a request. The zero
+// value only lets admins in.
+type Permission int
+
+const (
+	// AllowAdmin routes are open to admins
+	AllowAdmin Permission = iota
+	// AllowMember routes are open to members and admins
+	AllowMember
+	// AllowGuestLight routes are also open to guests for the lights they were
+	// given, the light is the lightID route variable
+	AllowGuestLight
+	// AllowGuest routes are open to every user
+	AllowGuest
+	// AllowPublic routes need no session
+	AllowPublic
+)
+
+// User is a registered user and its role
+type User struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	// Lights are the ids of the lights a guest may control
+	Lights []int `json:"lights,omitempty"`
+}
+
+func newUser(name string, c credential) User {
+	u := User{Username: name, Role: c.role()}
+	if u.Role == RoleGuest {
+		u.Lights = append([]int{}, c.Lights...)
+	}
+	return u
+}
+
+// allowed tells whether u may send r to a route requiring p
+func (u User) allowed(p Permission, r *http.Request) bool {
+	switch u.Role {
+	case RoleAdmin:
+		return true
+	case RoleMember:
+		return p != AllowAdmin
+	case RoleGuest:
+		switch p {
+		case AllowGuest, AllowPublic:
+			return true
+		case AllowGuestLight:
+			id, err := strconv.Atoi(mux.Vars(r)["lightID"])
+			return err == nil && u.controls(id)
+		}
+	}
+	return false
+}
+
+// controls tells whether u may control the light with the given id
+func (u User) controls(id int) bool {
+	if u.Role != RoleGuest {
+		return true
+	}
+	for _, l := range u.Lights {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize rejects authenticated requests from users whose role doesn't
+// allow them on the route, or sent with API keys whose scopes don't
+func (s *Server) Authorize(inner http.Handler, name string, allow Permission) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := requestSession(r)
+		if !ok || !sess.user.allowed(allow, r) {
+			forbidden(w, name, fmt.Sprintf("not allowed for role %s", sess.user.Role))
+			return
+		}
+		if sess.scopes != nil && !scopesAllow(sess.scopes, r) {
+			forbidden(w, name, fmt.Sprintf("not allowed for API key scopes %s", strings.Join(sess.scopes, ", ")))
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func forbidden(w http.ResponseWriter, name, msg string) {
+	log.Printf("%s: forbidden: %s\n", name, msg)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(fmt.Sprintf(`{"message": "Forbidden: %s"}`, msg)))
+}
+
+// Users lists the registered users ordered by name
+func (s *Server) Users(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	creds, err := s.db.Users()
+	if err != nil {
+		msg := fmt.Sprintf("failed to read users: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Users failed: %s"}`, msg)))
+		return
+	}
+
+	users := make([]User, 0, len(creds))
+	for name, c := range creds {
+		users = append(users, newUser(name, c))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	buf, err := json.Marshal(users)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Users failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+type roleInput struct {
+	Role string `json:"role"`
+	// Lights are the lights a guest may control
+	Lights []int `json:"lights"`
+}
+
+// SetUserRole changes the role of a user, and the lights it may control as a
+// guest
+func (s *Server) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	name := mux.Vars(r)["username"]
+
+	var in roleInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Set role failed: %s"}`, msg)))
+		return
+	}
+
+	u, err := s.setRole(name, in)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case err == ErrUnknownUser:
+			code = http.StatusNotFound
+		case isInvalid(err):
+			code = http.StatusBadRequest
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Set role failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(u)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Set role failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func (s *Server) setRole(name string, in roleInput) (User, error) {
+	lights, err := s.checkRole(in)
+	if err != nil {
+		return User{}, err
+	}
+
+	c, err := s.db.SetRole(name, in.Role, lights)
+	if err != nil {
+		return User{}, err
+	}
+	if err := s.sessionStore.userChanged(name); err != nil {
+		log.Printf("failed to apply the role of %s to its sessions: %v", name, err)
+	}
+	// Event streams filter events with the role
+	s.events.recheck()
+	return newUser(name, c), nil
+}
+
+// checkRole validates a role and returns the lights a guest may control,
+// without duplicates
+func (s *Server) checkRole(in roleInput) ([]int, error) {
+	var lights []int
+	switch in.Role {
+	case RoleAdmin, RoleMember:
+	case RoleGuest:
+		seen := make(map[int]bool)
+		for _, id := range in.Lights {
+			if _, ok := s.house.Light(id); !ok {
+				return nil, invalidError(fmt.Sprintf("unknown light: %d", id))
+			}
+			if !seen[id] {
+				seen[id] = true
+				lights = append(lights, id)
+			}
+		}
+	default:
+		return nil, invalidError(fmt.Sprintf("invalid role '%s', expected admin, member or guest", in.Role))
+	}
+	return lights, nil
+}
@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestRoles(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	// login returns a client sending requests as a user with the given role
+	login := func(name, role string, lights ...int) *testClient {
+		if err := c.srv.PutUser(name, role, lights...); err != nil {
+			t.Fatalf("failed to put user: %v", err)
+		}
+		if err := c.srv.PutSession(name, name, time.Now().Unix()); err != nil {
+			t.Fatalf("failed to put session: %v", err)
+		}
+		return &testClient{t: t, srv: c.srv, url: c.url, token: name}
+	}
+	member := login("alice", server.RoleMember)
+	guest := login("bob", server.RoleGuest, 2)
+
+	for _, tt := range []struct {
+		desc   string
+		client *testClient
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"member lists users", member, "GET", "/users", "", http.StatusForbidden},
+		{"member adds a light", member, "POST", "/lights", `{"description": "hall", "channel": 9}`, http.StatusForbidden},
+		{"member switches a light", member, "PUT", "/lights/1/on", "", http.StatusOK},
+		{"member reads settings", member, "GET", "/settings/home/", "", http.StatusOK},
+		{"guest switches its light", guest, "PUT", "/lights/2/on", "", http.StatusOK},
+		{"guest dims its light", guest, "PUT", "/lights/2", `{"brightness": 40}`, http.StatusOK},
+		{"guest switches another light", guest, "PUT", "/lights/1/off", "", http.StatusForbidden},
+		{"guest reads another light", guest, "GET", "/lights/1", "", http.StatusForbidden},
+		{"guest plays music", guest, "PUT", "/music/play?trackId=1", "", http.StatusOK},
+		{"guest reads the queue", guest, "GET", "/music/queue", "", http.StatusOK},
+		{"guest reads settings", guest, "GET", "/settings/home/", "", http.StatusForbidden},
+		{"guest lists schedules", guest, "GET", "/schedules", "", http.StatusForbidden},
+		{"guest activates a scene", guest, "PUT", "/scenes/1/activate", "", http.StatusForbidden},
+	} {
+		if code := tt.client.do(tt.method, tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, tt.code, code)
+		}
+	}
+
+	var lights []server.Light
+	if code := guest.do("GET", "/lights", "", &lights); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(lights) != 1 || lights[0].ID != 2 {
+		t.Fatalf("expected only light #2, got: %+v", lights)
+	}
+
+	var users []server.User
+	if code := c.do("GET", "/users", "", &users); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expected := []server.User{
+		{Username: "admin", Role: server.RoleAdmin},
+		{Username: "alice", Role: server.RoleMember},
+		{Username: "bob", Role: server.RoleGuest, Lights: []int{2}},
+	}
+	if !reflect.DeepEqual(users, expected) {
+		t.Fatalf("expected users: %+v, got: %+v", expected, users)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		path string
+		body string
+		code int
+	}{
+		{"unknown role", "/users/alice/role", `{"role": "owner"}`, http.StatusBadRequest},
+		{"unknown light", "/users/alice/role", `{"role": "guest", "lights": [42]}`, http.StatusBadRequest},
+		{"unknown user", "/users/carol/role", `{"role": "member"}`, http.StatusNotFound},
+		{"last admin", "/users/admin/role", `{"role": "member"}`, http.StatusBadRequest},
+	} {
+		if code := c.do("PUT", tt.path, tt.body, nil); code != tt.code {
+			t.Errorf("%s: expected status: %d, got: %d", tt.desc, tt.code, code)
+		}
+	}
+
+	// Invitations are for members by default
+	var inv server.Invitation
+	if code := c.do("POST", "/invitations", `{}`, &inv); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	reg := fmt.Sprintf(`{"username": "carol", "password": "pw", "invitation": %q}`, inv.Code)
+	resp, err := http.Post(c.url+"/register", "application/json", strings.NewReader(reg))
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	resp.Body.Close()
+	users = nil
+	if code := c.do("GET", "/users", "", &users); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(users) != 4 || !reflect.DeepEqual(users[3], server.User{Username: "carol", Role: server.RoleMember}) {
+		t.Fatalf("expected carol registered as a member, got: %+v", users)
+	}
+
+	// Role changes apply to open sessions
+	var u server.User
+	if code := c.do("PUT", "/users/alice/role", `{"role": "guest", "lights": [1, 1]}`, &u); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if !reflect.DeepEqual(u, server.User{Username: "alice", Role: server.RoleGuest, Lights: []int{1}}) {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+	if code := member.do("PUT", "/lights/1/off", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := member.do("PUT", "/lights/2/off", "", nil); code != http.StatusForbidden {
+		t.Fatalf("expected status: %d, got: %d", http.StatusForbidden, code)
+	}
+
+	if code := c.do("PUT", "/users/bob/role", `{"role": "admin"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := guest.do("GET", "/users", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := guest.do("PUT", "/users/admin/role", `{"role": "member"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("GET", "/users", "", nil); code != http.StatusForbidden {
+		t.Fatalf("expected status: %d, got: %d", http.StatusForbidden, code)
+	}
+}
+
+func TestLegacyRoles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	_, c, stop := startConfiguredTestServer(t, cfg, nil)
+	for _, name := range []string{"root", "carol"} {
+		if err := c.srv.PutLegacyUser(name); err != nil {
+			t.Fatalf("failed to put user: %v", err)
+		}
+	}
+	stop()
+
+	// Users from before roles are members, but the configured admin
+	cfg.Admin = "root"
+	_, c, stop = startConfiguredTestServer(t, cfg, nil)
+	defer stop()
+
+	var users []server.User
+	if code := c.do("GET", "/users", "", &users); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expected := []server.User{
+		{Username: "admin", Role: server.RoleAdmin},
+		{Username: "carol", Role: server.RoleMember},
+		{Username: "root", Role: server.RoleAdmin},
+	}
+	if !reflect.DeepEqual(users, expected) {
+		t.Fatalf("expected users: %+v, got: %+v", expected, users)
+	}
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrUnknownRule = errors.New("unknown rule")
+	errNoLocation  = errors.New("no location is configured")
+)
+
+// Duration is a time.Duration written as a string in JSON, e.g. "10m"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule runs an action when a sensor reading crosses a threshold, e.g. turn
+// the living room light on when luminosity falls below 50 after sunset.
+//
+// Once a rule fires it is triggered and won't fire again until the reading
+// recovers past the threshold by Hysteresis. While cooling down after firing
+// it doesn't fire either, but stays ready to fire once the cooldown ends.
+type Rule struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Sensor string `json:"sensor"`
+	// Exactly one of Below and Above is set
+	Below      *float32 `json:"below,omitempty"`
+	Above      *float32 `json:"above,omitempty"`
+	Hysteresis float32  `json:"hysteresis,omitempty"`
+	Cooldown   Duration `json:"cooldown,omitempty"`
+	// After and Before restrict the rule to a time of day, "HH:MM" in the
+	// server's time zone, or "sunrise" or "sunset" at the configured
+	// location. The window may wrap around midnight.
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+	Action Action `json:"action"`
+
+	Triggered bool       `json:"triggered"`
+	LastFired *time.Time `json:"lastFired,omitempty"`
+}
+
+// RuleResult tells whether a rule fires for a reading, and why
+type RuleResult struct {
+	Rule   Rule   `json:"rule"`
+	Fires  bool   `json:"fires"`
+	Reason string `json:"reason"`
+}
+
+// met reports whether value is past the threshold
+func (r Rule) met(value float32) bool {
+	if r.Below != nil {
+		return value < *r.Below
+	}
+	return value > *r.Above
+}
+
+// recovered reports whether value is back past the threshold by the
+// hysteresis
+func (r Rule) recovered(value float32) bool {
+	if r.Below != nil {
+		return value >= *r.Below+r.Hysteresis
+	}
+	return value <= *r.Above-r.Hysteresis
+}
+
+// inWindow reports whether t is within the time of day of the rule. sun
+// returns the sunrise and sunset of the day of t, it is nil without a
+// location, and rules of sunrise or sunset are then never in their window.
+func (r Rule) inWindow(t time.Time, sun func(time.Time) (int, int)) bool {
+	m := t.Hour()*60 + t.Minute()
+	after, err := timeOfDay(r.After, t, sun)
+	if err != nil {
+		return false
+	}
+	before, err := timeOfDay(r.Before, t, sun)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case r.After == "" && r.Before == "":
+		return true
+	case r.Before == "":
+		return m >= after
+	case r.After == "":
+		return m < before
+	case after <= before:
+		return m >= after && m < before
+	default:
+		return m >= after || m < before
+	}
+}
+
+// step updates the state of r for a reading at now and reports whether it
+// fires
+func (r *Rule) step(value float32, now time.Time, sun func(time.Time) (int, int)) (bool, string) {
+	if r.Triggered {
+		if !r.recovered(value) {
+			return false, "already fired, waiting for the reading to recover"
+		}
+		r.Triggered = false
+	}
+
+	if !r.met(value) {
+		return false, "threshold not crossed"
+	}
+	if !r.inWindow(now, sun) {
+		return false, "outside the time of day"
+	}
+	if r.LastFired != nil {
+		if until := r.LastFired.Add(time.Duration(r.Cooldown)); now.Before(until) {
+			return false, fmt.Sprintf("cooling down until %s", until.Format(time.RFC3339))
+		}
+	}
+
+	fired := now
+	r.LastFired = &fired
+	r.Triggered = true
+	return true, "fires"
+}
+
+// timeOfDay returns the minutes since midnight of a bound of a rule window on
+// the day of t
+func timeOfDay(s string, t time.Time, sun func(time.Time) (int, int)) (int, error) {
+	if s != "sunrise" && s != "sunset" {
+		return parseTimeOfDay(s)
+	}
+	if sun == nil {
+		return 0, errNoLocation
+	}
+	rise, set := sun(t)
+	if s == "sunrise" {
+		return rise, nil
+	}
+	return set, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of "HH:MM"
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ruleEngine holds the rules and their state
+type ruleEngine struct {
+	mu    sync.Mutex
+	rules []Rule
+	// sun returns the sunrise and sunset of a day at the configured
+	// location, it is nil without one
+	sun func(time.Time) (int, int)
+}
+
+// list returns all rules
+func (e *ruleEngine) list() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Rule{}, e.rules...)
+}
+
+// add adds r with the next free id. commit runs before the rule is added,
+// under the lock, and aborts the change if it fails.
+func (e *ruleEngine) add(r Rule, commit func(Rule) error) (Rule, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r.ID = 0
+	for _, other := range e.rules {
+		if other.ID > r.ID {
+			r.ID = other.ID
+		}
+	}
+	r.ID++
+
+	if err := commit(r); err != nil {
+		return Rule{}, err
+	}
+
+	e.rules = append(e.rules, r)
+	return r, nil
+}
+
+// remove removes the rule with the given id. commit runs before the rule is
+// removed, under the lock, and aborts the change if it fails.
+func (e *ruleEngine) remove(id int, commit func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, r := range e.rules {
+		if r.ID != id {
+			continue
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		e.rules = append(e.rules[:i], e.rules[i+1:]...)
+		return nil
+	}
+	return ErrUnknownRule
+}
+
+// evaluate steps the rules on the sensor of reading. If commit is nil the
+// rules are left unchanged, otherwise it persists every rule whose state
+// changed, under the lock.
+func (e *ruleEngine) evaluate(reading SensorReading, now time.Time, commit func(Rule) error) []RuleResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var results []RuleResult
+	for i, r := range e.rules {
+		if r.Sensor != reading.Sensor {
+			continue
+		}
+
+		before := r
+		fires, reason := r.step(reading.Value, now, e.sun)
+		results = append(results, RuleResult{Rule: before, Fires: fires, Reason: reason})
+
+		if commit == nil || (r.Triggered == before.Triggered && r.LastFired == before.LastFired) {
+			continue
+		}
+		if err := commit(r); err != nil {
+			log.Printf("error: failed to persist rule #%d: %v", r.ID, err)
+		}
+		e.rules[i] = r
+	}
+	return results
+}
+
+// applyRules runs the actions of the rules firing for a reading
+func (s *Server) applyRules(reading SensorReading) {
+	for _, res := range s.rules.evaluate(reading, s.clock.Now(), s.db.PutRule) {
+		if !res.Fires {
+			continue
+		}
+
+		log.Printf("rule #%d fired on %s %v", res.Rule.ID, reading.Sensor, reading.Value)
+		if err := s.runAction(res.Rule.Action); err != nil {
+			log.Printf("error: rule #%d failed: %v", res.Rule.ID, err)
+		}
+	}
+}
+
+// validateRule checks a new rule
+func (s *Server) validateRule(r Rule) error {
+	if s.house.Sensor(r.Sensor) == nil {
+		return invalidError(fmt.Sprintf("unknown sensor '%s'", r.Sensor))
+	}
+	if (r.Below == nil) == (r.Above == nil) {
+		return invalidError("exactly one of below and above is required")
+	}
+	if r.Hysteresis < 0 {
+		return invalidError(fmt.Sprintf("invalid hysteresis: %f", r.Hysteresis))
+	}
+	if r.Cooldown < 0 {
+		return invalidError(fmt.Sprintf("invalid cooldown: %v", time.Duration(r.Cooldown)))
+	}
+	for _, t := range []string{r.After, r.Before} {
+		switch {
+		case t == "":
+		case t == "sunrise" || t == "sunset":
+			if s.rules.sun == nil {
+				return invalidError(fmt.Sprintf("%s requires the latitude and longitude to be configured", t))
+			}
+		default:
+			if _, err := parseTimeOfDay(t); err != nil {
+				return invalidError(fmt.Sprintf("invalid time of day '%s', expected HH:MM, sunrise or sunset", t))
+			}
+		}
+	}
+	return s.validateAction(r.Action)
+}
+
+// Rules lists the rules with their state
+func (s *Server) Rules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	buf, err := json.Marshal(s.rules.list())
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Rules failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddRule creates a rule
+func (s *Server) AddRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add rule failed: %s"}`, msg)))
+		return
+	}
+	rule.Triggered = false
+	rule.LastFired = nil
+
+	if err := s.validateRule(rule); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add rule failed: %s"}`, err)))
+		return
+	}
+
+	rule, err := s.rules.add(rule, s.db.PutRule)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add rule failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(rule)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// DeleteRule removes a rule
+func (s *Server) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["ruleID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete rule failed: %s"}`, msg)))
+		return
+	}
+
+	err = s.rules.remove(id, func() error { return s.db.DeleteRule(id) })
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownRule {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete rule failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted rule #%d", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// DryRunRules shows which rules would fire for a reading, without running
+// them or changing their state
+func (s *Server) DryRunRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var reading SensorReading
+	if err := json.NewDecoder(r.Body).Decode(&reading); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Dry run failed: %s"}`, msg)))
+		return
+	}
+	if s.house.Sensor(reading.Sensor) == nil {
+		msg := fmt.Sprintf("unknown sensor '%s'", reading.Sensor)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Dry run failed: %s"}`, msg)))
+		return
+	}
+
+	results := s.rules.evaluate(reading, s.clock.Now(), nil)
+	if results == nil {
+		results = []RuleResult{}
+	}
+
+	buf, err := json.Marshal(results)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Dry run failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,178 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestRules(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 19, 0, 0, 0, time.UTC)}
+	sim, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"unknown sensor", `{"sensor": "humidity", "below": 50, "action": {"type": "notify", "message": "hi"}}`},
+		{"no threshold", `{"sensor": "luminosity", "action": {"type": "notify", "message": "hi"}}`},
+		{"two thresholds", `{"sensor": "luminosity", "below": 50, "above": 60, "action": {"type": "notify", "message": "hi"}}`},
+		{"negative hysteresis", `{"sensor": "luminosity", "below": 50, "hysteresis": -1, "action": {"type": "notify", "message": "hi"}}`},
+		{"bad cooldown", `{"sensor": "luminosity", "below": 50, "cooldown": "soon", "action": {"type": "notify", "message": "hi"}}`},
+		{"bad time", `{"sensor": "luminosity", "below": 50, "after": "25:00", "action": {"type": "notify", "message": "hi"}}`},
+		{"no message", `{"sensor": "luminosity", "below": 50, "action": {"type": "notify"}}`},
+	} {
+		if code := c.do("POST", "/rules", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.name, http.StatusBadRequest, code)
+		}
+	}
+
+	for _, body := range []string{
+		`{"name": "dusk", "sensor": "luminosity", "below": 50, "hysteresis": 10, "cooldown": "10m",
+		  "after": "18:00", "before": "06:00", "action": {"type": "light", "light": 3, "state": "on"}}`,
+		`{"name": "heat", "sensor": "temperature", "above": 30, "action": {"type": "notify", "message": "hot"}}`,
+	} {
+		if code := c.do("POST", "/rules", body, nil); code != http.StatusCreated {
+			t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+		}
+	}
+
+	dryRun := func(value float32) server.RuleResult {
+		var results []server.RuleResult
+		body := fmt.Sprintf(`{"sensor": "luminosity", "value": %v}`, value)
+		if code := c.do("POST", "/rules/dry-run", body, &results); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		if len(results) != 1 || results[0].Rule.ID != 1 {
+			t.Fatalf("expected a result for rule #1, got: %+v", results)
+		}
+		return results[0]
+	}
+
+	if res := dryRun(60); res.Fires {
+		t.Fatalf("expected rule not to fire above threshold, got: %+v", res)
+	}
+	if res := dryRun(40); !res.Fires {
+		t.Fatalf("expected rule to fire below threshold, got: %+v", res)
+	}
+	// A dry run changes nothing
+	if l := c.light(3); l.TurnOn {
+		t.Fatal("expected dry run not to switch light #3")
+	}
+
+	// Readings from the Arduino are evaluated
+	if err := sim.Emit(server.SensorReading{Sensor: "luminosity", Value: 40}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	eventually(t, func() bool { return c.light(3).TurnOn })
+
+	if code := c.do("PUT", "/lights/3/off", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		advance time.Duration
+		value   float32
+		fires   bool
+	}{
+		{"still dark", 0, 45, false},
+		{"within hysteresis", 0, 55, false},
+		{"recovered", 0, 65, false},
+		{"cooling down", time.Minute, 40, false},
+		{"cooled down", 10 * time.Minute, 40, true},
+		{"next morning", 12 * time.Hour, 70, false},
+		{"dark by day", 0, 40, false},
+	} {
+		clock.Advance(tt.advance)
+		if res := dryRun(tt.value); res.Fires != tt.fires {
+			t.Fatalf("%s: expected dry run to fire: %t, got: %+v", tt.name, tt.fires, res)
+		}
+		c.srv.UpdateSensor(server.SensorReading{Sensor: "luminosity", Value: tt.value})
+		if l := c.light(3); l.TurnOn != tt.fires {
+			t.Fatalf("%s: expected light #3 on: %t, got: %t", tt.name, tt.fires, l.TurnOn)
+		}
+		if tt.fires {
+			c.do("PUT", "/lights/3/off", "", nil)
+		}
+	}
+
+	var rules []server.Rule
+	if code := c.do("GET", "/rules", "", &rules); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(rules) != 2 || rules[0].LastFired == nil || rules[1].LastFired != nil {
+		t.Fatalf("expected rule #1 to have fired, got: %+v", rules)
+	}
+
+	if code := c.do("DELETE", "/rules/1", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", "/rules/1", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+}
+
+func TestSunRules(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Lisbon sets at 20:05 UTC on the solstice, and rises at 05:12
+	clock := &fakeClock{now: time.Date(2018, 6, 21, 19, 45, 0, 0, time.UTC)}
+	cfg := testConfig(filepath.Join(dir, "test.db"))
+	lat, lon := 38.72, -9.14
+	cfg.Latitude, cfg.Longitude = &lat, &lon
+	_, c, stop := startConfiguredTestServer(t, cfg, clock)
+	defer stop()
+
+	body := `{"sensor": "luminosity", "below": 50, "after": "sunset", "before": "sunrise", "action": {"type": "light", "light": 3, "state": "on"}}`
+	if code := c.do("POST", "/rules", body, nil); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+
+	for _, tt := range []struct {
+		at    time.Time
+		fires bool
+	}{
+		{time.Date(2018, 6, 21, 19, 45, 0, 0, time.UTC), false},
+		{time.Date(2018, 6, 21, 20, 25, 0, 0, time.UTC), true},
+		{time.Date(2018, 6, 22, 4, 50, 0, 0, time.UTC), true},
+		{time.Date(2018, 6, 22, 5, 30, 0, 0, time.UTC), false},
+	} {
+		clock.Advance(tt.at.Sub(clock.Now()))
+		var results []server.RuleResult
+		if code := c.do("POST", "/rules/dry-run", `{"sensor": "luminosity", "value": 40}`, &results); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		if len(results) != 1 || results[0].Fires != tt.fires {
+			t.Errorf("%v: expected fires: %v, got: %+v", tt.at, tt.fires, results)
+		}
+	}
+
+	// Without a location rules can't follow the sun
+	_, c2, stop2 := startClockedTestServer(t, filepath.Join(dir, "other.db"), clock)
+	defer stop2()
+	if code := c2.do("POST", "/rules", body, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status: %d, got: %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrUnknownScene = errors.New("unknown scene")
+
+// errNotRun reports the actions of a scene skipped as its lights failed
+var errNotRun = errors.New("not run, the lights failed")
+
+// Scene is a named set of actions applied together, e.g. "movie night":
+// living room off, kitchen on, play track 3. The other actions don't run when
+// the lights fail to switch.
+type Scene struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Actions []Action `json:"actions"`
+}
+
+// SceneResult is the outcome of an action of an activated scene
+type SceneResult struct {
+	Action Action `json:"action"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SceneActivation reports the outcome of every action of a scene
+type SceneActivation struct {
+	OK      bool          `json:"ok"`
+	Results []SceneResult `json:"results"`
+}
+
+// ScenePreview tells what an action of a scene would change
+type ScenePreview struct {
+	Action Action `json:"action"`
+	// Current is the state of the device, e.g. "off", "40%" or
+	// "playing <track>"
+	Current string `json:"current,omitempty"`
+	// Command is the Arduino command a light action sends
+	Command string `json:"command,omitempty"`
+	Changes bool   `json:"changes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validateScene checks a new scene
+func (s *Server) validateScene(sc Scene) error {
+	if strings.TrimSpace(sc.Name) == "" {
+		return invalidError("name is required")
+	}
+	if len(sc.Actions) == 0 {
+		return invalidError("at least one action is required")
+	}
+
+	lights := make(map[int]bool)
+	music := false
+	for i, a := range sc.Actions {
+		if err := s.validateAction(a); err != nil {
+			return invalidError(fmt.Sprintf("action #%d: %v", i+1, err))
+		}
+
+		switch a.Type {
+		case "light":
+			if lights[a.Light] {
+				return invalidError(fmt.Sprintf("action #%d: light #%d is already set", i+1, a.Light))
+			}
+			lights[a.Light] = true
+		case "music":
+			if music {
+				return invalidError(fmt.Sprintf("action #%d: music is already set", i+1))
+			}
+			music = true
+		}
+	}
+	return nil
+}
+
+// activateScene applies the light actions of sc in one batch, then the
+// others unless a light failed, so a scene is never applied by halves
+func (s *Server) activateScene(sc Scene) SceneActivation {
+	act := SceneActivation{OK: true, Results: make([]SceneResult, len(sc.Actions))}
+
+	var changes []lightChange
+	var index []int
+	errs := make([]error, len(sc.Actions))
+	for i, a := range sc.Actions {
+		if a.Type == "light" {
+			changes = append(changes, a.lightChange())
+			index = append(index, i)
+		}
+	}
+	failed := false
+	if len(changes) > 0 {
+		for k, err := range s.setLightStates(changes) {
+			errs[index[k]] = err
+			failed = failed || err != nil
+		}
+	}
+
+	for i, a := range sc.Actions {
+		switch {
+		case a.Type == "light":
+		case failed:
+			errs[i] = errNotRun
+		default:
+			errs[i] = s.runAction(a)
+		}
+	}
+
+	for i, a := range sc.Actions {
+		act.Results[i] = SceneResult{Action: a, OK: errs[i] == nil}
+		if errs[i] != nil {
+			act.OK = false
+			act.Results[i].Error = errs[i].Error()
+		}
+	}
+	return act
+}
+
+// previewScene tells what activating sc would change
+func (s *Server) previewScene(sc Scene) []ScenePreview {
+	previews := make([]ScenePreview, len(sc.Actions))
+	status := s.house.MusicStatus()
+	playing := "off"
+	if status.State {
+		playing = fmt.Sprintf("playing %s", status.Track.Name)
+	}
+
+	for i, a := range sc.Actions {
+		p := ScenePreview{Action: a}
+
+		switch a.Type {
+		case "light":
+			l, ok := s.house.Light(a.Light)
+			if !ok {
+				p.Error = fmt.Sprintf("unknown light #%d", a.Light)
+				break
+			}
+			p.Current = brightnessState(l.Brightness)
+			c := a.lightChange()
+			p.Changes = l.Brightness != c.Brightness
+			l.setBrightness(c.Brightness)
+			p.Command = lightCommand(l, 0)
+		case "music":
+			p.Current = playing
+			if a.State == "play" {
+				if _, ok := s.house.Track(a.Track); !ok {
+					p.Error = fmt.Sprintf("unknown track #%d", a.Track)
+					break
+				}
+				p.Changes = !status.State || status.Track.ID != a.Track
+			} else {
+				p.Changes = status.State
+			}
+		case "notify":
+			p.Changes = true
+		}
+		previews[i] = p
+	}
+	return previews
+}
+
+// brightnessState describes a brightness: on, off or the percentage
+func brightnessState(brightness int) string {
+	switch brightness {
+	case 0:
+		return "off"
+	case maxBrightness:
+		return "on"
+	default:
+		return fmt.Sprintf("%d%%", brightness)
+	}
+}
+
+// Scenes lists the scenes
+func (s *Server) Scenes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	scenes, err := s.db.Scenes()
+	if err != nil {
+		msg := fmt.Sprintf("failed to read scenes: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Scenes failed: %s"}`, msg)))
+		return
+	}
+
+	buf, err := json.Marshal(scenes)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Scenes failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddScene creates a scene
+func (s *Server) AddScene(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var sc Scene
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add scene failed: %s"}`, msg)))
+		return
+	}
+	sc.ID = 0
+
+	if err := s.validateScene(sc); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add scene failed: %s"}`, err)))
+		return
+	}
+
+	sc, err := s.db.PutScene(sc)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add scene failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(sc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// DeleteScene removes a scene
+func (s *Server) DeleteScene(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["sceneID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete scene failed: %s"}`, msg)))
+		return
+	}
+
+	if err := s.db.DeleteScene(id); err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownScene {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete scene failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted scene #%d", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// PreviewScene shows what activating a scene would change
+func (s *Server) PreviewScene(w http.ResponseWriter, r *http.Request) {
+	s.withScene(w, r, "Preview scene", func(sc Scene) interface{} {
+		return s.previewScene(sc)
+	})
+}
+
+// ActivateScene applies a scene and reports the outcome of every action
+func (s *Server) ActivateScene(w http.ResponseWriter, r *http.Request) {
+	s.withScene(w, r, "Activate scene", func(sc Scene) interface{} {
+		return s.activateScene(sc)
+	})
+}
+
+// withScene looks up the scene of the request and responds with the result
+// of handle
+func (s *Server) withScene(w http.ResponseWriter, r *http.Request, name string, handle func(Scene) interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["sceneID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, name, msg)))
+		return
+	}
+
+	sc, err := s.db.Scene(id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownScene {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, name, err)))
+		return
+	}
+
+	buf, err := json.Marshal(handle(sc))
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "%s failed: %s"}`, name, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestScenes(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"no name", `{"actions": [{"type": "light", "light": 1, "state": "on"}]}`},
+		{"no actions", `{"name": "empty"}`},
+		{"unknown light", `{"name": "x", "actions": [{"type": "light", "light": 42, "state": "on"}]}`},
+		{"light twice", `{"name": "x", "actions": [{"type": "light", "light": 1, "state": "on"}, {"type": "light", "light": 1, "state": "off"}]}`},
+		{"music twice", `{"name": "x", "actions": [{"type": "music", "state": "off"}, {"type": "music", "state": "play", "track": 1}]}`},
+	} {
+		if code := c.do("POST", "/scenes", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.name, http.StatusBadRequest, code)
+		}
+	}
+
+	var scene server.Scene
+	body := `{"name": "movie night", "actions": [
+		{"type": "light", "light": 3, "state": "off"},
+		{"type": "light", "light": 4, "state": "on"},
+		{"type": "music", "state": "play", "track": 3}
+	]}`
+	if code := c.do("POST", "/scenes", body, &scene); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+
+	var scenes []server.Scene
+	if code := c.do("GET", "/scenes", "", &scenes); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(scenes) != 1 || !reflect.DeepEqual(scenes[0], scene) {
+		t.Fatalf("expected scenes: %+v, got: %+v", []server.Scene{scene}, scenes)
+	}
+
+	var previews []server.ScenePreview
+	if code := c.do("GET", "/scenes/1/preview", "", &previews); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(previews) != 3 || previews[0].Changes || !previews[1].Changes || previews[1].Command != "led4_ON" ||
+		!previews[2].Changes || previews[2].Current != "off" {
+		t.Fatalf("unexpected preview: %+v", previews)
+	}
+	// A preview changes nothing
+	if l := c.light(4); l.TurnOn {
+		t.Fatal("expected preview not to switch light #4")
+	}
+
+	var act server.SceneActivation
+	if code := c.do("PUT", "/scenes/1/activate", "", &act); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if !act.OK || len(act.Results) != 3 {
+		t.Fatalf("expected all actions to succeed, got: %+v", act)
+	}
+	if l := c.light(4); !l.TurnOn {
+		t.Fatal("expected light #4 on")
+	}
+	var status server.MusicPlayerStatus
+	c.do("GET", "/music", "", &status)
+	if !status.State || status.Track.ID != 3 {
+		t.Fatalf("expected track #3 playing, got: %+v", status)
+	}
+
+	// The lights are switched in one batch after the restore on connect
+	cmds := sim.Commands()
+	if got := cmds[len(cmds)-2:]; !reflect.DeepEqual(got, []string{"led3_OFF", "led4_ON"}) {
+		t.Fatalf("expected batch: [led3_OFF led4_ON], got: %v", got)
+	}
+
+	// Lights of scenes can't be deleted
+	if code := c.do("DELETE", "/lights/4", "", nil); code != http.StatusConflict {
+		t.Fatalf("expected status: %d, got: %d", http.StatusConflict, code)
+	}
+
+	// The music isn't played when the lights fail
+	if code := c.do("PUT", "/music/off", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	sim.SetState(server.Disconnected)
+	act = server.SceneActivation{}
+	c.do("PUT", "/scenes/1/activate", "", &act)
+	if act.OK || act.Results[0].Error != "arduino is disconnected" || act.Results[2].OK ||
+		act.Results[2].Error != "not run, the lights failed" {
+		t.Fatalf("expected lights to fail while disconnected, got: %+v", act)
+	}
+	status = server.MusicPlayerStatus{}
+	c.do("GET", "/music", "", &status)
+	if status.State {
+		t.Fatalf("expected music off, got: %+v", status)
+	}
+	sim.SetState(server.Connected)
+
+	if code := c.do("PUT", "/scenes/2/activate", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	if code := c.do("DELETE", "/scenes/1", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("GET", "/scenes/1/preview", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+}
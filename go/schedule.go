@@ -0,0 +1,423 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest the scheduler sleeps, so it notices clock changes
+const maxScheduleWait = time.Minute
+
+var ErrUnknownSchedule = errors.New("unknown schedule")
+
+// Clock tells the time. The scheduler runs on it so tests can control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Schedule runs an action once at a time, or repeatedly on a cron expression
+// in the server's time zone, e.g. "0 7 * * 1-5" for 07:00 on weekdays.
+type Schedule struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name,omitempty"`
+	Cron   string     `json:"cron,omitempty"`
+	At     *time.Time `json:"at,omitempty"`
+	Action Action     `json:"action"`
+
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	// NextRun is absent once a one-shot schedule has run
+	NextRun *time.Time `json:"nextRun,omitempty"`
+}
+
+// Action is what a schedule or rule does: switch a light on or off, play a
+// track, stop the music or notify the event stream clients
+type Action struct {
+	// Type is "light", "music" or "notify"
+	Type  string `json:"type"`
+	Light int    `json:"light,omitempty"`
+	Track int    `json:"track,omitempty"`
+	// State is "on" or "off" for lights, "play", "pause", "resume", "next",
+	// "previous" or "off" for music
+	State string `json:"state,omitempty"`
+	// Brightness dims a light instead of switching it with State
+	Brightness *int   `json:"brightness,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// lightChange returns the change a light action makes
+func (a Action) lightChange() lightChange {
+	c := lightChange{ID: a.Light}
+	switch {
+	case a.Brightness != nil:
+		c.Brightness = *a.Brightness
+	case a.State == "on":
+		c.Brightness = maxBrightness
+	}
+	return c
+}
+
+// nextRun returns when sc runs next after now, or nil if it won't
+func (sc Schedule) nextRun(now time.Time) *time.Time {
+	if sc.At != nil {
+		if sc.LastRun != nil {
+			return nil
+		}
+		at := *sc.At
+		return &at
+	}
+
+	spec, err := parseCron(sc.Cron)
+	if err != nil {
+		return nil
+	}
+	next := spec.next(now)
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+// scheduler holds the schedules with their next run
+type scheduler struct {
+	mu        sync.Mutex
+	schedules []Schedule
+	// wake interrupts the wait for the next run when schedules change
+	wake chan struct{}
+}
+
+func newScheduler(schedules []Schedule, now time.Time) *scheduler {
+	for i := range schedules {
+		schedules[i].NextRun = schedules[i].nextRun(now)
+	}
+	return &scheduler{
+		schedules: schedules,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (sch *scheduler) notify() {
+	select {
+	case sch.wake <- struct{}{}:
+	default:
+	}
+}
+
+// list returns all schedules
+func (sch *scheduler) list() []Schedule {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return append([]Schedule{}, sch.schedules...)
+}
+
+// add adds sc with the next free id. commit runs before the schedule is
+// added, under the lock, and aborts the change if it fails.
+func (sch *scheduler) add(sc Schedule, now time.Time, commit func(Schedule) error) (Schedule, error) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	sc.ID = 0
+	for _, other := range sch.schedules {
+		if other.ID > sc.ID {
+			sc.ID = other.ID
+		}
+	}
+	sc.ID++
+	sc.NextRun = sc.nextRun(now)
+
+	if err := commit(sc); err != nil {
+		return Schedule{}, err
+	}
+
+	sch.schedules = append(sch.schedules, sc)
+	sch.notify()
+	return sc, nil
+}
+
+// remove removes the schedule with the given id. commit runs before the
+// schedule is removed, under the lock, and aborts the change if it fails.
+func (sch *scheduler) remove(id int, commit func() error) error {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	for i, sc := range sch.schedules {
+		if sc.ID != id {
+			continue
+		}
+		if err := commit(); err != nil {
+			return err
+		}
+		sch.schedules = append(sch.schedules[:i], sch.schedules[i+1:]...)
+		sch.notify()
+		return nil
+	}
+	return ErrUnknownSchedule
+}
+
+// next returns the earliest next run
+func (sch *scheduler) next() (time.Time, bool) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	var next time.Time
+	for _, sc := range sch.schedules {
+		if sc.NextRun != nil && (next.IsZero() || sc.NextRun.Before(next)) {
+			next = *sc.NextRun
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// due returns the schedules that should have run by now
+func (sch *scheduler) due(now time.Time) []Schedule {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	var due []Schedule
+	for _, sc := range sch.schedules {
+		if sc.NextRun != nil && !sc.NextRun.After(now) {
+			due = append(due, sc)
+		}
+	}
+	return due
+}
+
+// ran records that the schedule with the given id ran at t, failing with
+// runErr if not nil. commit persists the result under the lock.
+func (sch *scheduler) ran(id int, t time.Time, runErr error, commit func(Schedule) error) error {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	for i := range sch.schedules {
+		sc := &sch.schedules[i]
+		if sc.ID != id {
+			continue
+		}
+
+		ran := t
+		sc.LastRun = &ran
+		sc.LastError = ""
+		if runErr != nil {
+			sc.LastError = runErr.Error()
+		}
+		sc.NextRun = sc.nextRun(t)
+		return commit(*sc)
+	}
+	// Deleted while running
+	return nil
+}
+
+// runScheduler runs the schedules as they fall due until the server is closed
+func (s *Server) runScheduler() {
+	for {
+		now := s.clock.Now()
+		wait := maxScheduleWait
+		if next, ok := s.schedules.next(); ok && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+
+		select {
+		case <-s.clock.After(wait):
+			s.runDueSchedules()
+		case <-s.schedules.wake:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) runDueSchedules() {
+	now := s.clock.Now()
+	for _, sc := range s.schedules.due(now) {
+		err := s.runAction(sc.Action)
+		if err != nil {
+			log.Printf("error: schedule #%d failed: %v", sc.ID, err)
+		} else {
+			log.Printf("schedule #%d ran", sc.ID)
+		}
+
+		if err := s.schedules.ran(sc.ID, now, err, s.db.PutSchedule); err != nil {
+			log.Printf("error: failed to persist schedule #%d: %v", sc.ID, err)
+		}
+	}
+}
+
+// runAction performs an action the way the matching request would
+func (s *Server) runAction(a Action) error {
+	switch a.Type {
+	case "notify":
+		s.events.publish(NotifyEvent, StatusResponse{Message: a.Message})
+		return nil
+	case "light":
+		return s.setLightStates([]lightChange{a.lightChange()})[0]
+	case "music":
+		if a.State == "play" {
+			_, err := s.playTrack(a.Track)
+			return err
+		}
+		_, err := s.setMusicState(a.State)
+		return err
+	default:
+		return fmt.Errorf("unknown action type: %s", a.Type)
+	}
+}
+
+// validateSchedule checks a new schedule
+func (s *Server) validateSchedule(sc Schedule, now time.Time) error {
+	switch {
+	case sc.Cron == "" && sc.At == nil:
+		return invalidError("either cron or at is required")
+	case sc.Cron != "" && sc.At != nil:
+		return invalidError("only one of cron and at may be set")
+	case sc.At != nil && !sc.At.After(now):
+		return invalidError(fmt.Sprintf("at %s is in the past", sc.At.Format(time.RFC3339)))
+	case sc.Cron != "":
+		spec, err := parseCron(sc.Cron)
+		if err != nil {
+			return invalidError(fmt.Sprintf("invalid cron: %v", err))
+		}
+		if spec.next(now).IsZero() {
+			return invalidError(fmt.Sprintf("cron '%s' never runs", sc.Cron))
+		}
+	}
+
+	return s.validateAction(sc.Action)
+}
+
+// validateAction checks the action of a new schedule or rule
+func (s *Server) validateAction(a Action) error {
+	switch a.Type {
+	case "light":
+		if _, ok := s.house.Light(a.Light); !ok {
+			return invalidError(fmt.Sprintf("unknown light #%d", a.Light))
+		}
+		switch {
+		case a.Brightness != nil && a.State != "":
+			return invalidError("only one of state and brightness may be set")
+		case a.Brightness != nil:
+			if *a.Brightness < 0 || *a.Brightness > maxBrightness {
+				return invalidError(fmt.Sprintf("invalid brightness %d, expected 0 to %d", *a.Brightness, maxBrightness))
+			}
+		case a.State != "on" && a.State != "off":
+			return invalidError(fmt.Sprintf("invalid light state: %s", a.State))
+		}
+	case "music":
+		switch a.State {
+		case "play":
+			if _, ok := s.house.Track(a.Track); !ok {
+				return invalidError(fmt.Sprintf("unknown track #%d", a.Track))
+			}
+		case "off", "pause", "resume", "next", "previous":
+		default:
+			return invalidError(fmt.Sprintf("invalid music state: %s", a.State))
+		}
+	case "notify":
+		if a.Message == "" {
+			return invalidError("message is required")
+		}
+	default:
+		return invalidError(fmt.Sprintf("invalid action type '%s', expected light, music or notify", a.Type))
+	}
+	return nil
+}
+
+// Schedules lists the schedules with their last and next run
+func (s *Server) Schedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	buf, err := json.Marshal(s.schedules.list())
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Schedules failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// AddSchedule creates a schedule
+func (s *Server) AddSchedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var in Schedule
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		msg := fmt.Sprintf("failed to decode request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add schedule failed: %s"}`, msg)))
+		return
+	}
+	sc := Schedule{Name: in.Name, Cron: in.Cron, At: in.At, Action: in.Action}
+
+	now := s.clock.Now()
+	if err := s.validateSchedule(sc, now); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add schedule failed: %s"}`, err)))
+		return
+	}
+
+	sc, err := s.schedules.add(sc, now, s.db.PutSchedule)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Add schedule failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(sc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// DeleteSchedule removes a schedule
+func (s *Server) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id, err := strconv.Atoi(mux.Vars(r)["scheduleID"])
+	if err != nil {
+		msg := fmt.Sprintf("failed to parse id: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete schedule failed: %s"}`, msg)))
+		return
+	}
+
+	err = s.schedules.remove(id, func() error { return s.db.DeleteSchedule(id) })
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownSchedule {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Delete schedule failed: %s"}`, err)))
+		return
+	}
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, deleted schedule #%d", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,175 @@
+package server_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+// fakeClock is set by the test. Its timers never fire, the test runs due
+// schedules itself.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSchedules(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A Monday
+	start := time.Date(2018, 5, 28, 6, 59, 30, 0, time.UTC)
+	clock := &fakeClock{now: start}
+
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"no time", `{"action": {"type": "music", "state": "off"}}`},
+		{"cron and at", `{"cron": "0 7 * * *", "at": "2018-05-28T08:00:00Z", "action": {"type": "music", "state": "off"}}`},
+		{"past", `{"at": "2018-05-28T06:00:00Z", "action": {"type": "music", "state": "off"}}`},
+		{"bad cron", `{"cron": "0 25 * * *", "action": {"type": "music", "state": "off"}}`},
+		{"never", `{"cron": "0 0 30 2 *", "action": {"type": "music", "state": "off"}}`},
+		{"unknown light", `{"cron": "0 7 * * *", "action": {"type": "light", "light": 42, "state": "on"}}`},
+		{"bad state", `{"cron": "0 7 * * *", "action": {"type": "light", "light": 4, "state": "dim"}}`},
+		{"unknown track", `{"cron": "0 7 * * *", "action": {"type": "music", "state": "play", "track": 42}}`},
+		{"bad type", `{"cron": "0 7 * * *", "action": {"type": "oven", "state": "on"}}`},
+	} {
+		if code := c.do("POST", "/schedules", tt.body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", tt.name, http.StatusBadRequest, code)
+		}
+	}
+
+	var kitchen server.Schedule
+	body := `{"name": "kitchen", "cron": "0 7 * * 1-5", "action": {"type": "light", "light": 4, "state": "on"}}`
+	if code := c.do("POST", "/schedules", body, &kitchen); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	if expected := start.Add(30 * time.Second); kitchen.NextRun == nil || !kitchen.NextRun.Equal(expected) {
+		t.Fatalf("expected next run: %v, got: %v", expected, kitchen.NextRun)
+	}
+
+	for _, tt := range []struct {
+		at     string
+		action string
+	}{
+		{"07:05", `{"type": "music", "state": "play", "track": 3}`},
+		{"07:30", `{"type": "music", "state": "off"}`},
+		{"07:35", `{"type": "light", "light": 5, "state": "on"}`},
+	} {
+		body := fmt.Sprintf(`{"at": "2018-05-28T%s:00Z", "action": %s}`, tt.at, tt.action)
+		if code := c.do("POST", "/schedules", body, nil); code != http.StatusCreated {
+			t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+		}
+	}
+
+	// Nothing is due yet
+	c.srv.RunDueSchedules()
+	if l := c.light(4); l.TurnOn {
+		t.Fatal("expected light #4 off before 07:00")
+	}
+
+	clock.Advance(time.Minute)
+	c.srv.RunDueSchedules()
+	if l := c.light(4); !l.TurnOn {
+		t.Fatal("expected light #4 on after 07:00")
+	}
+
+	clock.Advance(10 * time.Minute)
+	c.srv.RunDueSchedules()
+	var status server.MusicPlayerStatus
+	c.do("GET", "/music", "", &status)
+	if !status.State || status.Track.ID != 3 {
+		t.Fatalf("expected track #3 playing, got: %+v", status)
+	}
+
+	if code := c.do("DELETE", "/schedules/4", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("DELETE", "/schedules/4", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+
+	clock.Advance(30 * time.Minute)
+	c.srv.RunDueSchedules()
+	c.do("GET", "/music", "", &status)
+	if status.State {
+		t.Fatalf("expected music off, got: %+v", status)
+	}
+	if l := c.light(5); l.TurnOn {
+		t.Fatal("expected deleted schedule not to run")
+	}
+
+	var schedules []server.Schedule
+	if code := c.do("GET", "/schedules", "", &schedules); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(schedules) != 3 {
+		t.Fatalf("expected 3 schedules, got: %+v", schedules)
+	}
+
+	// Cron schedules move on to the next match, one-shots are done
+	tuesday := time.Date(2018, 5, 29, 7, 0, 0, 0, time.UTC)
+	if sc := schedules[0]; sc.LastRun == nil || sc.NextRun == nil || !sc.NextRun.Equal(tuesday) {
+		t.Fatalf("expected last run and next run %v, got: %+v", tuesday, sc)
+	}
+	for _, sc := range schedules[1:] {
+		if sc.LastRun == nil || sc.NextRun != nil || sc.LastError != "" {
+			t.Fatalf("expected one-shot schedule done, got: %+v", sc)
+		}
+	}
+}
+
+func TestSchedulerRuns(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	at := time.Now().Add(50 * time.Millisecond).Format(time.RFC3339Nano)
+	body := fmt.Sprintf(`{"at": "%s", "action": {"type": "light", "light": 1, "state": "on"}}`, at)
+	if code := c.do("POST", "/schedules", body, nil); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+
+	eventually(t, func() bool {
+		return c.light(1).TurnOn
+	})
+}
+
+func (c *testClient) light(id int) server.Light {
+	var l server.Light
+	if code := c.do("GET", fmt.Sprintf("/lights/%d", id), "", &l); code != http.StatusOK {
+		c.t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	return l
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	minBackoff   = 500 * time.Millisecond
+	maxBackoff   = 30 * time.Second
+	writeTimeout = 5 * time.Second
+	queueSize    = 16
+)
+
+var (
+	ErrNotConnected = errors.New("serial port not connected")
+	ErrWriteTimeout = errors.New("timed out writing to serial port")
+	ErrClosed       = errors.New("serial connection closed")
+)
+
+// SerialConn owns the serial port to the Arduino. Commands are queued and
+// written by a single goroutine, incoming lines are delivered on Lines, and
+// the port is reopened with exponential backoff whenever it fails.
+type SerialConn struct {
+	open func() (io.ReadWriteCloser, error)
+
+	mu    sync.RWMutex
+	state ConnState
+
+	writes chan writeReq
+	lines  chan []byte
+	quit   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type writeReq struct {
+	cmd  []byte
+	errc chan error
+}
+
+// NewSerialConn starts managing the serial port described by conf
+func NewSerialConn(conf *serial.Config) *SerialConn {
+	return newSerialConn(func() (io.ReadWriteCloser, error) {
+		return serial.OpenPort(conf)
+	}, minBackoff, maxBackoff)
+}
+
+func newSerialConn(open func() (io.ReadWriteCloser, error), min, max time.Duration) *SerialConn {
+	c := &SerialConn{
+		open:       open,
+		writes:     make(chan writeReq, queueSize),
+		lines:      make(chan []byte, queueSize),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		minBackoff: min,
+		maxBackoff: max,
+	}
+	go c.run()
+	return c
+}
+
+// State returns the current state of the connection
+func (c *SerialConn) State() ConnState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+func (c *SerialConn) setState(s ConnState) {
+	c.mu.Lock()
+	c.state = s
+	c.mu.Unlock()
+}
+
+// Lines returns the newline delimited messages read from the port
+func (c *SerialConn) Lines() <-chan []byte {
+	return c.lines
+}
+
+// Send queues a command for the Arduino and waits until it has been written
+func (c *SerialConn) Send(cmd string) error {
+	return c.SendBatch([]string{cmd})
+}
+
+// SendBatch queues commands for the Arduino, to be written at once, and waits
+// until they have been written
+func (c *SerialConn) SendBatch(cmds []string) error {
+	if c.State() != Connected {
+		return ErrNotConnected
+	}
+
+	log.Printf("sending commands: %s\n", strings.Join(cmds, ", "))
+
+	req := writeReq{cmd: []byte(strings.Join(cmds, "\n") + "\n"), errc: make(chan error, 1)}
+	timeout := time.NewTimer(writeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case c.writes <- req:
+	case <-c.quit:
+		return ErrClosed
+	case <-timeout.C:
+		return ErrWriteTimeout
+	}
+
+	select {
+	case err := <-req.errc:
+		return err
+	case <-c.quit:
+		return ErrClosed
+	case <-timeout.C:
+		return ErrWriteTimeout
+	}
+}
+
+// Close closes the port and stops reconnecting
+func (c *SerialConn) Close() {
+	c.once.Do(func() { close(c.quit) })
+	<-c.done
+}
+
+func (c *SerialConn) run() {
+	defer close(c.done)
+	defer close(c.lines)
+
+	backoff := c.minBackoff
+	for {
+		c.setState(Connecting)
+
+		port, err := c.open()
+		if err != nil {
+			log.Printf("failed to open serial port, retrying in %v: %v\n", backoff, err)
+			c.setState(Disconnected)
+			if !c.wait(backoff) {
+				return
+			}
+			if backoff *= 2; backoff > c.maxBackoff {
+				backoff = c.maxBackoff
+			}
+			continue
+		}
+		backoff = c.minBackoff
+
+		log.Println("serial port connected")
+		c.setState(Connected)
+
+		readDone := make(chan struct{})
+		go func() {
+			if err := c.read(port); err != ErrClosed {
+				log.Printf("failed to read from serial port: %v\n", err)
+			}
+			close(readDone)
+		}()
+
+		closed := c.write(port, readDone)
+		c.setState(Disconnected)
+		port.Close()
+		<-readDone
+		if closed {
+			return
+		}
+		log.Println("serial port disconnected")
+	}
+}
+
+// wait sleeps for d, failing queued writes meanwhile. It returns false if the
+// connection was closed.
+func (c *SerialConn) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case req := <-c.writes:
+			req.errc <- ErrNotConnected
+		case <-t.C:
+			return true
+		case <-c.quit:
+			return false
+		}
+	}
+}
+
+// write drains the queue into port until a write or read fails. It returns
+// true if the connection was closed.
+func (c *SerialConn) write(port io.Writer, readDone chan struct{}) bool {
+	for {
+		select {
+		case req := <-c.writes:
+			_, err := port.Write(req.cmd)
+			req.errc <- err
+			if err != nil {
+				log.Printf("failed to write to serial port: %v\n", err)
+				return false
+			}
+		case <-readDone:
+			return false
+		case <-c.quit:
+			return true
+		}
+	}
+}
+
+// read delivers every non-empty line read from port until it fails
+func (c *SerialConn) read(port io.Reader) error {
+	r := bufio.NewReader(port)
+
+	var line []byte
+	for {
+		b, err := r.ReadBytes('\n')
+		line = append(line, b...)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			select {
+			case c.lines <- line:
+			case <-c.quit:
+				return ErrClosed
+			}
+		}
+		line = nil
+	}
+}
+
+func isTimeout(err error) bool {
+	t, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+// fakePort is an in-memory serial port
+type fakePort struct {
+	*io.PipeReader
+	in *io.PipeWriter
+
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func newFakePort() *fakePort {
+	r, w := io.Pipe()
+	return &fakePort{PipeReader: r, in: w}
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out.Write(b)
+}
+
+func (p *fakePort) written() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out.String()
+}
+
+func waitForState(t *testing.T, c *server.SerialConn, want server.ConnState) {
+	deadline := time.Now().Add(time.Second)
+	for c.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state: %v, got: %v", want, c.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSerialConn(t *testing.T) {
+	ports := make(chan *fakePort, 2)
+
+	var mu sync.Mutex
+	var opens int
+	open := func() (io.ReadWriteCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Fail the first two attempts to exercise the backoff
+		opens++
+		if opens <= 2 {
+			return nil, errors.New("no such device")
+		}
+
+		p := newFakePort()
+		ports <- p
+		return p, nil
+	}
+
+	c := server.NewTestSerialConn(open)
+	defer c.Close()
+
+	port := <-ports
+	waitForState(t, c, server.Connected)
+
+	if err := c.Send("led1_ON"); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if got := port.written(); got != "led1_ON\n" {
+		t.Fatalf("expected written: %q, got: %q", "led1_ON\n", got)
+	}
+	if err := c.SendBatch([]string{"led2_ON", "led3_OFF"}); err != nil {
+		t.Fatalf("failed to send batch: %v", err)
+	}
+	if got, want := port.written(), "led1_ON\nled2_ON\nled3_OFF\n"; got != want {
+		t.Fatalf("expected written: %q, got: %q", want, got)
+	}
+
+	go port.in.Write([]byte("\n{\"id\":1,\"turnon\":true}\r\n"))
+	select {
+	case line := <-c.Lines():
+		if string(line) != `{"id":1,"turnon":true}` {
+			t.Fatalf("unexpected line: %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for line")
+	}
+
+	// Unplugging the device should trigger a reconnect
+	port.in.CloseWithError(errors.New("device unplugged"))
+	select {
+	case <-ports:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for reconnect")
+	}
+	waitForState(t, c, server.Connected)
+}
+
+func TestSerialConnNotConnected(t *testing.T) {
+	c := server.NewTestSerialConn(func() (io.ReadWriteCloser, error) {
+		return nil, errors.New("no such device")
+	})
+	defer c.Close()
+
+	if err := c.Send("led1_ON"); err != server.ErrNotConnected {
+		t.Fatalf("expected error: %v, got: %v", server.ErrNotConnected, err)
+	}
+}
+
+func TestSimulatorBlockedEmit(t *testing.T) {
+	sim := server.NewSimulator()
+
+	// Emits block once the lines aren't received, without blocking the others
+	errc := make(chan error)
+	go func() {
+		for {
+			if err := sim.Emit(server.SensorReading{Sensor: "temperature", Value: 21.5}); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if state := sim.State(); state != server.Connected {
+			t.Fatalf("expected state: %s, got: %s", server.Connected, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sim.Close()
+	select {
+	case err := <-errc:
+		if err != server.ErrClosed {
+			t.Fatalf("expected error: %v, got: %v", server.ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for Emit to return")
+	}
+}
@@ -3,33 +3,43 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/tarm/serial"
 )
 
-const (
-	LIVE    = true
-	storage = "auth.db"
-	music   = "/home/pi/music/"
-)
-
-var (
-	serialConf   *serial.Config
-	lights       []Light
-	tracks       []Track
-	activeTrack  Track
-	trackPlaying bool
-	mpg123       *exec.Cmd
-	temperature  float32
-	luminosity   float32
-	settings     Settings
-)
+// How often the link to the Arduino is checked for reconnects
+const syncInterval = time.Second
+
+// Server is a smart house API. It owns the house state and its storage, and
+// relays commands to the house controller.
+type Server struct {
+	cfg     Config
+	db      *AuthStore
+	arduino Driver
+	player  Player
+	house   *House
+	events  *eventHub
+	router  *mux.Router
+
+	clock     Clock
+	schedules *scheduler
+	rules     *ruleEngine
+
+	// authLimit limits the login and registration requests of each client
+	authLimit *RateLimiter
+	// sessionStore creates and checks the sessions of logged in users
+	sessionStore sessionBackend
+
+	// scanMu serializes rescans of the music directory
+	scanMu sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
 
 type StatusResponse struct {
 	Message string `json:"message,omitempty"`
@@ -40,237 +50,799 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Allow       Permission
 }
 
 type Routes []Route
 
-func NewServer(device string, baud int) *mux.Router {
-	if err := NewAuthDB(storage); err != nil {
-		log.Fatalf("failed to create db: %v", err)
-	}
+// NewServer returns the API server for cfg. Commands for the house
+// controller go through driver, and tracks are played from the files in
+// cfg.Music with the player it selects. If it is empty a fixed demo track list
+// is served and nothing is played.
+func NewServer(cfg Config, driver Driver) (*Server, error) {
+	return newServer(cfg, driver, systemClock{})
+}
 
-	// Configure serial comms
-	serialConf = &serial.Config{Name: device, Baud: baud}
+func newServer(cfg Config, driver Driver, clock Clock) (*Server, error) {
+	db, err := NewAuthDB(cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create db: %v", err)
+	}
 
-	// Init Light state for each bedroom, all light start off
-	rooms := []string{"bedroom-1", "bedroom-2", "living room", "kitchen", "bathroom"}
+	// Restore the lights, the first start creates one per room, all off
+	lights, err := loadLights(db, cfg.Rooms)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load lights: %v", err)
+	}
 
-	for i := 0; i < 5; i++ {
-		l := Light{
-			ID:          i + 1,
-			Description: rooms[i],
-			TurnOn:      false,
-		}
+	schedules, err := db.Schedules()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load schedules: %v", err)
+	}
 
-		lights = append(lights, l)
+	rules, err := db.Rules()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load rules: %v", err)
 	}
 
-	// Init Settings
-	settings = Settings{
-		Automatic: false,
-		Threshold: 1,
+	player, err := NewPlayer(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	if LIVE {
-		// Init songs
-		files, err := ioutil.ReadDir(music)
+	tracks := demoTracks
+	if cfg.Music != "" {
+		tracks, _, err = scanLibrary(db, cfg.Music, player.Formats())
 		if err != nil {
-			log.Fatalf("failed to read music dir: %v", err)
+			db.Close()
+			return nil, err
 		}
+	}
 
-		for i, f := range files {
-			t := Track{
-				ID:   i + 1,
-				Name: f.Name(),
-			}
-			tracks = append(tracks, t)
-		}
+	sessions, err := newSessionBackend(cfg, db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load sessions: %v", err)
+	}
+
+	events := newEventHub()
+	s := &Server{
+		cfg:     cfg,
+		db:      db,
+		arduino: driver,
+		player:  player,
+		house:   NewHouse(lights, tracks, events, clock),
+		events:  events,
+		quit:    make(chan struct{}),
+
+		clock:     clock,
+		schedules: newScheduler(schedules, clock.Now()),
+		rules:     &ruleEngine{rules: rules, sun: cfg.sun()},
+		authLimit: NewRateLimiter(authRequestsPerMinute, authBurst, clock),
+
+		sessionStore: sessions,
+	}
+
+	// Launch receiver for updates from the Arduino, and restore the light
+	// states on the Arduino whenever it (re)connects
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.updateReceiver()
+	}()
+	s.syncController()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runScheduler()
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runSweeper()
+	}()
+
+	// Users registered before roles are members, but the configured admin
+	n, err := db.MigrateRoles(cfg.Admin)
+	if err != nil {
+		log.Printf("error: failed to migrate the roles of users: %v", err)
+	} else if n > 0 {
+		log.Printf("gave roles to %d users registered before roles", n)
+	}
 
-		// Launch receiver for serial updates from Arduino
-		go UpdateReceiver()
-
-	} else {
-		tracks = []Track{
-			Track{
-				ID:   1,
-				Name: "Rick Astley - Never Gonna Give You Up",
-			},
-			Track{
-				ID:   2,
-				Name: "Rick Astley - Whenever You Need Somebody",
-			},
-			Track{
-				ID:   3,
-				Name: "Rick Astley - Together Forever",
-			},
-			Track{
-				ID:   4,
-				Name: "Rick Astley - It Would Take a Strong Strong Man",
-			},
-			Track{
-				ID:   5,
-				Name: "Rick Astley - The Love Has Gone",
-			},
-			Track{
-				ID:   6,
-				Name: "Rick Astley - Don't Say Goodbye",
-			},
-			Track{
-				ID:   7,
-				Name: "Rick Astley - Slipping Away",
-			},
-			Track{
-				ID:   8,
-				Name: "Rick Astley - No More Looking for Love",
-			},
-			Track{
-				ID:   9,
-				Name: "Rick Astley - You Move Me",
-			},
-			Track{
-				ID:   10,
-				Name: "Rick Astley - When I Fall in Love",
-			},
+	// Users register with invitations, the first admin's is logged
+	if !db.HasAdmin() {
+		if err := s.inviteFirstAdmin(); err != nil {
+			log.Printf("error: failed to invite the first admin: %v", err)
 		}
 	}
 
 	// Init routes
-	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+	s.router = mux.NewRouter().StrictSlash(true)
+	for _, route := range s.routes() {
 		var handler http.Handler
 		handler = route.HandlerFunc
+		if route.Allow != AllowPublic {
+			handler = s.Authorize(handler, route.Name, route.Allow)
+			handler = s.Authenticate(handler, route.Name)
+		}
 		handler = Logger(handler, route.Name)
 
-		router.Methods(route.Method).Path(route.Pattern).Name(route.Name).Handler(handler)
+		s.router.Methods(route.Method).Path(route.Pattern).Name(route.Name).Handler(handler)
 	}
 
-	return router
+	return s, nil
 }
 
-func Health(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "OK")
+// ServeHTTP serves the API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
 }
 
-var routes = Routes{
-	Route{
-		"Health",
-		"GET",
-		"/SmartHouse/1.0.2/health",
-		Health,
-	},
+// Close stops the background work of the server and closes its storage. The
+// driver is left open.
+func (s *Server) Close() error {
+	close(s.quit)
+	s.wg.Wait()
+	s.house.StopMusic()
+	return s.db.Close()
+}
 
-	Route{
-		"Login",
-		"POST",
-		"/SmartHouse/1.0.2/login",
-		Login,
+// demoTracks are served when no music directory is configured
+var demoTracks = []Track{
+	Track{
+		ID:   1,
+		Name: "Rick Astley - Never Gonna Give You Up",
 	},
-
-	Route{
-		"Register",
-		"POST",
-		"/SmartHouse/1.0.2/register",
-		Register,
+	Track{
+		ID:   2,
+		Name: "Rick Astley - Whenever You Need Somebody",
 	},
-
-	Route{
-		"Luminosity",
-		"GET",
-		"/SmartHouse/1.0.2/luminosity",
-		Luminosity,
+	Track{
+		ID:   3,
+		Name: "Rick Astley - Together Forever",
 	},
-
-	Route{
-		"Temperature",
-		"GET",
-		"/SmartHouse/1.0.2/temperature",
-		Temperature,
+	Track{
+		ID:   4,
+		Name: "Rick Astley - It Would Take a Strong Strong Man",
 	},
-
-	Route{
-		"LightState",
-		"GET",
-		"/SmartHouse/1.0.2/lights/{lightID}",
-		LightState,
+	Track{
+		ID:   5,
+		Name: "Rick Astley - The Love Has Gone",
 	},
-
-	Route{
-		"Lights",
-		"GET",
-		"/SmartHouse/1.0.2/lights",
-		Lights,
-	},
-
-	Route{
-		"SetLightState",
-		"PUT",
-		"/SmartHouse/1.0.2/lights/{lightID}/{state}",
-		SetLightState,
+	Track{
+		ID:   6,
+		Name: "Rick Astley - Don't Say Goodbye",
 	},
-
-	Route{
-		"MusicAvailable",
-		"GET",
-		"/SmartHouse/1.0.2/music/available/",
-		MusicAvailable,
+	Track{
+		ID:   7,
+		Name: "Rick Astley - Slipping Away",
 	},
-
-	Route{
-		"MusicSummary",
-		"GET",
-		"/SmartHouse/1.0.2/music",
-		MusicSummary,
+	Track{
+		ID:   8,
+		Name: "Rick Astley - No More Looking for Love",
 	},
-
-	Route{
-		"PlayTrack",
-		"PUT",
-		"/SmartHouse/1.0.2/music/play",
-		PlayTrack,
+	Track{
+		ID:   9,
+		Name: "Rick Astley - You Move Me",
 	},
-
-	Route{
-		"SetMusicState",
-		"PUT",
-		"/SmartHouse/1.0.2/music/{state}",
-		SetMusicState,
+	Track{
+		ID:   10,
+		Name: "Rick Astley - When I Fall in Love",
 	},
+}
 
-	Route{
-		"HomeSettings",
-		"GET",
-		"/SmartHouse/1.0.2/settings/home/",
-		HomeSettings,
-	},
+func Health(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "OK")
+}
 
-	Route{
-		"SetHomeSettings",
-		"PUT",
-		"/SmartHouse/1.0.2/settings/home/",
-		SetHomeSettings,
-	},
+func (s *Server) routes() Routes {
+	return Routes{
+		Route{
+			"Health",
+			"GET",
+			"/SmartHouse/1.0.2/health",
+			Health,
+			AllowPublic,
+		},
+
+		Route{
+			"Login",
+			"POST",
+			"/SmartHouse/1.0.2/login",
+			s.authLimit.Limit(s.Login),
+			AllowPublic,
+		},
+
+		Route{
+			"Register",
+			"POST",
+			"/SmartHouse/1.0.2/register",
+			s.authLimit.Limit(s.Register),
+			AllowPublic,
+		},
+
+		Route{
+			"ResetPassword",
+			"POST",
+			"/SmartHouse/1.0.2/password-reset",
+			s.authLimit.Limit(s.ResetPassword),
+			AllowPublic,
+		},
+
+		Route{
+			"ChangePassword",
+			"PUT",
+			"/SmartHouse/1.0.2/password",
+			s.ChangePassword,
+			AllowGuest,
+		},
+
+		Route{
+			"Logout",
+			"POST",
+			"/SmartHouse/1.0.2/logout",
+			s.Logout,
+			AllowGuest,
+		},
+
+		Route{
+			"Sessions",
+			"GET",
+			"/SmartHouse/1.0.2/sessions",
+			s.Sessions,
+			AllowGuest,
+		},
+
+		Route{
+			"RevokeSession",
+			"DELETE",
+			"/SmartHouse/1.0.2/sessions/{sessionID}",
+			s.RevokeSession,
+			AllowGuest,
+		},
+
+		Route{
+			"APIKeys",
+			"GET",
+			"/SmartHouse/1.0.2/apikeys",
+			s.APIKeys,
+			AllowGuest,
+		},
+
+		Route{
+			"AddAPIKey",
+			"POST",
+			"/SmartHouse/1.0.2/apikeys",
+			s.AddAPIKey,
+			AllowGuest,
+		},
+
+		Route{
+			"RevokeAPIKey",
+			"DELETE",
+			"/SmartHouse/1.0.2/apikeys/{keyID}",
+			s.RevokeAPIKey,
+			AllowGuest,
+		},
+
+		Route{
+			"Users",
+			"GET",
+			"/SmartHouse/1.0.2/users",
+			s.Users,
+			AllowAdmin,
+		},
+
+		Route{
+			"SetUserRole",
+			"PUT",
+			"/SmartHouse/1.0.2/users/{username}/role",
+			s.SetUserRole,
+			AllowAdmin,
+		},
+
+		Route{
+			"AddPasswordReset",
+			"POST",
+			"/SmartHouse/1.0.2/users/{username}/password-reset",
+			s.AddPasswordReset,
+			AllowAdmin,
+		},
+
+		Route{
+			"Invitations",
+			"GET",
+			"/SmartHouse/1.0.2/invitations",
+			s.Invitations,
+			AllowAdmin,
+		},
+
+		Route{
+			"AddInvitation",
+			"POST",
+			"/SmartHouse/1.0.2/invitations",
+			s.AddInvitation,
+			AllowAdmin,
+		},
+
+		Route{
+			"RevokeInvitation",
+			"DELETE",
+			"/SmartHouse/1.0.2/invitations/{invitationID}",
+			s.RevokeInvitation,
+			AllowAdmin,
+		},
+
+		Route{
+			"Luminosity",
+			"GET",
+			"/SmartHouse/1.0.2/luminosity",
+			s.Luminosity,
+			AllowMember,
+		},
+
+		Route{
+			"Temperature",
+			"GET",
+			"/SmartHouse/1.0.2/temperature",
+			s.Temperature,
+			AllowMember,
+		},
+
+		Route{
+			"LuminosityHistory",
+			"GET",
+			"/SmartHouse/1.0.2/luminosity/history",
+			s.LuminosityHistory,
+			AllowMember,
+		},
+
+		Route{
+			"TemperatureHistory",
+			"GET",
+			"/SmartHouse/1.0.2/temperature/history",
+			s.TemperatureHistory,
+			AllowMember,
+		},
+
+		Route{
+			"LightState",
+			"GET",
+			"/SmartHouse/1.0.2/lights/{lightID}",
+			s.LightState,
+			AllowGuestLight,
+		},
+
+		Route{
+			"Lights",
+			"GET",
+			"/SmartHouse/1.0.2/lights",
+			s.Lights,
+			AllowGuest,
+		},
+
+		Route{
+			"AddLight",
+			"POST",
+			"/SmartHouse/1.0.2/lights",
+			s.AddLight,
+			AllowAdmin,
+		},
+
+		Route{
+			"UpdateLight",
+			"PATCH",
+			"/SmartHouse/1.0.2/lights/{lightID}",
+			s.UpdateLight,
+			AllowAdmin,
+		},
+
+		Route{
+			"DeleteLight",
+			"DELETE",
+			"/SmartHouse/1.0.2/lights/{lightID}",
+			s.DeleteLight,
+			AllowAdmin,
+		},
+
+		Route{
+			"SetLightLevel",
+			"PUT",
+			"/SmartHouse/1.0.2/lights/{lightID}",
+			s.SetLightLevel,
+			AllowGuestLight,
+		},
+
+		Route{
+			"SetLightState",
+			"PUT",
+			"/SmartHouse/1.0.2/lights/{lightID}/{state}",
+			s.SetLightState,
+			AllowGuestLight,
+		},
+
+		Route{
+			"MusicAvailable",
+			"GET",
+			"/SmartHouse/1.0.2/music/available/",
+			s.MusicAvailable,
+			AllowGuest,
+		},
+
+		Route{
+			"RescanMusic",
+			"POST",
+			"/SmartHouse/1.0.2/music/rescan",
+			s.RescanMusic,
+			AllowAdmin,
+		},
+
+		Route{
+			"UploadTrack",
+			"POST",
+			"/SmartHouse/1.0.2/music/tracks",
+			s.UploadTrack,
+			AllowMember,
+		},
+
+		Route{
+			"DeleteTrack",
+			"DELETE",
+			"/SmartHouse/1.0.2/music/tracks/{trackID}",
+			s.DeleteTrack,
+			AllowAdmin,
+		},
+
+		Route{
+			"MusicSummary",
+			"GET",
+			"/SmartHouse/1.0.2/music",
+			s.MusicSummary,
+			AllowGuest,
+		},
+
+		Route{
+			"PlayTrack",
+			"PUT",
+			"/SmartHouse/1.0.2/music/play",
+			s.PlayTrack,
+			AllowGuest,
+		},
+
+		Route{
+			"SeekMusic",
+			"PUT",
+			"/SmartHouse/1.0.2/music/seek",
+			s.SeekMusic,
+			AllowGuest,
+		},
+
+		Route{
+			"SetMusicVolume",
+			"PUT",
+			"/SmartHouse/1.0.2/music/volume",
+			s.SetMusicVolume,
+			AllowGuest,
+		},
+
+		Route{
+			"MusicQueue",
+			"GET",
+			"/SmartHouse/1.0.2/music/queue",
+			s.MusicQueue,
+			AllowGuest,
+		},
+
+		Route{
+			"PlayMusicQueue",
+			"PUT",
+			"/SmartHouse/1.0.2/music/queue",
+			s.PlayMusicQueue,
+			AllowGuest,
+		},
+
+		Route{
+			"AddToMusicQueue",
+			"POST",
+			"/SmartHouse/1.0.2/music/queue",
+			s.AddToMusicQueue,
+			AllowGuest,
+		},
+
+		Route{
+			"SetMusicQueueMode",
+			"PATCH",
+			"/SmartHouse/1.0.2/music/queue",
+			s.SetMusicQueueMode,
+			AllowGuest,
+		},
+
+		Route{
+			"ClearMusicQueue",
+			"DELETE",
+			"/SmartHouse/1.0.2/music/queue",
+			s.ClearMusicQueue,
+			AllowGuest,
+		},
+
+		Route{
+			"SetMusicState",
+			"PUT",
+			"/SmartHouse/1.0.2/music/{state}",
+			s.SetMusicState,
+			AllowGuest,
+		},
+
+		Route{
+			"Playlists",
+			"GET",
+			"/SmartHouse/1.0.2/playlists",
+			s.Playlists,
+			AllowGuest,
+		},
+
+		Route{
+			"AddPlaylist",
+			"POST",
+			"/SmartHouse/1.0.2/playlists",
+			s.AddPlaylist,
+			AllowMember,
+		},
+
+		Route{
+			"DeletePlaylist",
+			"DELETE",
+			"/SmartHouse/1.0.2/playlists/{playlistID}",
+			s.DeletePlaylist,
+			AllowMember,
+		},
+
+		Route{
+			"PlayPlaylist",
+			"PUT",
+			"/SmartHouse/1.0.2/playlists/{playlistID}/play",
+			s.PlayPlaylist,
+			AllowGuest,
+		},
+
+		Route{
+			"HomeSettings",
+			"GET",
+			"/SmartHouse/1.0.2/settings/home/",
+			s.HomeSettings,
+			AllowMember,
+		},
+
+		Route{
+			"SetHomeSettings",
+			"PUT",
+			"/SmartHouse/1.0.2/settings/home/",
+			s.SetHomeSettings,
+			AllowMember,
+		},
+
+		Route{
+			"Schedules",
+			"GET",
+			"/SmartHouse/1.0.2/schedules",
+			s.Schedules,
+			AllowMember,
+		},
+
+		Route{
+			"AddSchedule",
+			"POST",
+			"/SmartHouse/1.0.2/schedules",
+			s.AddSchedule,
+			AllowMember,
+		},
+
+		Route{
+			"DeleteSchedule",
+			"DELETE",
+			"/SmartHouse/1.0.2/schedules/{scheduleID}",
+			s.DeleteSchedule,
+			AllowMember,
+		},
+
+		Route{
+			"Scenes",
+			"GET",
+			"/SmartHouse/1.0.2/scenes",
+			s.Scenes,
+			AllowMember,
+		},
+
+		Route{
+			"AddScene",
+			"POST",
+			"/SmartHouse/1.0.2/scenes",
+			s.AddScene,
+			AllowMember,
+		},
+
+		Route{
+			"DeleteScene",
+			"DELETE",
+			"/SmartHouse/1.0.2/scenes/{sceneID}",
+			s.DeleteScene,
+			AllowMember,
+		},
+
+		Route{
+			"PreviewScene",
+			"GET",
+			"/SmartHouse/1.0.2/scenes/{sceneID}/preview",
+			s.PreviewScene,
+			AllowMember,
+		},
+
+		Route{
+			"ActivateScene",
+			"PUT",
+			"/SmartHouse/1.0.2/scenes/{sceneID}/activate",
+			s.ActivateScene,
+			AllowMember,
+		},
+
+		Route{
+			"Rules",
+			"GET",
+			"/SmartHouse/1.0.2/rules",
+			s.Rules,
+			AllowMember,
+		},
+
+		Route{
+			"AddRule",
+			"POST",
+			"/SmartHouse/1.0.2/rules",
+			s.AddRule,
+			AllowMember,
+		},
+
+		Route{
+			"DryRunRules",
+			"POST",
+			"/SmartHouse/1.0.2/rules/dry-run",
+			s.DryRunRules,
+			AllowMember,
+		},
+
+		Route{
+			"DeleteRule",
+			"DELETE",
+			"/SmartHouse/1.0.2/rules/{ruleID}",
+			s.DeleteRule,
+			AllowMember,
+		},
+
+		Route{
+			"Events",
+			"GET",
+			"/SmartHouse/1.0.2/events",
+			s.Events,
+			// Authenticated by the handler, which also accepts a token
+			// query parameter
+			AllowPublic,
+		},
+	}
 }
 
-func UpdateReceiver() {
+// updateReceiver applies the updates reported by the Arduino until the server
+// or its driver is closed
+func (s *Server) updateReceiver() {
 	for {
-		s, err := serial.OpenPort(serialConf)
-		if err != nil {
-			log.Fatalf("failed to open serial port: %v", err)
+		select {
+		case line, ok := <-s.arduino.Lines():
+			if !ok {
+				return
+			}
+			s.handleUpdate(line)
+		case <-s.quit:
+			return
 		}
+	}
+}
 
-		// Try to read
-		dec := json.NewDecoder(s)
-		for dec.More() {
-			var l Light
-			if err := dec.Decode(&l); err != nil {
-				log.Printf("error: failed to unmarshal: %v", err)
-				time.Sleep(1 * time.Millisecond)
-				continue
-			}
+func (s *Server) handleUpdate(line []byte) {
+	var msg struct {
+		Light
+		SensorReading
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		log.Printf("error: failed to unmarshal '%s': %v", line, err)
+		return
+	}
+
+	if msg.Sensor != "" {
+		s.updateSensor(msg.SensorReading)
+		return
+	}
+
+	// The Arduino identifies lights by channel
+	l, ok := s.house.LightOnChannel(msg.ID)
+	if !ok {
+		log.Printf("error: no light on channel %d", msg.ID)
+		return
+	}
 
-			lights[l.ID-1].TurnOn = l.TurnOn
-			log.Printf("Light #%d set to: %t", l.ID, l.TurnOn)
+	// Controllers without dimming only report turnon
+	l, err := s.house.UpdateLight(l.ID, func(l *Light) {
+		switch {
+		case !msg.TurnOn:
+			l.setBrightness(0)
+		case msg.Brightness > 0:
+			l.setBrightness(msg.Brightness)
+		case l.Brightness == 0:
+			l.setBrightness(maxBrightness)
 		}
-		s.Close()
+	}, s.db.PutLight)
+	if err != nil {
+		log.Printf("error: failed to update light on channel %d: %v", msg.ID, err)
+		return
 	}
+	log.Printf("Light #%d set to: %t, brightness %d", l.ID, l.TurnOn, l.Brightness)
+}
+
+func (s *Server) updateSensor(r SensorReading) {
+	sensor := s.house.Sensor(r.Sensor)
+	if sensor == nil {
+		log.Printf("error: unknown sensor '%s'", r.Sensor)
+		return
+	}
+
+	now := s.clock.Now()
+	sensor.set(r.Value, now)
+	s.events.publish(SensorEvent, sensorEvent{Sensor: r.Sensor, SensorData: sensor.data(now)})
+
+	if err := s.db.PutReading(r.Sensor, now, r.Value); err != nil {
+		log.Printf("error: failed to store %s reading: %v", r.Sensor, err)
+	}
+
+	s.applyRules(r)
+}
+
+// syncController resends the light states every time the Arduino connects,
+// as it starts with all lights off. The first check runs before returning,
+// later ones poll until the server is closed.
+func (s *Server) syncController() {
+	last := Disconnected
+	check := func() {
+		state := s.arduino.State()
+		if state == Connected && last != Connected {
+			for _, l := range s.house.Lights() {
+				if err := s.arduino.Send(lightCommand(l, 0)); err != nil {
+					log.Printf("error: failed to restore light #%d: %v", l.ID, err)
+					break
+				}
+			}
+		}
+		last = state
+	}
+
+	check()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		t := time.NewTicker(syncInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				check()
+			case <-s.quit:
+				return
+			}
+		}
+	}()
 }
@@ -9,7 +9,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	server "github.com/freddygv/SmartHouse-Server/go"
 )
@@ -33,10 +36,11 @@ func TestNewDB(t *testing.T) {
 	testdb, teardown := setup(t)
 	defer teardown()
 
-	err := server.NewAuthDB(testdb)
+	db, err := server.NewAuthDB(testdb)
 	if err != nil {
 		t.Fatalf("failed to create db: %v", err)
 	}
+	defer db.Close()
 
 	if _, err := os.Stat(testdb); os.IsNotExist(err) {
 		t.Fatalf("failed to create db: %v", err)
@@ -47,18 +51,23 @@ func TestAuth(t *testing.T) {
 	testdb, teardown := setup(t)
 	defer teardown()
 
-	err := server.NewAuthDB(testdb)
+	s, err := server.NewServer(testConfig(testdb), server.NewSimulator())
 	if err != nil {
-		t.Fatalf("failed to create db: %v", err)
+		t.Fatalf("failed to create server: %v", err)
 	}
+	defer s.Close()
 
-	srv := httptest.NewServer(server.NewServer("foo", 1))
+	srv := httptest.NewServer(s)
 	defer srv.Close()
 
+	code, err := s.Invite(server.RoleMember, "")
+	if err != nil {
+		t.Fatalf("failed to invite: %v", err)
+	}
 	input := server.RegInput{
-		Username: "Bob",
-		Password: "password",
-		Secret:   server.Secret,
+		Username:   "Bob",
+		Password:   "password",
+		Invitation: code,
 	}
 
 	buf, err := json.Marshal(input)
@@ -93,14 +102,14 @@ func TestAuth(t *testing.T) {
 			desc:      "wrong pw",
 			loginName: input.Username,
 			loginPW:   "notpassword",
-			err:       "Login failed: incorrect password",
+			err:       "Login failed: invalid username or password",
 			code:      http.StatusBadRequest,
 		},
 		{
 			desc:      "user does not exist",
 			loginName: "Alice",
 			loginPW:   "password",
-			err:       "Login failed: unregistered user: Alice",
+			err:       "Login failed: invalid username or password",
 			code:      http.StatusBadRequest,
 		},
 	}
@@ -153,3 +162,517 @@ func TestAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthenticate(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	now := time.Now().Unix()
+	if err := c.srv.PutSession("valid", "admin", now); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	if err := c.srv.PutSession("expired", "admin", now-server.ExpirationSeconds-1); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	if err := c.srv.PutSession("removed", "nobody", now); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(c.srv.Authenticate(inner, "test"))
+	defer srv.Close()
+
+	tt := []struct {
+		desc   string
+		header string
+		code   int
+	}{
+		{
+			desc:   "valid token",
+			header: "Bearer valid",
+			code:   http.StatusOK,
+		},
+		{
+			desc: "missing token",
+			code: http.StatusUnauthorized,
+		},
+		{
+			desc:   "unknown token",
+			header: "Bearer unknown",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			desc:   "expired token",
+			header: "Bearer expired",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			desc:   "unknown user",
+			header: "Bearer removed",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			desc:   "wrong scheme",
+			header: "Basic valid",
+			code:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to get: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.code {
+				t.Errorf("expected status: %d, got: %d", tc.code, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// testConfig returns a configuration for a simulated house storing its data
+// in testdb
+func testConfig(testdb string) server.Config {
+	cfg := server.DefaultConfig()
+	cfg.Driver = "simulator"
+	cfg.Storage = testdb
+	cfg.Music = ""
+	return cfg
+}
+
+// newTestServer starts a server backed by a simulator and returns a client
+// that authenticates its requests
+func newTestServer(t *testing.T) (*server.Simulator, *testClient, func()) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	sim, c, stop := startTestServer(t, filepath.Join(dir, "test.db"))
+	teardown := func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+	return sim, c, teardown
+}
+
+// startTestServer starts a server backed by a simulator on an existing db
+func startTestServer(t *testing.T, testdb string) (*server.Simulator, *testClient, func()) {
+	return startClockedTestServer(t, testdb, nil)
+}
+
+// startClockedTestServer starts a server whose schedules run on clock, or on
+// the system clock if it is nil
+func startClockedTestServer(t *testing.T, testdb string, clock server.Clock) (*server.Simulator, *testClient, func()) {
+	return startConfiguredTestServer(t, testConfig(testdb), clock)
+}
+
+// startConfiguredTestServer starts a server for cfg backed by a simulator
+func startConfiguredTestServer(t *testing.T, cfg server.Config, clock server.Clock) (*server.Simulator, *testClient, func()) {
+	sim := server.NewSimulator()
+	var s *server.Server
+	var err error
+	if clock != nil {
+		s, err = server.NewServerWithClock(cfg, sim, clock)
+	} else {
+		s, err = server.NewServer(cfg, sim)
+	}
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	srv := httptest.NewServer(s)
+
+	// Servers restarted on a db already have their admin
+	if err := s.PutUser("admin", server.RoleAdmin); err != nil && err != server.ErrUserExists {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	if err := s.PutSession(t.Name(), "admin", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+
+	stop := func() {
+		srv.Close()
+		s.Close()
+		sim.Close()
+	}
+	return sim, &testClient{t: t, srv: s, url: srv.URL + "/SmartHouse/1.0.2", token: t.Name()}, stop
+}
+
+type testClient struct {
+	t     *testing.T
+	srv   *server.Server
+	url   string
+	token string
+	// apiKey is sent instead of the session token if set
+	apiKey string
+}
+
+// do sends an authenticated request and decodes the response into out
+func (c *testClient) do(method, path, body string, out interface{}) int {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("failed to create request: %v", err)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("failed to %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("failed to decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestDriverCommands(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	if code := c.do("PUT", "/lights/2/on", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("PUT", "/settings/home/", `{"automatic": true, "threshold": 2.5}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	// Light states are restored on connect before any request
+	expected := []string{
+		"led1_OFF", "led2_OFF", "led3_OFF", "led4_OFF", "led5_OFF",
+		"led2_ON", "house_auto_ON", "house_threshold_2.500000",
+	}
+	if got := sim.Commands(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected commands: %v, got: %v", expected, got)
+	}
+
+	sim.SetState(server.Disconnected)
+	if code := c.do("PUT", "/lights/2/off", "", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status: %d, got: %d", http.StatusServiceUnavailable, code)
+	}
+	sim.SetState(server.Connected)
+
+	// Updates emitted by the controller are reflected in the light state
+	if err := sim.Emit(server.Light{ID: 3, TurnOn: true}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+
+	eventually(t, func() bool {
+		var l server.Light
+		c.do("GET", "/lights/3", "", &l)
+		return l.TurnOn
+	})
+}
+
+func TestLightLevel(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	tt := []struct {
+		desc    string
+		path    string
+		body    string
+		code    int
+		command string
+		light   server.Light
+	}{
+		{"dim", "/lights/2", `{"brightness": 40, "transition": "500ms"}`, http.StatusOK, "led2_DIM_40_500",
+			server.Light{TurnOn: true, Brightness: 40}},
+		{"full", "/lights/2", `{"brightness": 100}`, http.StatusOK, "led2_ON",
+			server.Light{TurnOn: true, Brightness: 100}},
+		{"fade out", "/lights/2", `{"brightness": 0, "transition": "2s"}`, http.StatusOK, "led2_DIM_0_2000",
+			server.Light{TurnOn: false, Brightness: 0}},
+		{"on", "/lights/2/on", "", http.StatusOK, "led2_ON",
+			server.Light{TurnOn: true, Brightness: 100}},
+		{"off", "/lights/2/off", "", http.StatusOK, "led2_OFF",
+			server.Light{TurnOn: false, Brightness: 0}},
+		{"missing brightness", "/lights/2", `{"transition": "1s"}`, http.StatusBadRequest, "", server.Light{}},
+		{"too bright", "/lights/2", `{"brightness": 101}`, http.StatusBadRequest, "", server.Light{}},
+		{"too slow", "/lights/2", `{"brightness": 50, "transition": "2m"}`, http.StatusBadRequest, "", server.Light{}},
+		{"unknown light", "/lights/42", `{"brightness": 50}`, http.StatusNotFound, "", server.Light{}},
+	}
+	for _, tc := range tt {
+		before := len(sim.Commands())
+		if code := c.do("PUT", tc.path, tc.body, nil); code != tc.code {
+			t.Fatalf("%s: expected status: %d, got: %d", tc.desc, tc.code, code)
+		}
+		if tc.command == "" {
+			continue
+		}
+
+		cmds := sim.Commands()
+		if len(cmds) != before+1 || cmds[before] != tc.command {
+			t.Fatalf("%s: expected command: %s, got: %v", tc.desc, tc.command, cmds[before:])
+		}
+		if l := c.light(2); l.TurnOn != tc.light.TurnOn || l.Brightness != tc.light.Brightness {
+			t.Fatalf("%s: expected light: %+v, got: %+v", tc.desc, tc.light, l)
+		}
+	}
+
+	// Brightness echoes from the controller are decoded, controllers
+	// without dimming leave it alone
+	if err := sim.Emit(server.Light{ID: 3, TurnOn: true, Brightness: 25}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	eventually(t, func() bool { return c.light(3).Brightness == 25 })
+
+	if err := sim.Emit(map[string]interface{}{"id": 3, "turnon": true}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	if err := sim.Emit(server.Light{ID: 4, TurnOn: true}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	eventually(t, func() bool { return c.light(4).Brightness == 100 })
+	if l := c.light(3); l.Brightness != 25 {
+		t.Fatalf("expected brightness of light #3 kept, got: %+v", l)
+	}
+}
+
+func TestLightInventory(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	testdb := filepath.Join(dir, "test.db")
+
+	_, c, stop := startTestServer(t, testdb)
+
+	var added server.Light
+	if code := c.do("POST", "/lights", `{"description": "garage", "channel": 8}`, &added); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	if added.ID != 6 || added.Channel != 8 {
+		t.Fatalf("unexpected light: %+v", added)
+	}
+
+	tt := []struct {
+		desc   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"duplicate channel", "POST", "/lights", `{"description": "hall", "channel": 8}`, http.StatusBadRequest},
+		{"missing description", "POST", "/lights", `{"channel": 9}`, http.StatusBadRequest},
+		{"invalid channel", "POST", "/lights", `{"description": "hall", "channel": 0}`, http.StatusBadRequest},
+		{"rename", "PATCH", "/lights/1", `{"description": "nursery"}`, http.StatusOK},
+		{"remap to used channel", "PATCH", "/lights/1", `{"channel": 8}`, http.StatusBadRequest},
+		{"switch on", "PUT", "/lights/6/on", "", http.StatusOK},
+		{"schedule", "POST", "/schedules", `{"cron": "0 7 * * *", "action": {"type": "light", "light": 3, "state": "on"}}`, http.StatusCreated},
+		{"delete scheduled", "DELETE", "/lights/3", "", http.StatusConflict},
+		{"delete", "DELETE", "/lights/2", "", http.StatusOK},
+		{"delete unknown", "DELETE", "/lights/2", "", http.StatusNotFound},
+		{"get unknown", "GET", "/lights/2", "", http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		if code := c.do(tc.method, tc.path, tc.body, nil); code != tc.code {
+			t.Errorf("%s: expected status: %d, got: %d", tc.desc, tc.code, code)
+		}
+	}
+	stop()
+
+	// The inventory and light states survive a restart and are resent
+	sim, c, stop := startTestServer(t, testdb)
+	defer stop()
+
+	var lights []server.Light
+	if code := c.do("GET", "/lights", "", &lights); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+
+	expected := []server.Light{
+		{ID: 1, Description: "nursery", Channel: 1},
+		{ID: 3, Description: "living room", Channel: 3},
+		{ID: 4, Description: "kitchen", Channel: 4},
+		{ID: 5, Description: "bathroom", Channel: 5},
+		{ID: 6, Description: "garage", Channel: 8, TurnOn: true, Brightness: 100},
+	}
+	if !reflect.DeepEqual(lights, expected) {
+		t.Fatalf("expected lights: %+v, got: %+v", expected, lights)
+	}
+
+	commands := []string{"led1_OFF", "led3_OFF", "led4_OFF", "led5_OFF", "led8_ON"}
+	if got := sim.Commands(); !reflect.DeepEqual(got, commands) {
+		t.Fatalf("expected commands: %v, got: %v", commands, got)
+	}
+
+	// Ids of deleted lights aren't reused
+	if code := c.do("DELETE", "/lights/6", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := c.do("POST", "/lights", `{"description": "shed", "channel": 9}`, &added); code != http.StatusCreated {
+		t.Fatalf("expected status: %d, got: %d", http.StatusCreated, code)
+	}
+	if added.ID != 7 {
+		t.Fatalf("expected light #7, got: %+v", added)
+	}
+}
+
+func TestSensorReadings(t *testing.T) {
+	sim, c, teardown := newTestServer(t)
+	defer teardown()
+
+	var sd server.SensorData
+	if code := c.do("GET", "/temperature", "", &sd); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if !sd.Stale || sd.Updated != nil {
+		t.Fatalf("expected stale reading without timestamp, got: %+v", sd)
+	}
+
+	if err := sim.Emit(server.SensorReading{Sensor: "temperature", Value: 21.5}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	if err := sim.Emit(server.SensorReading{Sensor: "luminosity", Value: 640}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+
+	eventually(t, func() bool {
+		var temp, lum server.SensorData
+		c.do("GET", "/temperature", "", &temp)
+		c.do("GET", "/luminosity", "", &lum)
+		return temp.Value == 21.5 && !temp.Stale && temp.Updated != nil &&
+			lum.Value == 640 && lum.Unit == "Lux" && !lum.Stale
+	})
+}
+
+func TestSensorHistory(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2018, 5, 28, 15, 0, 0, 0, time.UTC)}
+	_, c, stop := startClockedTestServer(t, filepath.Join(dir, "test.db"), clock)
+	defer stop()
+
+	from := time.Date(2018, 5, 28, 12, 0, 0, 0, time.UTC)
+	for _, r := range []struct {
+		offset time.Duration
+		value  float32
+	}{
+		{0, 1},
+		{10 * time.Minute, 3},
+		{70 * time.Minute, 5},
+		{3 * time.Hour, 7},
+	} {
+		if err := c.srv.PutReading("temperature", from.Add(r.offset), r.value); err != nil {
+			t.Fatalf("failed to put reading: %v", err)
+		}
+	}
+
+	query := "/temperature/history?from=2018-05-28T12:00:00Z&to=2018-05-28T14:00:00Z"
+
+	var raw []server.SensorData
+	if code := c.do("GET", query, "", &raw); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(raw) != 3 {
+		t.Fatalf("expected 3 readings, got: %d", len(raw))
+	}
+
+	var hourly []server.SensorData
+	if code := c.do("GET", query+"&resolution=1h", "", &hourly); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(hourly) != 2 {
+		t.Fatalf("expected 2 buckets, got: %d", len(hourly))
+	}
+
+	first := hourly[0]
+	if first.Value != 2 || *first.Min != 1 || *first.Max != 3 || first.Count != 2 || !first.Updated.Equal(from) {
+		t.Fatalf("unexpected first bucket: %+v", first)
+	}
+	if second := hourly[1]; second.Value != 5 || second.Count != 1 || !second.Updated.Equal(from.Add(time.Hour)) {
+		t.Fatalf("unexpected second bucket: %+v", second)
+	}
+
+	for _, q := range []string{
+		query + "&resolution=1ms",
+		query + "&resolution=-1h",
+		"/temperature/history?from=2018-05-28T14:00:00Z&to=2018-05-28T12:00:00Z",
+		"/temperature/history?from=yesterday",
+	} {
+		if code := c.do("GET", q, "", nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status: %d, got: %d", q, http.StatusBadRequest, code)
+		}
+	}
+
+	// Too many readings are downsampled even without a resolution
+	early := time.Date(2018, 5, 28, 10, 0, 0, 0, time.UTC)
+	for i := 0; i <= 2000; i++ {
+		if err := c.srv.PutReading("luminosity", early.Add(time.Duration(i)*time.Second), 640); err != nil {
+			t.Fatalf("failed to put reading: %v", err)
+		}
+	}
+	var capped []server.SensorData
+	if code := c.do("GET", "/luminosity/history?from=2018-05-28T10:00:00Z&to=2018-05-28T11:00:00Z", "", &capped); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(capped) == 0 || len(capped) > 2000 || capped[0].Count == 0 {
+		t.Fatalf("expected at most 2000 buckets, got: %d", len(capped))
+	}
+
+	// Readings from the Arduino are stored at the server's time, which ends
+	// the range by default
+	clock.Advance(time.Hour)
+	c.srv.UpdateSensor(server.SensorReading{Sensor: "temperature", Value: 30})
+	clock.Advance(time.Minute)
+	var recent []server.SensorData
+	if code := c.do("GET", "/temperature/history?from=2018-05-28T15:30:00Z", "", &recent); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(recent) != 1 || recent[0].Value != 30 || !recent[0].Updated.Equal(from.Add(4*time.Hour)) {
+		t.Fatalf("expected the reading at 16:00, got: %+v", recent)
+	}
+
+	// Old readings are deleted
+	clock.Advance(90 * 24 * time.Hour)
+	c.srv.SweepReadings()
+	if code := c.do("GET", query, "", &raw); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(raw) != 0 {
+		t.Fatalf("expected no readings, got: %d", len(raw))
+	}
+}
+
+// eventually fails the test if cond doesn't hold within a second
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
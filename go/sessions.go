@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+const (
+	// lastUsedPrecision is how often the last use of a session is recorded,
+	// in seconds, sparing a write per request
+	lastUsedPrecision = 60
+	// sweepInterval is how often expired sessions, invitations and password
+	// resets, and old attempts are deleted
+	sweepInterval = time.Hour
+	// maxDeviceLength bounds the device recorded from the User-Agent header
+	maxDeviceLength = 200
+)
+
+var errUnknownSession = errors.New("unknown session")
+
+// session is what the sessions bucket stores for a token
+type session struct {
+	Username string
+	// Device is the User-Agent header the session logged in with
+	Device string
+	// Created and LastUsed are Unix times
+	Created  int64
+	LastUsed int64
+
+	// token and user are set once the session is checked
+	token string
+	user  User
+	// scopes limit the requests of API keys, they are nil for sessions
+	scopes []string
+}
+
+// expired tells whether the session expired at now, a Unix time
+func (s session) expired(now int64) bool {
+	return now-s.Created > expirationSeconds
+}
+
+// id identifies a session to its user without revealing its token
+func (s session) id() string {
+	return tokenID(s.token)
+}
+
+// tokenID identifies a secret token without revealing it
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sessionBackend stores and checks the sessions users log in with
+type sessionBackend interface {
+	// create returns the token of a new session, of its user
+	create(sess session) (string, error)
+	// check returns the unexpired session of a token with its user, and
+	// records that it was used at now, a Unix time
+	check(token string, now int64) (session, error)
+	// list returns the sessions of a user the backend keeps, by token
+	list(user string) (map[string]session, error)
+	// revoke ends the session of a token
+	revoke(token string) error
+	// revokeUser ends the sessions of a user but the one of the token keep
+	revokeUser(user, keep string) error
+	// userChanged applies a change of the role of a user to its sessions
+	userChanged(user string) error
+	// sweep forgets the sessions expired at now, a Unix time, and returns
+	// how many
+	sweep(now int64) (int, error)
+}
+
+// newSessionBackend returns the session backend cfg selects
+func newSessionBackend(cfg Config, db *AuthStore) (sessionBackend, error) {
+	switch cfg.Sessions {
+	case "bolt":
+		return boltSessions{db}, nil
+	case "signed":
+		return newSignedSessions(cfg.SessionKeys, db)
+	default:
+		return nil, fmt.Errorf("unknown session backend: %s", cfg.Sessions)
+	}
+}
+
+// boltSessions keeps sessions in the sessions bucket, keyed by random tokens
+type boltSessions struct {
+	db *AuthStore
+}
+
+func (b boltSessions) create(sess session) (string, error) {
+	for i := 0; i < maxRetries; i++ {
+		token, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate uuid: %v", err)
+		}
+
+		// Generate a new token if the current one exists
+		if _, err := b.db.Session(token); err != errUnknownSession {
+			continue
+		}
+
+		if err := b.db.PutSession(token, sess); err != nil {
+			return "", fmt.Errorf("failed to put session: %v", err)
+		}
+		return token, nil
+	}
+	return "", errors.New("no unused token found")
+}
+
+func (b boltSessions) check(token string, now int64) (session, error) {
+	sess, err := b.db.Session(token)
+	if err != nil {
+		return session{}, errors.New("invalid session token")
+	}
+	if sess.expired(now) {
+		return session{}, errors.New("session expired")
+	}
+
+	// Sessions from before roles have no user and must log in again
+	creds, err := b.db.Credentials(sess.Username)
+	if err == ErrUnknownUser {
+		return session{}, errors.New("unknown user")
+	}
+	if err != nil {
+		return session{}, err
+	}
+	sess.token = token
+	sess.user = newUser(sess.Username, creds)
+
+	if now-sess.LastUsed >= lastUsedPrecision {
+		sess.LastUsed = now
+		if err := b.db.TouchSession(token, now); err != nil {
+			log.Printf("failed to record use of session %s: %v", sess.id(), err)
+		}
+	}
+	return sess, nil
+}
+
+func (b boltSessions) list(user string) (map[string]session, error) {
+	return b.db.UserSessions(user)
+}
+
+func (b boltSessions) revoke(token string) error {
+	return b.db.DeleteSession(token)
+}
+
+func (b boltSessions) revokeUser(user, keep string) error {
+	_, err := b.db.DeleteUserSessions(user, keep)
+	return err
+}
+
+// userChanged does nothing, checks read the user from the database
+func (b boltSessions) userChanged(user string) error {
+	return nil
+}
+
+// sweep also deletes the sessions from before they had a user
+func (b boltSessions) sweep(now int64) (int, error) {
+	return b.db.DeleteExpiredSessions(now - expirationSeconds)
+}
+
+// Session is an active login of the user
+type Session struct {
+	ID       string    `json:"id"`
+	Device   string    `json:"device"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	// Current is set on the session the request was sent with
+	Current bool `json:"current"`
+}
+
+// device returns the device a request comes from
+func device(r *http.Request) string {
+	d := strings.TrimSpace(r.UserAgent())
+	if len(d) > maxDeviceLength {
+		d = d[:maxDeviceLength]
+	}
+	return d
+}
+
+type contextKey int
+
+const sessionKey contextKey = 0
+
+func withSession(r *http.Request, sess session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey, sess))
+}
+
+// requestSession returns the session an authenticated request was sent with
+func requestSession(r *http.Request) (session, bool) {
+	sess, ok := r.Context().Value(sessionKey).(session)
+	return sess, ok
+}
+
+// requestUser returns the user that sent an authenticated request
+func requestUser(r *http.Request) (User, bool) {
+	sess, ok := requestSession(r)
+	return sess.user, ok
+}
+
+// Logout ends the session the request was sent with
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	sess, _ := requestSession(r)
+	if err := s.sessionStore.revoke(sess.token); err != nil {
+		msg := fmt.Sprintf("failed to delete session: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Logout failed: %s"}`, msg)))
+		return
+	}
+	// End the event streams of the session
+	s.events.recheck()
+
+	buf, err := json.Marshal(StatusResponse{Message: "OK"})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Sessions lists the active sessions of the user, last used first. Backends
+// that don't keep sessions only list the current one.
+func (s *Server) Sessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	current, _ := requestSession(r)
+	stored, err := s.sessionStore.list(current.Username)
+	if err != nil {
+		msg := fmt.Sprintf("failed to read sessions: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Sessions failed: %s"}`, msg)))
+		return
+	}
+
+	if _, ok := stored[current.token]; !ok && current.token != "" {
+		stored[current.token] = current
+	}
+
+	now := time.Now().Unix()
+	sessions := []Session{}
+	for token, sess := range stored {
+		if sess.expired(now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:       tokenID(token),
+			Device:   sess.Device,
+			Created:  time.Unix(sess.Created, 0).UTC(),
+			LastUsed: time.Unix(sess.LastUsed, 0).UTC(),
+			Current:  token == current.token,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsed.Equal(sessions[j].LastUsed) {
+			return sessions[i].LastUsed.After(sessions[j].LastUsed)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	buf, err := json.Marshal(sessions)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal json: %v", err)
+		log.Println(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Sessions failed: %s"}`, msg)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// RevokeSession ends one of the sessions of the user
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	id := mux.Vars(r)["sessionID"]
+	current, _ := requestSession(r)
+
+	err := s.revokeSession(current, id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == errUnknownSession {
+			code = http.StatusNotFound
+		}
+		log.Println(err)
+		w.WriteHeader(code)
+		w.Write([]byte(fmt.Sprintf(`{"message": "Revoke session failed: %s"}`, err)))
+		return
+	}
+	s.events.recheck()
+
+	buf, err := json.Marshal(&StatusResponse{Message: fmt.Sprintf("OK, revoked session %s", id)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// revokeSession ends the session of the user of current with the given id
+func (s *Server) revokeSession(current session, id string) error {
+	if current.token != "" && current.id() == id {
+		return s.sessionStore.revoke(current.token)
+	}
+
+	stored, err := s.sessionStore.list(current.Username)
+	if err != nil {
+		return fmt.Errorf("failed to read sessions: %v", err)
+	}
+	for token := range stored {
+		if tokenID(token) == id {
+			return s.sessionStore.revoke(token)
+		}
+	}
+	return errUnknownSession
+}
+
+// runSweeper deletes expired sessions, invitations and password resets, and
+// old attempts and readings until the server is closed
+func (s *Server) runSweeper() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sweepSessions()
+		s.sweepInvitations()
+		s.sweepPasswordResets()
+		s.sweepAttempts()
+		s.sweepReadings()
+
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// sweepSessions deletes expired sessions
+func (s *Server) sweepSessions() {
+	n, err := s.sessionStore.sweep(time.Now().Unix())
+	if err != nil {
+		log.Printf("error: failed to delete expired sessions: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("deleted %d expired sessions", n)
+	}
+}
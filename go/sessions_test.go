@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestSessions(t *testing.T) {
+	_, c, teardown := newTestServer(t)
+	defer teardown()
+
+	if err := c.srv.PutUser("alice", server.RoleMember); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+
+	// login returns a client of a new session of alice on device
+	login := func(device string) *testClient {
+		req, err := http.NewRequest("POST", c.url+"/login", strings.NewReader(`{"username": "alice", "password": "password"}`))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("User-Agent", device)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to login: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var token server.StatusResponse
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to login: %d %v", resp.StatusCode, err)
+		}
+		return &testClient{t: t, srv: c.srv, url: c.url, token: token.Message}
+	}
+	sessions := func(c *testClient) []server.Session {
+		var sessions []server.Session
+		if code := c.do("GET", "/sessions", "", &sessions); code != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+		}
+		return sessions
+	}
+
+	phone := login("phone")
+	laptop := login("laptop")
+
+	// A session used for the first time in a while records it
+	now := time.Now()
+	if err := c.srv.PutSession("tablet", "alice", now.Add(-time.Hour).Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	tablet := &testClient{t: t, srv: c.srv, url: c.url, token: "tablet"}
+
+	list := sessions(tablet)
+	if len(list) != 3 {
+		t.Fatalf("expected 3 sessions, got: %+v", list)
+	}
+	devices := map[string]server.Session{}
+	for _, s := range list {
+		devices[s.Device] = s
+	}
+	if s := devices[""]; !s.Current || s.LastUsed.Before(now.Add(-5*time.Second)) || s.Created.After(now.Add(-time.Hour)) {
+		t.Fatalf("unexpected tablet session: %+v", s)
+	}
+	if s := devices["phone"]; s.Current || s.ID == "" || s.Created.Before(now.Add(-5*time.Second)) {
+		t.Fatalf("unexpected phone session: %+v", s)
+	}
+
+	// Sessions of others can't be revoked
+	if code := c.do("DELETE", "/sessions/"+devices["laptop"].ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+	if code := phone.do("DELETE", "/sessions/"+devices["laptop"].ID, "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := laptop.do("GET", "/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code := phone.do("DELETE", "/sessions/"+devices["laptop"].ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status: %d, got: %d", http.StatusNotFound, code)
+	}
+
+	if code := phone.do("POST", "/logout", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if code := phone.do("GET", "/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected status: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if list := sessions(tablet); len(list) != 1 {
+		t.Fatalf("expected only the tablet session left, got: %+v", list)
+	}
+
+	// The sweeper deletes expired sessions and sessions without a user
+	if err := c.srv.PutSession("expired", "alice", now.Unix()-server.ExpirationSeconds-1); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	if err := c.srv.PutSession("anonymous", "", now.Unix()); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	c.srv.SweepSessions()
+	for token, kept := range map[string]bool{"expired": false, "anonymous": false, "tablet": true, c.token: true} {
+		if c.srv.HasSession(token) != kept {
+			t.Errorf("%s: expected kept: %v", token, kept)
+		}
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-
-	"github.com/tarm/serial"
 )
 
 type Settings struct {
@@ -15,10 +13,10 @@ type Settings struct {
 	Threshold float32 `json:"threshold"`
 }
 
-func HomeSettings(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HomeSettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	buf, err := json.Marshal(settings)
+	buf, err := json.Marshal(s.house.Settings())
 	if err != nil {
 		msg := fmt.Sprintf("failed to marshal json: %v", err)
 		log.Println(msg)
@@ -30,7 +28,7 @@ func HomeSettings(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
-func SetHomeSettings(w http.ResponseWriter, r *http.Request) {
+func (s *Server) SetHomeSettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	b, err := ioutil.ReadAll(r.Body)
@@ -39,57 +37,25 @@ func SetHomeSettings(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body.Close()
 
-	if err := json.Unmarshal(b, &settings); err != nil {
-		msg := fmt.Sprintf("failed to unmarshal settings: %v", err)
+	if conn := s.arduino.State(); conn != Connected {
+		msg := fmt.Sprintf("arduino is %s", conn)
 		log.Println(msg)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(fmt.Sprintf(`{"message": "failed to set Home settings state: %s"}`, msg)))
 		return
 	}
 
-	if LIVE == true {
-		s, err := serial.OpenPort(serialConf)
-		if err != nil {
-			msg := fmt.Sprintf("failed to open port: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, msg)))
-			return
-		}
-
-		// Example Arduino commands: house_auto_ON, house_threshold_200
-		var auto string
-		if settings.Automatic {
-			auto = "house_auto_ON\n"
-		} else {
-			auto = "house_auto_OFF\n"
-		}
-
-		log.Print("Sending:", auto)
-
-		_, err = s.Write([]byte(auto))
-		if err != nil {
-			msg := fmt.Sprintf("failed to write: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, msg)))
-			return
-		}
-
-		threshold := fmt.Sprintf("house_threshold_%f\n", settings.Threshold)
-
-		log.Print("Sending:", threshold)
-
-		_, err = s.Write([]byte(threshold))
-		if err != nil {
-			msg := fmt.Sprintf("failed to write: %v", err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf(`{"message": "Light toggle failed: %s"}\n`, msg)))
-			return
+	settings, err := s.house.UpdateSettings(func(settings *Settings) error {
+		if err := json.Unmarshal(b, settings); err != nil {
+			return fmt.Errorf("failed to unmarshal settings: %v", err)
 		}
-
-		s.Close()
+		return nil
+	}, s.sendSettings)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": "failed to set Home settings state: %s"}`, err)))
+		return
 	}
 
 	msg := fmt.Sprintf("OK, current house settings: automatic: '%t', threshold: '%f'",
@@ -101,3 +67,20 @@ func SetHomeSettings(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(buf)
 }
+
+// sendSettings sends the settings to the Arduino
+func (s *Server) sendSettings(settings Settings) error {
+	// Example Arduino commands: house_auto_ON, house_threshold_200
+	auto := "house_auto_OFF"
+	if settings.Automatic {
+		auto = "house_auto_ON"
+	}
+	threshold := fmt.Sprintf("house_threshold_%f", settings.Threshold)
+
+	for _, cmd := range []string{auto, threshold} {
+		if err := s.arduino.Send(cmd); err != nil {
+			return fmt.Errorf("failed to write: %v", err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -14,43 +18,59 @@ type AuthStore struct {
 }
 
 const (
-	authBucket    = "auth"
-	sessionBucket = "sessions"
+	authBucket        = "auth"
+	sessionBucket     = "sessions"
+	temperatureBucket = "temperature"
+	luminosityBucket  = "luminosity"
+	lightBucket       = "lights"
+	scheduleBucket    = "schedules"
+	ruleBucket        = "rules"
+	sceneBucket       = "scenes"
+	playlistBucket    = "playlists"
+	trackBucket       = "tracks"
+	attemptBucket     = "attempts"
+	invitationBucket  = "invitations"
+	resetBucket       = "resets"
+	apiKeyBucket      = "apikeys"
+	revocationBucket  = "revocations"
 )
 
-var db *AuthStore
-
 // NewAuthDB returns a new and initialized db
-func NewAuthDB(file string) error {
+func NewAuthDB(file string) (*AuthStore, error) {
 	storage, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		return fmt.Errorf("failed to open new db: %v", err)
+		return nil, fmt.Errorf("failed to open new db: %v", err)
 	}
 
 	if err := storage.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(authBucket))
-		_, err = tx.CreateBucketIfNotExists([]byte(sessionBucket))
-		if err != nil {
-			return fmt.Errorf("failed to create bucket: %v", err)
+		buckets := []string{authBucket, sessionBucket, temperatureBucket, luminosityBucket, lightBucket, scheduleBucket, ruleBucket, sceneBucket, playlistBucket, trackBucket, attemptBucket, invitationBucket, resetBucket, apiKeyBucket, revocationBucket}
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return fmt.Errorf("failed to create bucket: %v", err)
+			}
 		}
 		return nil
 	}); err != nil {
-		return err
+		storage.Close()
+		return nil, err
 	}
 
-	db = &AuthStore{storage}
-
-	return nil
+	return &AuthStore{storage}, nil
 }
 
-// PutUser persists a user name and its credentials (key and salt)
-func (s *AuthStore) PutUser(user, creds string) error {
-	err := s.Update(func(tx *bolt.Tx) error {
+// PutUser persists a new user and its credentials, existing users are kept
+func (s *AuthStore) PutUser(user string, c credential) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(authBucket))
-		err := b.Put([]byte(user), []byte(creds))
-		return err
+		if b.Get([]byte(user)) != nil {
+			return ErrUserExists
+		}
+		return b.Put([]byte(user), buf)
 	})
-	return err
 }
 
 // UserCredentials retrieves a user's credentials (key and salt)
@@ -64,28 +84,322 @@ func (s *AuthStore) UserCredentials(user string) []byte {
 	return creds
 }
 
-// PutSession persists a session token and its creation date
-func (s *AuthStore) PutSession(token, created string) error {
+// Credentials retrieves the credentials of a user
+func (s *AuthStore) Credentials(user string) (credential, error) {
+	stored := s.UserCredentials(user)
+	if stored == nil {
+		return credential{}, ErrUnknownUser
+	}
+	var c credential
+	if err := json.Unmarshal(stored, &c); err != nil {
+		return credential{}, fmt.Errorf("failed to unmarshal credentials: %v", err)
+	}
+	return c, nil
+}
+
+// UpdateCredentials changes the credentials of a user at once and returns
+// them changed
+func (s *AuthStore) UpdateCredentials(user string, change func(*credential)) (credential, error) {
+	var c credential
 	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authBucket))
+		v := b.Get([]byte(user))
+		if v == nil {
+			return ErrUnknownUser
+		}
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("failed to unmarshal credentials: %v", err)
+		}
+
+		change(&c)
+		buf, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("failed to marshal credentials: %v", err)
+		}
+		return b.Put([]byte(user), buf)
+	})
+	if err != nil {
+		return credential{}, err
+	}
+	return c, nil
+}
+
+// Users retrieves the credentials of every user, by name
+func (s *AuthStore) Users() (map[string]credential, error) {
+	users := make(map[string]credential)
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var c credential
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("failed to unmarshal credentials of %s: %v", k, err)
+			}
+			users[string(k)] = c
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// HasUsers tells whether any user registered
+func (s *AuthStore) HasUsers() bool {
+	var found bool
+	_ = s.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(authBucket)).Cursor().First()
+		found = k != nil
+		return nil
+	})
+	return found
+}
+
+// HasAdmin tells whether any user is an admin
+func (s *AuthStore) HasAdmin() bool {
+	var found bool
+	_ = s.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(authBucket)).ForEach(func(k, v []byte) error {
+			var c credential
+			if err := json.Unmarshal(v, &c); err == nil && c.Role == RoleAdmin {
+				found = true
+			}
+			return nil
+		})
+	})
+	return found
+}
+
+// MigrateRoles gives the users registered before roles the member role, but
+// admin the admin role, returning how many were migrated
+func (s *AuthStore) MigrateRoles(admin string) (int, error) {
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authBucket))
+
+		// Keys can't be changed while iterating with ForEach
+		migrated := make(map[string][]byte)
+		if err := b.ForEach(func(k, v []byte) error {
+			var c credential
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("failed to unmarshal credentials of %s: %v", k, err)
+			}
+			if c.Role != "" {
+				return nil
+			}
+
+			c.Role = RoleMember
+			if string(k) == admin {
+				c.Role = RoleAdmin
+			}
+			buf, err := json.Marshal(c)
+			if err != nil {
+				return fmt.Errorf("failed to marshal credentials: %v", err)
+			}
+			migrated[string(k)] = buf
+			return nil
+		}); err != nil {
+			return err
+		}
+		for name, buf := range migrated {
+			if err := b.Put([]byte(name), buf); err != nil {
+				return err
+			}
+		}
+		n = len(migrated)
+		return nil
+	})
+	return n, err
+}
+
+// SetRole changes the role of a user and the lights it may control as a
+// guest. The last admin keeps its role.
+func (s *AuthStore) SetRole(user, role string, lights []int) (credential, error) {
+	var c credential
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authBucket))
+		v := b.Get([]byte(user))
+		if v == nil {
+			return ErrUnknownUser
+		}
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("failed to unmarshal credentials: %v", err)
+		}
+
+		if c.role() == RoleAdmin && role != RoleAdmin {
+			admins := 0
+			if err := b.ForEach(func(k, v []byte) error {
+				var other credential
+				if err := json.Unmarshal(v, &other); err != nil {
+					return fmt.Errorf("failed to unmarshal credentials of %s: %v", k, err)
+				}
+				if other.role() == RoleAdmin {
+					admins++
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if admins == 1 {
+				return invalidError("the last admin can't change role")
+			}
+		}
+
+		c.Role = role
+		c.Lights = lights
+		buf, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("failed to marshal credentials: %v", err)
+		}
+		return b.Put([]byte(user), buf)
+	})
+	if err != nil {
+		return credential{}, err
+	}
+	return c, nil
+}
+
+// PutSession persists a session token, its user and its creation date
+func (s *AuthStore) PutSession(token string, sess session) error {
+	buf, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(sessionBucket))
-		err := b.Put([]byte(token), []byte(created))
-		return err
+		return b.Put([]byte(token), buf)
 	})
-	return err
 }
 
-// SessionCreation retrieves the creation date of a session token
-func (s *AuthStore) SessionCreation(token string) (int64, error) {
-	var created int64
+// Session retrieves the session of a token
+func (s *AuthStore) Session(token string) (session, error) {
+	var sess session
 	if err := s.View(func(tx *bolt.Tx) (err error) {
 		b := tx.Bucket([]byte(sessionBucket))
-		c := b.Get([]byte(token))
-		created, err = strconv.ParseInt(string(c), 10, 64)
+		v := b.Get([]byte(token))
+		if v == nil {
+			return errUnknownSession
+		}
+		sess, err = decodeSession(v)
 		return err
 	}); err != nil {
-		return 0, err
+		return session{}, err
 	}
-	return created, nil
+	return sess, nil
+}
+
+// UserSessions retrieves the sessions of a user, by token
+func (s *AuthStore) UserSessions(user string) (map[string]session, error) {
+	sessions := make(map[string]session)
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+		return b.ForEach(func(k, v []byte) error {
+			sess, err := decodeSession(v)
+			if err != nil {
+				return err
+			}
+			if sess.Username == user {
+				sessions[string(k)] = sess
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// TouchSession records that a session was last used at now, a Unix time
+func (s *AuthStore) TouchSession(token string, now int64) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+		v := b.Get([]byte(token))
+		if v == nil {
+			return errUnknownSession
+		}
+		sess, err := decodeSession(v)
+		if err != nil {
+			return err
+		}
+
+		sess.LastUsed = now
+		buf, err := json.Marshal(sess)
+		if err != nil {
+			return fmt.Errorf("failed to marshal session: %v", err)
+		}
+		return b.Put([]byte(token), buf)
+	})
+}
+
+// DeleteExpiredSessions deletes the sessions created before a Unix time, and
+// the sessions without a user, returning how many were deleted
+func (s *AuthStore) DeleteExpiredSessions(before int64) (int, error) {
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+
+		// Keys can't be deleted while iterating with ForEach
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			sess, err := decodeSession(v)
+			if err != nil || sess.Created < before || sess.Username == "" {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// decodeSession decodes a stored session. Sessions stored before they had a
+// user only hold their creation date.
+func decodeSession(v []byte) (session, error) {
+	var sess session
+	if created, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+		sess.Created = created
+		return sess, nil
+	}
+	if err := json.Unmarshal(v, &sess); err != nil {
+		return session{}, fmt.Errorf("failed to unmarshal session: %v", err)
+	}
+	return sess, nil
+}
+
+// DeleteUserSessions deletes the sessions of a user but the one of keep,
+// returning how many were deleted
+func (s *AuthStore) DeleteUserSessions(user, keep string) (int, error) {
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+
+		// Keys can't be deleted while iterating with ForEach
+		var ended [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			sess, err := decodeSession(v)
+			if err == nil && sess.Username == user && string(k) != keep {
+				ended = append(ended, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range ended {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(ended)
+		return nil
+	})
+	return n, err
 }
 
 // DeleteSession deletes a session token
@@ -98,3 +412,922 @@ func (s *AuthStore) DeleteSession(token string) error {
 	}
 	return nil
 }
+
+// Attempts retrieves the failed attempts of a key, none if it has no failures
+func (s *AuthStore) Attempts(key string) (attempts, error) {
+	var a attempts
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(attemptBucket))
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &a); err != nil {
+			return fmt.Errorf("failed to unmarshal attempts: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return attempts{}, err
+	}
+	return a, nil
+}
+
+// UpdateAttempts changes the failed attempts of a key at once and returns
+// them changed
+func (s *AuthStore) UpdateAttempts(key string, change func(*attempts)) (attempts, error) {
+	var a attempts
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(attemptBucket))
+		if v := b.Get([]byte(key)); v != nil {
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("failed to unmarshal attempts: %v", err)
+			}
+		}
+
+		change(&a)
+		buf, err := json.Marshal(a)
+		if err != nil {
+			return fmt.Errorf("failed to marshal attempts: %v", err)
+		}
+		return b.Put([]byte(key), buf)
+	})
+	if err != nil {
+		return attempts{}, err
+	}
+	return a, nil
+}
+
+// ClearAttempts forgets the failed attempts of a key
+func (s *AuthStore) ClearAttempts(key string) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(attemptBucket))
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteAttemptsBefore deletes the attempts whose last failure is before a
+// time
+func (s *AuthStore) DeleteAttemptsBefore(before time.Time) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(attemptBucket))
+
+		// Keys can't be deleted while iterating with ForEach
+		var stale [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var a attempts
+			if err := json.Unmarshal(v, &a); err != nil || a.Last.Before(before) {
+				stale = append(stale, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var errInvitationExists = errors.New("invitation exists")
+
+// PutInvitation persists a new invitation, keyed by its code
+func (s *AuthStore) PutInvitation(inv Invitation) error {
+	buf, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invitation: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitationBucket))
+		if b.Get([]byte(inv.Code)) != nil {
+			return errInvitationExists
+		}
+		return b.Put([]byte(inv.Code), buf)
+	})
+}
+
+// Invitations retrieves all invitations, including expired ones
+func (s *AuthStore) Invitations() ([]Invitation, error) {
+	var invitations []Invitation
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitationBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var inv Invitation
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return fmt.Errorf("failed to unmarshal invitation: %v", err)
+			}
+			invitations = append(invitations, inv)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// DeleteInvitation deletes the invitation with the given id
+func (s *AuthStore) DeleteInvitation(id string) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitationBucket))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if tokenID(string(k)) == id {
+				return c.Delete()
+			}
+		}
+		return ErrUnknownInvitation
+	})
+}
+
+// RedeemInvitation registers a user with the credentials c and the role of an
+// unexpired invitation, which is deleted, all at once
+func (s *AuthStore) RedeemInvitation(code, user string, c credential, now time.Time) (credential, error) {
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitationBucket))
+		v := b.Get([]byte(code))
+		if v == nil {
+			return ErrUnknownInvitation
+		}
+		var inv Invitation
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return fmt.Errorf("failed to unmarshal invitation: %v", err)
+		}
+		if !inv.Expires.After(now) || (inv.Username != "" && inv.Username != user) {
+			return ErrUnknownInvitation
+		}
+
+		users := tx.Bucket([]byte(authBucket))
+		if users.Get([]byte(user)) != nil {
+			return ErrUserExists
+		}
+
+		c.Role = inv.Role
+		c.Lights = inv.Lights
+		buf, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("failed to marshal credentials: %v", err)
+		}
+		if err := users.Put([]byte(user), buf); err != nil {
+			return err
+		}
+		return b.Delete([]byte(code))
+	})
+	if err != nil {
+		return credential{}, err
+	}
+	return c, nil
+}
+
+// DeleteExpiredInvitations deletes the invitations expired at now, returning
+// how many were deleted
+func (s *AuthStore) DeleteExpiredInvitations(now time.Time) (int, error) {
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitationBucket))
+
+		// Keys can't be deleted while iterating with ForEach
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var inv Invitation
+			if err := json.Unmarshal(v, &inv); err != nil || !inv.Expires.After(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// PutPasswordReset persists a new password reset, keyed by its code, and
+// deletes the previous ones of its user
+func (s *AuthStore) PutPasswordReset(r PasswordReset) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal password reset: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(authBucket)).Get([]byte(r.Username)) == nil {
+			return ErrUnknownUser
+		}
+
+		b := tx.Bucket([]byte(resetBucket))
+		if b.Get([]byte(r.Code)) != nil {
+			return errResetExists
+		}
+		if err := deletePasswordResets(b, func(other PasswordReset) bool {
+			return other.Username == r.Username
+		}); err != nil {
+			return err
+		}
+		return b.Put([]byte(r.Code), buf)
+	})
+}
+
+// RedeemPasswordReset replaces the password of a user with the one of c with
+// an unexpired password reset, which is deleted, and deletes the API keys of
+// the user, all at once
+func (s *AuthStore) RedeemPasswordReset(code, user string, c credential, now time.Time) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(resetBucket))
+		v := b.Get([]byte(code))
+		if v == nil {
+			return ErrUnknownReset
+		}
+		var r PasswordReset
+		if err := json.Unmarshal(v, &r); err != nil {
+			return fmt.Errorf("failed to unmarshal password reset: %v", err)
+		}
+		if !r.Expires.After(now) || r.Username != user {
+			return ErrUnknownReset
+		}
+
+		users := tx.Bucket([]byte(authBucket))
+		stored := users.Get([]byte(user))
+		if stored == nil {
+			return ErrUnknownReset
+		}
+		var creds credential
+		if err := json.Unmarshal(stored, &creds); err != nil {
+			return fmt.Errorf("failed to unmarshal credentials: %v", err)
+		}
+		creds.setPassword(c)
+		buf, err := json.Marshal(creds)
+		if err != nil {
+			return fmt.Errorf("failed to marshal credentials: %v", err)
+		}
+		if err := users.Put([]byte(user), buf); err != nil {
+			return err
+		}
+
+		if err := b.Delete([]byte(code)); err != nil {
+			return err
+		}
+		return deleteUserAPIKeys(tx, user)
+	})
+}
+
+// DeleteExpiredPasswordResets deletes the password resets expired at now
+func (s *AuthStore) DeleteExpiredPasswordResets(now time.Time) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		return deletePasswordResets(tx.Bucket([]byte(resetBucket)), func(r PasswordReset) bool {
+			return !r.Expires.After(now)
+		})
+	})
+}
+
+// deletePasswordResets deletes the password resets matching a condition, and
+// the ones that can't be read
+func deletePasswordResets(b *bolt.Bucket, match func(PasswordReset) bool) error {
+	// Keys can't be deleted while iterating with ForEach
+	var matching [][]byte
+	if err := b.ForEach(func(k, v []byte) error {
+		var r PasswordReset
+		if err := json.Unmarshal(v, &r); err != nil || match(r) {
+			matching = append(matching, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range matching {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutAPIKey persists a new API key, keyed by its hash
+func (s *AuthStore) PutAPIKey(hash string, k apiKey) error {
+	buf, err := json.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b.Get([]byte(hash)) != nil {
+			return errAPIKeyExists
+		}
+		return b.Put([]byte(hash), buf)
+	})
+}
+
+// APIKey retrieves the API key stored under a hash
+func (s *AuthStore) APIKey(hash string) (apiKey, error) {
+	var k apiKey
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return ErrUnknownAPIKey
+		}
+		if err := json.Unmarshal(v, &k); err != nil {
+			return fmt.Errorf("failed to unmarshal API key: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return apiKey{}, err
+	}
+	return k, nil
+}
+
+// UserAPIKeys retrieves the API keys of a user, by hash
+func (s *AuthStore) UserAPIKeys(user string) (map[string]apiKey, error) {
+	keys := make(map[string]apiKey)
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var key apiKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return fmt.Errorf("failed to unmarshal API key: %v", err)
+			}
+			if key.Username == user {
+				keys[string(k)] = key
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// TouchAPIKey records that an API key was last used at now, a Unix time
+func (s *AuthStore) TouchAPIKey(hash string, now int64) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return ErrUnknownAPIKey
+		}
+		var k apiKey
+		if err := json.Unmarshal(v, &k); err != nil {
+			return fmt.Errorf("failed to unmarshal API key: %v", err)
+		}
+
+		k.LastUsed = now
+		buf, err := json.Marshal(k)
+		if err != nil {
+			return fmt.Errorf("failed to marshal API key: %v", err)
+		}
+		return b.Put([]byte(hash), buf)
+	})
+}
+
+// DeleteAPIKey deletes the API key of a user with the given id
+func (s *AuthStore) DeleteAPIKey(user, id string) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if apiKeyID(string(k)) != id {
+				continue
+			}
+			var key apiKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return fmt.Errorf("failed to unmarshal API key: %v", err)
+			}
+			if key.Username == user {
+				return c.Delete()
+			}
+		}
+		return ErrUnknownAPIKey
+	})
+}
+
+// DeleteUserAPIKeys deletes the API keys of a user
+func (s *AuthStore) DeleteUserAPIKeys(user string) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		return deleteUserAPIKeys(tx, user)
+	})
+}
+
+func deleteUserAPIKeys(tx *bolt.Tx, user string) error {
+	b := tx.Bucket([]byte(apiKeyBucket))
+
+	// Keys can't be deleted while iterating with ForEach
+	var owned [][]byte
+	if err := b.ForEach(func(k, v []byte) error {
+		var key apiKey
+		if err := json.Unmarshal(v, &key); err != nil {
+			return fmt.Errorf("failed to unmarshal API key: %v", err)
+		}
+		if key.Username == user {
+			owned = append(owned, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range owned {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutLight persists a light, keyed by its id
+func (s *AuthStore) PutLight(l Light) error {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal light: %v", err)
+	}
+
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightBucket))
+		return b.Put(itob(l.ID), buf)
+	})
+}
+
+// AddLight persists a new light with the next id. Ids aren't reused, so that
+// nothing referring to a deleted light drives the new one.
+func (s *AuthStore) AddLight(l Light) (Light, error) {
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightBucket))
+
+		// Lights created on first start don't advance the sequence
+		for {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			l.ID = int(id)
+			if b.Get(itob(l.ID)) == nil {
+				break
+			}
+		}
+
+		buf, err := json.Marshal(l)
+		if err != nil {
+			return fmt.Errorf("failed to marshal light: %v", err)
+		}
+		return b.Put(itob(l.ID), buf)
+	})
+	if err != nil {
+		return Light{}, err
+	}
+	return l, nil
+}
+
+// Lights retrieves all lights ordered by id
+func (s *AuthStore) Lights() ([]Light, error) {
+	var lights []Light
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var l Light
+			if err := json.Unmarshal(v, &l); err != nil {
+				return fmt.Errorf("failed to unmarshal light: %v", err)
+			}
+			lights = append(lights, l)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return lights, nil
+}
+
+// DeleteLight deletes a light
+func (s *AuthStore) DeleteLight(id int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightBucket))
+		return b.Delete(itob(id))
+	})
+}
+
+// PutSchedule persists a schedule, keyed by its id
+func (s *AuthStore) PutSchedule(sc Schedule) error {
+	buf, err := json.Marshal(sc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule: %v", err)
+	}
+
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(scheduleBucket))
+		return b.Put(itob(sc.ID), buf)
+	})
+}
+
+// Schedules retrieves all schedules ordered by id
+func (s *AuthStore) Schedules() ([]Schedule, error) {
+	var schedules []Schedule
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(scheduleBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var sc Schedule
+			if err := json.Unmarshal(v, &sc); err != nil {
+				return fmt.Errorf("failed to unmarshal schedule: %v", err)
+			}
+			schedules = append(schedules, sc)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule deletes a schedule
+func (s *AuthStore) DeleteSchedule(id int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(scheduleBucket))
+		return b.Delete(itob(id))
+	})
+}
+
+// PutRule persists a rule, keyed by its id
+func (s *AuthStore) PutRule(r Rule) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rule: %v", err)
+	}
+
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ruleBucket))
+		return b.Put(itob(r.ID), buf)
+	})
+}
+
+// Rules retrieves all rules ordered by id
+func (s *AuthStore) Rules() ([]Rule, error) {
+	var rules []Rule
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ruleBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var r Rule
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("failed to unmarshal rule: %v", err)
+			}
+			rules = append(rules, r)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// DeleteRule deletes a rule
+func (s *AuthStore) DeleteRule(id int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ruleBucket))
+		return b.Delete(itob(id))
+	})
+}
+
+// PutScene persists a scene, assigning it the next id if it has none
+func (s *AuthStore) PutScene(sc Scene) (Scene, error) {
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sceneBucket))
+		if sc.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			sc.ID = int(id)
+		}
+
+		buf, err := json.Marshal(sc)
+		if err != nil {
+			return fmt.Errorf("failed to marshal scene: %v", err)
+		}
+		return b.Put(itob(sc.ID), buf)
+	})
+	if err != nil {
+		return Scene{}, err
+	}
+	return sc, nil
+}
+
+// Scene retrieves a scene
+func (s *AuthStore) Scene(id int) (Scene, error) {
+	var sc Scene
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sceneBucket))
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrUnknownScene
+		}
+		if err := json.Unmarshal(v, &sc); err != nil {
+			return fmt.Errorf("failed to unmarshal scene: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return Scene{}, err
+	}
+	return sc, nil
+}
+
+// Scenes retrieves all scenes ordered by id
+func (s *AuthStore) Scenes() ([]Scene, error) {
+	scenes := []Scene{}
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sceneBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var sc Scene
+			if err := json.Unmarshal(v, &sc); err != nil {
+				return fmt.Errorf("failed to unmarshal scene: %v", err)
+			}
+			scenes = append(scenes, sc)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return scenes, nil
+}
+
+// DeleteScene deletes a scene
+func (s *AuthStore) DeleteScene(id int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sceneBucket))
+		if b.Get(itob(id)) == nil {
+			return ErrUnknownScene
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+// PutPlaylist persists a playlist, assigning it the next id if it has none
+func (s *AuthStore) PutPlaylist(p Playlist) (Playlist, error) {
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(playlistBucket))
+		if p.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			p.ID = int(id)
+		}
+
+		buf, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("failed to marshal playlist: %v", err)
+		}
+		return b.Put(itob(p.ID), buf)
+	})
+	if err != nil {
+		return Playlist{}, err
+	}
+	return p, nil
+}
+
+// Playlist retrieves a playlist
+func (s *AuthStore) Playlist(id int) (Playlist, error) {
+	var p Playlist
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(playlistBucket))
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrUnknownPlaylist
+		}
+		if err := json.Unmarshal(v, &p); err != nil {
+			return fmt.Errorf("failed to unmarshal playlist: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return Playlist{}, err
+	}
+	return p, nil
+}
+
+// Playlists retrieves all playlists ordered by id
+func (s *AuthStore) Playlists() ([]Playlist, error) {
+	playlists := []Playlist{}
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(playlistBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var p Playlist
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("failed to unmarshal playlist: %v", err)
+			}
+			playlists = append(playlists, p)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return playlists, nil
+}
+
+// DeletePlaylist deletes a playlist
+func (s *AuthStore) DeletePlaylist(id int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(playlistBucket))
+		if b.Get(itob(id)) == nil {
+			return ErrUnknownPlaylist
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+// LibraryEntries retrieves the indexed tracks ordered by id
+func (s *AuthStore) LibraryEntries() ([]libraryEntry, error) {
+	var entries []libraryEntry
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(trackBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var e libraryEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("failed to unmarshal track: %v", err)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// UpdateLibrary persists the changed tracks, assigning the next id to new
+// ones, and deletes the removed ones, all at once
+func (s *AuthStore) UpdateLibrary(changed []libraryEntry, removed []int) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(trackBucket))
+		for _, e := range changed {
+			if e.Track.ID == 0 {
+				id, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				e.Track.ID = int(id)
+			}
+
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("failed to marshal track: %v", err)
+			}
+			if err := b.Put(itob(e.Track.ID), buf); err != nil {
+				return err
+			}
+		}
+
+		for _, id := range removed {
+			if err := b.Delete(itob(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// itob returns the big endian representation of an id, so keys sort by id
+func itob(id int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// reading is a sensor value at a point in time
+type reading struct {
+	Time  time.Time
+	Value float32
+}
+
+// PutReading persists a sensor reading, keyed by time
+func (s *AuthStore) PutReading(sensor string, t time.Time, value float32) error {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	val := strconv.FormatFloat(float64(value), 'f', -1, 32)
+
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sensor))
+		if b == nil {
+			return fmt.Errorf("unknown sensor: %s", sensor)
+		}
+		return b.Put(key, []byte(val))
+	})
+}
+
+// Readings retrieves the readings of a sensor taken in [from, to), oldest first
+func (s *AuthStore) Readings(sensor string, from, to time.Time) ([]reading, error) {
+	min := make([]byte, 8)
+	binary.BigEndian.PutUint64(min, uint64(from.UnixNano()))
+	max := make([]byte, 8)
+	binary.BigEndian.PutUint64(max, uint64(to.UnixNano()))
+
+	var readings []reading
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sensor))
+		if b == nil {
+			return fmt.Errorf("unknown sensor: %s", sensor)
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, v = c.Next() {
+			value, err := strconv.ParseFloat(string(v), 32)
+			if err != nil {
+				return fmt.Errorf("failed to parse reading: %v", err)
+			}
+			readings = append(readings, reading{
+				Time:  time.Unix(0, int64(binary.BigEndian.Uint64(k))),
+				Value: float32(value),
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// DeleteReadingsBefore deletes the readings of a sensor taken before a time,
+// returning how many were deleted
+func (s *AuthStore) DeleteReadingsBefore(sensor string, before time.Time) (int, error) {
+	max := make([]byte, 8)
+	binary.BigEndian.PutUint64(max, uint64(before.UnixNano()))
+
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sensor))
+		if b == nil {
+			return fmt.Errorf("unknown sensor: %s", sensor)
+		}
+
+		// Keys are sorted by time, the oldest is deleted until it is recent
+		// enough, seeking again as deleting leaves the cursor undefined
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// PutRevocation persists a revocation of signed session tokens under a key
+func (s *AuthStore) PutRevocation(key string, r revocation) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation: %v", err)
+	}
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(revocationBucket))
+		return b.Put([]byte(key), buf)
+	})
+}
+
+// Revocations retrieves the revocations of signed session tokens, by key
+func (s *AuthStore) Revocations() (map[string]revocation, error) {
+	revocations := make(map[string]revocation)
+	if err := s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(revocationBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var r revocation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("failed to unmarshal revocation: %v", err)
+			}
+			revocations[string(k)] = r
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// DeleteExpiredRevocations deletes the revocations of tokens all expired at
+// now, a Unix time, returning how many were deleted
+func (s *AuthStore) DeleteExpiredRevocations(now int64) (int, error) {
+	var n int
+	err := s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(revocationBucket))
+
+		// Keys can't be deleted while iterating with ForEach
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var r revocation
+			if err := json.Unmarshal(v, &r); err != nil || r.expired(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
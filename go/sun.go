@@ -0,0 +1,60 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// julianUnixEpoch is the Julian date of the Unix epoch
+	julianUnixEpoch = 2440587.5
+	// julian2000 is the Julian date of 2000-01-01 12:00 UTC
+	julian2000 = 2451545.0
+	// sunAltitude is the altitude of the center of the sun at sunrise and
+	// sunset, allowing for refraction and its radius, in degrees
+	sunAltitude   = -0.833
+	minutesPerDay = 24 * 60
+)
+
+// sunTimes returns the minutes since midnight of sunrise and sunset on the day
+// of t, in its time zone, at a latitude and longitude in degrees, east and
+// north positive. On days the sun doesn't rise sunrise is at the end of the
+// day and sunset at its start, on days it doesn't set the other way around.
+func sunTimes(t time.Time, latitude, longitude float64) (rise, set int) {
+	// Days since 2000-01-01 12:00 UTC to the solar noon of the day
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	n := math.Ceil(float64(midnight.Unix())/86400 + julianUnixEpoch - julian2000 + 0.0008)
+	mean := n - longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*mean, 360)
+	center := 1.9148*sinDeg(anomaly) + 0.02*sinDeg(2*anomaly) + 0.0003*sinDeg(3*anomaly)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + mean + 0.0053*sinDeg(anomaly) - 0.0069*sinDeg(2*ecliptic)
+	declination := math.Asin(sinDeg(ecliptic) * sinDeg(23.4397))
+
+	cosHour := (sinDeg(sunAltitude) - sinDeg(latitude)*math.Sin(declination)) / (cosDeg(latitude) * math.Cos(declination))
+	switch {
+	case cosHour > 1:
+		return minutesPerDay, 0
+	case cosHour < -1:
+		return 0, minutesPerDay
+	}
+	hour := math.Acos(cosHour) * 180 / math.Pi
+
+	return julianMinutes(transit-hour/360, t.Location()), julianMinutes(transit+hour/360, t.Location())
+}
+
+// julianMinutes returns the minutes since midnight of a Julian date in loc
+func julianMinutes(julian float64, loc *time.Location) int {
+	t := time.Unix(int64(math.Round((julian-julianUnixEpoch)*86400)), 0).In(loc)
+	return t.Hour()*60 + t.Minute()
+}
+
+func sinDeg(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cosDeg(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// minSessionKeyLength is the length in bytes session keys need at least, the
+// size of the HMAC-SHA256 output
+const minSessionKeyLength = 32
+
+// tokenHeader is the JWT header of signed session tokens
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	// KeyID identifies the session key the token is signed with
+	KeyID string `json:"kid"`
+}
+
+// tokenClaims are the JWT claims of signed session tokens, they carry what
+// the bolt backend reads from the database
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	Lights  []int  `json:"lights,omitempty"`
+	Device  string `json:"device,omitempty"`
+	// IssuedAt is a Unix time in seconds with millisecond precision, which
+	// tells the tokens of a user revoked by a password change from the ones
+	// issued right after it
+	IssuedAt  float64 `json:"iat"`
+	ExpiresAt int64   `json:"exp"`
+	ID        string  `json:"jti"`
+}
+
+func (c tokenClaims) issuedMillis() int64 {
+	return int64(math.Round(c.IssuedAt * 1000))
+}
+
+// revocation ends signed session tokens before they expire. It is stored
+// under "token:" and the id of a token to revoke that token, or under "user:"
+// and a username to revoke the tokens of the user issued until Before.
+type revocation struct {
+	// Before is a Unix time in milliseconds
+	Before int64 `json:",omitempty"`
+	// Keep is the id of a token of the user that stays valid
+	Keep string `json:",omitempty"`
+	// Expires is the Unix time the revoked tokens all expired at
+	Expires int64
+}
+
+// expired tells whether the revoked tokens all expired at now, a Unix time
+func (r revocation) expired(now int64) bool {
+	return now > r.Expires
+}
+
+// signedSessions issues HMAC-SHA256 signed JWTs carrying the user of the
+// session, so that servers sharing the keys check them without a database.
+// Role changes apply to the tokens issued after them, or when revoked by this
+// server. Revocations are kept in memory and in the database, and only end
+// the tokens on this server.
+type signedSessions struct {
+	// keys are the session keys by id, the one of signWith signs new tokens
+	keys     map[string][]byte
+	signWith string
+	db       *AuthStore
+
+	mu      sync.Mutex
+	revoked map[string]revocation
+}
+
+// newSignedSessions returns signed sessions signing tokens with the first of
+// keys, and restores the revocations stored in db
+func newSignedSessions(keys []string, db *AuthStore) (*signedSessions, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no session key")
+	}
+
+	revoked, err := db.Revocations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocations: %v", err)
+	}
+
+	s := &signedSessions{
+		keys:     make(map[string][]byte),
+		signWith: tokenID(keys[0]),
+		db:       db,
+		revoked:  revoked,
+	}
+	for _, k := range keys {
+		s.keys[tokenID(k)] = []byte(k)
+	}
+	return s, nil
+}
+
+func (s *signedSessions) create(sess session) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate uuid: %v", err)
+	}
+
+	now := time.Now()
+	claims := tokenClaims{
+		Subject:   sess.user.Username,
+		Role:      sess.user.Role,
+		Lights:    sess.user.Lights,
+		Device:    sess.Device,
+		IssuedAt:  float64(now.UnixNano()/int64(time.Millisecond)) / 1000,
+		ExpiresAt: now.Unix() + expirationSeconds,
+		ID:        id,
+	}
+
+	header, err := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT", KeyID: s.signWith})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token claims: %v", err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(s.keys[s.signWith], signed)), nil
+}
+
+func sign(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// verify returns the claims of a token signed with one of the keys
+func (s *signedSessions) verify(token string) (tokenClaims, error) {
+	invalid := errors.New("invalid session token")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, invalid
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return tokenClaims{}, invalid
+	}
+	key, ok := s.keys[header.KeyID]
+	if !ok {
+		return tokenClaims{}, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return tokenClaims{}, invalid
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil || claims.Subject == "" || claims.ID == "" {
+		return tokenClaims{}, invalid
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (s *signedSessions) check(token string, now int64) (session, error) {
+	claims, err := s.verify(token)
+	if err != nil {
+		return session{}, err
+	}
+	if now > claims.ExpiresAt {
+		return session{}, errors.New("session expired")
+	}
+	if s.isRevoked(claims) {
+		return session{}, errors.New("session revoked")
+	}
+
+	return session{
+		Username: claims.Subject,
+		Device:   claims.Device,
+		Created:  int64(claims.IssuedAt),
+		LastUsed: now,
+		token:    token,
+		user:     User{Username: claims.Subject, Role: claims.Role, Lights: claims.Lights},
+	}, nil
+}
+
+func (s *signedSessions) isRevoked(c tokenClaims) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revoked["token:"+c.ID]; ok {
+		return true
+	}
+	r, ok := s.revoked["user:"+c.Subject]
+	return ok && c.issuedMillis() <= r.Before && c.ID != r.Keep
+}
+
+// list returns no sessions, signed sessions aren't kept
+func (s *signedSessions) list(user string) (map[string]session, error) {
+	return make(map[string]session), nil
+}
+
+func (s *signedSessions) revoke(token string) error {
+	claims, err := s.verify(token)
+	if err != nil {
+		return err
+	}
+	return s.record("token:"+claims.ID, revocation{Expires: claims.ExpiresAt})
+}
+
+// revokeUser revokes the tokens of user issued until now, which all expire
+// within the session expiration
+func (s *signedSessions) revokeUser(user, keep string) error {
+	var keepID string
+	if keep != "" {
+		if claims, err := s.verify(keep); err == nil {
+			keepID = claims.ID
+		}
+	}
+
+	now := time.Now()
+	return s.record("user:"+user, revocation{
+		Before:  now.UnixNano() / int64(time.Millisecond),
+		Keep:    keepID,
+		Expires: now.Unix() + expirationSeconds,
+	})
+}
+
+// userChanged revokes the tokens of the user, which carry its previous role
+func (s *signedSessions) userChanged(user string) error {
+	return s.revokeUser(user, "")
+}
+
+// record persists a revocation, then applies it
+func (s *signedSessions) record(key string, r revocation) error {
+	if err := s.db.PutRevocation(key, r); err != nil {
+		return fmt.Errorf("failed to put revocation: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[key] = r
+	return nil
+}
+
+// sweep forgets the revocations of expired tokens, signed sessions expire on
+// their own
+func (s *signedSessions) sweep(now int64) (int, error) {
+	s.mu.Lock()
+	for key, r := range s.revoked {
+		if r.expired(now) {
+			delete(s.revoked, key)
+		}
+	}
+	s.mu.Unlock()
+
+	return s.db.DeleteExpiredRevocations(now)
+}
@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	server "github.com/freddygv/SmartHouse-Server/go"
+)
+
+func TestSignedSessions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey := strings.Repeat("old session key ", 2)
+	newKey := strings.Repeat("new session key ", 2)
+
+	// start starts a server signing sessions with the first of keys, on which
+	// requests are then sent
+	var c *testClient
+	start := func(keys ...string) func() {
+		cfg := testConfig(filepath.Join(dir, "test.db"))
+		cfg.Sessions, cfg.SessionKeys = "signed", keys
+		var stop func()
+		_, c, stop = startConfiguredTestServer(t, cfg, nil)
+		return stop
+	}
+	with := func(token string) *testClient {
+		return &testClient{t: t, srv: c.srv, url: c.url, token: token}
+	}
+	login := func(name string) string {
+		var token server.StatusResponse
+		if code := with("").do("POST", "/login", fmt.Sprintf(`{"username": %q, "password": "password"}`, name), &token); code != http.StatusOK {
+			t.Fatalf("login %s: expected status: %d, got: %d", name, http.StatusOK, code)
+		}
+		return token.Message
+	}
+	expect := func(desc, token string, code int) {
+		if got := with(token).do("GET", "/sessions", "", nil); got != code {
+			t.Fatalf("%s: expected status: %d, got: %d", desc, code, got)
+		}
+	}
+
+	stop := start(oldKey)
+	admin := login("admin")
+	if err := c.srv.PutUser("alice", server.RoleMember); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+	if err := c.srv.PutUser("bob", server.RoleGuest, 2); err != nil {
+		t.Fatalf("failed to put user: %v", err)
+	}
+
+	// Tokens are JWTs carrying the user, and list their own session
+	first := login("alice")
+	if parts := strings.Split(first, "."); len(parts) != 3 {
+		t.Fatalf("expected a JWT, got: %s", first)
+	}
+	var sessions []server.Session
+	if code := with(first).do("GET", "/sessions", "", &sessions); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("expected the current session, got: %+v", sessions)
+	}
+
+	// Tampered tokens are refused
+	parts := strings.Split(first, ".")
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(claims), `"member"`, `"admin"`, 1)))
+	expect("tampered", strings.Join(parts, "."), http.StatusUnauthorized)
+
+	// Logouts and password changes revoke tokens
+	third := login("alice")
+	if code := with(third).do("POST", "/logout", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expect("logged out", third, http.StatusUnauthorized)
+
+	second := login("alice")
+	if code := with(first).do("PUT", "/password", `{"currentPassword": "password", "newPassword": "password"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expect("changed password", first, http.StatusOK)
+	expect("other session", second, http.StatusUnauthorized)
+
+	// Role changes revoke the tokens carrying the previous role
+	guest := login("bob")
+	if code := with(admin).do("PUT", "/users/bob/role", `{"role": "member"}`, nil); code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, code)
+	}
+	expect("previous role", guest, http.StatusUnauthorized)
+	stop()
+
+	// Tokens signed with previous keys stay valid while rotating, and
+	// revocations are kept
+	stop = start(newKey, oldKey)
+	expect("rotating", first, http.StatusOK)
+	expect("revoked", second, http.StatusUnauthorized)
+	rotated := login("alice")
+	stop()
+
+	stop = start(newKey)
+	defer stop()
+	expect("rotated", first, http.StatusUnauthorized)
+	expect("new key", rotated, http.StatusOK)
+	expect("login", login("bob"), http.StatusOK)
+}
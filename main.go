@@ -1,24 +1,32 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
+	"os"
 
 	server "github.com/freddygv/SmartHouse-Server/go"
 )
 
-var (
-	device = "/dev/ttyACM0"
-	baud   = 9600
-)
-
 func main() {
-	router := server.NewServer(device, baud)
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
 
-	log.Printf("Server started...\n")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8888", router))
+	driver, err := server.NewDriver(cfg)
+	if err != nil {
+		log.Fatalf("failed to create driver: %v", err)
+	}
+	srv, err := server.NewServer(cfg, driver)
+	if err != nil {
+		log.Fatalf("failed to start server: %v", err)
+	}
 
-	// Make requests for temperature
-	// Make requests for luminosity
-	// Make request for settings
+	log.Printf("Server started on %s...\n", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, srv))
 }